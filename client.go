@@ -29,6 +29,7 @@ type Client struct {
 	ReadTimeout  time.Duration     // the net.Conn.SetReadTimeout value for new connections (ns), defauls to 2 * 1e9
 	WriteTimeout time.Duration     // the net.Conn.SetWriteTimeout value for new connections (ns), defauls to 2 * 1e9
 	TsigSecret   map[string]string // secret(s) for Tsig map[<zonename>]<base64 secret>
+	LocalAddr    net.Addr          // the local address to send from, such as &net.UDPAddr{IP: ip}, if nil the kernel picks one
 }
 
 func (w *reply) RemoteAddr() net.Addr {
@@ -132,11 +133,12 @@ func (c *Client) ExchangeRtt(m *Msg, a string) (r *Msg, rtt time.Duration, err e
 // dial connects to the address addr for the network set in c.Net
 func (w *reply) dial() (err error) {
 	var conn net.Conn
-	if w.client.Net == "" {
-		conn, err = net.Dial("udp", w.addr)
-	} else {
-		conn, err = net.Dial(w.client.Net, w.addr)
+	network := w.client.Net
+	if network == "" {
+		network = "udp"
 	}
+	d := net.Dialer{LocalAddr: localAddr(network, w.client.LocalAddr)}
+	conn, err = d.Dial(network, w.addr)
 	if err != nil {
 		return
 	}
@@ -144,6 +146,32 @@ func (w *reply) dial() (err error) {
 	return nil
 }
 
+// localAddr returns the local address a as the address type of network,
+// so a *net.UDPAddr can be used for TCP and the other way around. The
+// port only makes sense for one of them, but is kept as well.
+func localAddr(network string, a net.Addr) net.Addr {
+	var (
+		ip   net.IP
+		zone string
+		port int
+	)
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip, zone, port = a.IP, a.Zone, a.Port
+	case *net.TCPAddr:
+		ip, zone, port = a.IP, a.Zone, a.Port
+	default:
+		return a
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return &net.TCPAddr{IP: ip, Port: port, Zone: zone}
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: ip, Port: port, Zone: zone}
+	}
+	return a
+}
+
 func (w *reply) receive() (*Msg, error) {
 	var p []byte
 	m := new(Msg)
@@ -0,0 +1,82 @@
+package dns
+
+// Server side DNS cookies, RFC 7873.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+const (
+	clientCookieLen = 8  // length of a client cookie
+	serverCookieLen = 8  // length of the server cookies we hand out
+	maxCookieLen    = 40 // a client cookie and the longest server cookie
+)
+
+// serverCookie returns the server cookie for the client at ip with the
+// client cookie client: the first serverCookieLen bytes of an HMAC-SHA256
+// keyed with secret over both.
+func serverCookie(secret []byte, ip net.IP, client []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	h.Write(client)
+	return h.Sum(nil)[:serverCookieLen]
+}
+
+// checkCookie looks at the COOKIE option of the request r from a. It
+// returns the option to put in the reply, or nil if r has no cookie, and
+// whether r returned a valid server cookie. A forged or stale server
+// cookie is not valid, the reply then carries a fresh one. ErrCookie is
+// returned when the option is malformed.
+func (srv *Server) checkCookie(a net.Addr, r *Msg) (*EDNS0_COOKIE, bool, error) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, false, nil
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(b) < clientCookieLen || len(b) > maxCookieLen ||
+			(len(b) > clientCookieLen && len(b) < clientCookieLen+8) {
+			return nil, false, ErrCookie
+		}
+		client := b[:clientCookieLen]
+		server := serverCookie(srv.CookieSecret, addrIP(a), client)
+		valid := hmac.Equal(b[clientCookieLen:], server)
+		reply := &EDNS0_COOKIE{Code: EDNS0COOKIE, Cookie: hex.EncodeToString(append(client, server...))}
+		return reply, valid, nil
+	}
+	return nil, false, nil
+}
+
+// withCookie returns a copy of m with the cookie option c in its OPT
+// record, which must be present. A cookie option already there is replaced.
+func withCookie(m *Msg, c *EDNS0_COOKIE) *Msg {
+	t := *m
+	t.Extra = make([]RR, len(m.Extra))
+	for i, r := range m.Extra {
+		opt, ok := r.(*RR_OPT)
+		if !ok {
+			t.Extra[i] = r
+			continue
+		}
+		o := *opt
+		o.Option = nil
+		for _, e := range opt.Option {
+			if e.Option() != EDNS0COOKIE {
+				o.Option = append(o.Option, e)
+			}
+		}
+		o.Option = append(o.Option, c)
+		t.Extra[i] = &o
+	}
+	return &t
+}
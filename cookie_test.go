@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServerCookie(t *testing.T) {
+	secret := []byte("secret")
+	ip := net.ParseIP("192.0.2.1")
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	c := serverCookie(secret, ip, client)
+	if len(c) != serverCookieLen {
+		t.Fatalf("Expected a %d byte server cookie, got %d bytes", serverCookieLen, len(c))
+	}
+	if string(serverCookie(secret, ip, client)) != string(c) {
+		t.Log("Server cookie is not deterministic")
+		t.Fail()
+	}
+	if string(serverCookie(secret, ip.To16(), client)) != string(c) {
+		t.Log("Server cookie differs for the 16 byte form of an IPv4 address")
+		t.Fail()
+	}
+	others := [][]byte{
+		serverCookie([]byte("other"), ip, client),
+		serverCookie(secret, net.ParseIP("192.0.2.2"), client),
+		serverCookie(secret, ip, []byte{8, 7, 6, 5, 4, 3, 2, 1}),
+	}
+	for i, o := range others {
+		if string(o) == string(c) {
+			t.Logf("Server cookie %d should differ", i)
+			t.Fail()
+		}
+	}
+}
+
+func cookieRequest(cookie string) *Msg {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &EDNS0_COOKIE{Code: EDNS0COOKIE, Cookie: cookie})
+	return m
+}
+
+func TestCheckCookie(t *testing.T) {
+	srv := &Server{CookieSecret: []byte("secret")}
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000}
+	client := "0102030405060708"
+
+	c, valid, err := srv.checkCookie(a, cookieRequest(client))
+	if err != nil || valid || c == nil || len(c.Cookie) != 2*(clientCookieLen+serverCookieLen) || c.Cookie[:16] != client {
+		t.Fatalf("Bad reply cookie %v for a client cookie: %v", c, err)
+	}
+	if _, valid, _ := srv.checkCookie(a, cookieRequest(c.Cookie)); !valid {
+		t.Log("Returned server cookie is not valid")
+		t.Fail()
+	}
+	if _, valid, _ := srv.checkCookie(&net.UDPAddr{IP: net.ParseIP("192.0.2.2")}, cookieRequest(c.Cookie)); valid {
+		t.Log("Server cookie is valid from another address")
+		t.Fail()
+	}
+	forged := client + "0000000000000000"
+	c2, valid, err := srv.checkCookie(a, cookieRequest(forged))
+	if err != nil || valid {
+		t.Log("Forged server cookie is accepted")
+		t.Fail()
+	}
+	if c2 == nil || c2.Cookie != c.Cookie {
+		t.Logf("Expected a fresh server cookie %s for a forged one, got %v", c.Cookie, c2)
+		t.Fail()
+	}
+	for _, bad := range []string{"01020304", client + "0102", client + "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f2021"} {
+		if _, _, err := srv.checkCookie(a, cookieRequest(bad)); err != ErrCookie {
+			t.Logf("Expected ErrCookie for %s, got %v", bad, err)
+			t.Fail()
+		}
+	}
+	if c, _, err := srv.checkCookie(a, new(Msg).SetQuestion("miek.nl.", TypeA)); c != nil || err != nil {
+		t.Log("Expected no cookie for a request without one")
+		t.Fail()
+	}
+}
+
+func TestServingCookies(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServerLarge)}
+	srv.CookieSecret = []byte("secret")
+	// one request, then everything is limited
+	srv.Limiter = NewRateLimiter(0.001, 1)
+	srv.LimitTruncate = true
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+	c := new(Client)
+
+	// without a valid server cookie the reply does not fit in 512 bytes
+	r, err := c.Exchange(cookieRequest("0102030405060708"), addr)
+	if err != nil {
+		t.Fatalf("Exchange failed: %s", err.Error())
+	}
+	if !r.Truncated || len(r.Answer) == 50 {
+		t.Log("Expected a truncated reply without a server cookie")
+		t.Fail()
+	}
+	var cookie string
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*EDNS0_COOKIE); ok {
+				cookie = e.Cookie
+			}
+		}
+	}
+	if len(cookie) != 32 {
+		t.Fatalf("Expected a client and server cookie in the reply, got %q", cookie)
+	}
+
+	// the limiter is exhausted, a forged cookie does not help
+	r, err = c.Exchange(cookieRequest("01020304050607080000000000000000"), addr)
+	if err != nil || !r.Truncated {
+		t.Logf("Expected a limited reply for a forged cookie: %v", err)
+		t.Fail()
+	}
+
+	// a valid cookie skips the limiter and gets the full reply
+	r, err = c.Exchange(cookieRequest(cookie), addr)
+	if err != nil || r.Truncated || len(r.Answer) != 50 {
+		t.Logf("Expected the full reply with a valid cookie: %v", err)
+		t.Fail()
+	}
+}
+
+func TestUnpackCookieOption(t *testing.T) {
+	m := cookieRequest("0102030405060708")
+	opt := m.IsEdns0()
+	opt.Option = append([]EDNS0{&EDNS0_NSID{Code: EDNS0NSID, Nsid: "beef"}}, opt.Option...)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack: %s", err.Error())
+	}
+	// add an unknown option, code 0xfde9 with 2 bytes, which is skipped;
+	// the OPT record is last, its rdlength precedes the 18 bytes of options
+	buf[len(buf)-19] += 6
+	buf = append(buf, 0xfd, 0xe9, 0, 2, 0xab, 0xcd)
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatalf("Failed to unpack: %s", err.Error())
+	}
+	opt = r.IsEdns0()
+	if opt == nil || len(opt.Option) != 2 {
+		t.Fatalf("Expected 2 options, got %v", opt)
+	}
+	if c, ok := opt.Option[1].(*EDNS0_COOKIE); !ok || c.Cookie != "0102030405060708" {
+		t.Logf("Bad cookie option %v", opt.Option[1])
+		t.Fail()
+	}
+}
@@ -11,7 +11,9 @@ const hexDigit = "0123456789abcdef"
 // Everything is assumed in the ClassINET class. If
 // you need other classes you are on your own.
 
-// SetReply creates a reply packet from a request message.
+// SetReply creates a reply packet from a request message. The question is
+// copied byte for byte, so the case of the name is kept for resolvers
+// that randomize it (DNS 0x20).
 func (dns *Msg) SetReply(request *Msg) *Msg {
 	dns.Id = request.Id
 	dns.RecursionDesired = request.RecursionDesired // Copy rd bit
@@ -25,6 +27,18 @@ func (dns *Msg) SetReply(request *Msg) *Msg {
 	return dns
 }
 
+// SetReplyEdns0 works like SetReply, but when the request has an OPT RR an
+// OPT RR is also added to the reply, with the DO bit copied from the
+// request (RFC 3225). The UDP size in it is udpsize, the size of the
+// largest reply this side accepts, not the size the client advertised.
+func (dns *Msg) SetReplyEdns0(request *Msg, udpsize uint16) *Msg {
+	dns.SetReply(request)
+	if opt := request.IsEdns0(); opt != nil {
+		dns.SetEdns0(udpsize, opt.Do())
+	}
+	return dns
+}
+
 // SetQuestion creates a question packet.
 func (dns *Msg) SetQuestion(z string, t uint16) *Msg {
 	dns.Id = Id()
@@ -68,6 +82,113 @@ func (dns *Msg) SetRcodeFormatError(request *Msg) *Msg {
 	return dns
 }
 
+// SetRcodeNotImplemented creates a packet with NotImplemented set, for a
+// request with an opcode or a feature the server does not implement. The
+// opcode of the request is copied, so the client can tell which one.
+func (dns *Msg) SetRcodeNotImplemented(request *Msg) *Msg {
+	dns.setRcodeOnly(request, RcodeNotImplemented)
+	dns.Opcode = request.Opcode
+	return dns
+}
+
+// SetRcodeRefused creates a packet with Refused set, for a request the
+// server will not answer by policy.
+func (dns *Msg) SetRcodeRefused(request *Msg) *Msg {
+	return dns.setRcodeOnly(request, RcodeRefused)
+}
+
+// SetRcodeNameError creates a packet with NameError (NXDOMAIN) set. An
+// authoritative server still has to set Authoritative and put the SOA
+// record of the zone in the authority section, see Zone.NegativeResponse.
+func (dns *Msg) SetRcodeNameError(request *Msg) *Msg {
+	return dns.setRcodeOnly(request, RcodeNameError)
+}
+
+// setRcodeOnly works like SetRcode, but also clears the AA bit and
+// removes all records, so only the header and the question are left.
+func (dns *Msg) setRcodeOnly(request *Msg, rcode int) *Msg {
+	dns.SetRcode(request, rcode)
+	dns.Authoritative = false
+	dns.Answer, dns.Ns, dns.Extra = nil, nil, nil
+	return dns
+}
+
+// ClearAD clears the AD (authenticated data) bit in the message. A
+// non-validating forwarder must do this before relaying an answer, see
+// RFC 4035, section 3.2.3.
+func (dns *Msg) ClearAD() *Msg {
+	dns.AuthenticatedData = false
+	return dns
+}
+
+// Truncate makes the message fit in size bytes when packed. Records are
+// dropped from the end of the additional section first, then from the
+// authority and the answer section. The message is packed, with
+// compression, to find how many records fit. The question and the OPT and
+// TSIG records are always kept. The TC bit is only set when records from
+// the answer or authority section had to go, see RFC 2181, section 9.
+func (dns *Msg) Truncate(size int) {
+	if dns.packLen() <= size {
+		return
+	}
+	var rrs, meta []RR
+	rrs = append(rrs, dns.Answer...)
+	rrs = append(rrs, dns.Ns...)
+	for _, r := range dns.Extra {
+		switch r.Header().Rrtype {
+		case TypeOPT, TypeTSIG:
+			meta = append(meta, r)
+		default:
+			rrs = append(rrs, r)
+		}
+	}
+	na, nn := len(dns.Answer), len(dns.Answer)+len(dns.Ns)
+	// keep sets the sections to the first n records of rrs
+	keep := func(n int) {
+		a, ns := n, n
+		if a > na {
+			a = na
+		}
+		if ns > nn {
+			ns = nn
+		}
+		if ns < na {
+			ns = na
+		}
+		dns.Answer = rrs[:a:a]
+		dns.Ns = rrs[na:ns:ns]
+		dns.Extra = meta
+		if n > nn {
+			dns.Extra = append(append([]RR{}, rrs[nn:n]...), meta...)
+		}
+	}
+	// Find the largest number of records that fits.
+	lo, hi := 0, len(rrs)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		keep(mid)
+		if dns.packLen() <= size {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	keep(lo)
+	if lo < nn {
+		dns.Truncated = true
+	}
+}
+
+// packLen returns the length of the packed message, or a length larger
+// than any message can be when it does not pack.
+func (dns *Msg) packLen() int {
+	b, err := dns.Pack()
+	if err != nil {
+		return MaxMsgSize + 1
+	}
+	return len(b)
+}
+
 // SetUpdate makes the message a dynamic update packet. It
 // sets the ZONE section to: z, TypeSOA, ClassINET.
 func (dns *Msg) SetUpdate(z string) *Msg {
@@ -87,6 +208,7 @@ func (dns *Msg) SetIxfr(z string, serial uint32) *Msg {
 	dns.Ns = make([]RR, 1)
 	s := new(RR_SOA)
 	s.Hdr = RR_Header{z, TypeSOA, ClassINET, defaultTtl, 0}
+	s.Ns, s.Mbox = ".", "." // only the serial matters, but these must pack
 	s.Serial = serial
 	dns.Question[0] = Question{z, TypeIXFR, ClassINET}
 	dns.Ns[0] = s
@@ -108,7 +230,7 @@ func (dns *Msg) SetTsig(z, algo string, fudge, timesigned int64) *Msg {
 	t := new(RR_TSIG)
 	t.Hdr = RR_Header{z, TypeTSIG, ClassANY, 0, 0}
 	t.Algorithm = algo
-	t.Fudge = 300
+	t.Fudge = uint16(fudge)
 	t.TimeSigned = uint64(timesigned)
 	t.OrigId = dns.Id
 	dns.Extra = append(dns.Extra, t)
@@ -129,6 +251,42 @@ func (dns *Msg) SetEdns0(udpsize uint16, do bool) *Msg {
 	return dns
 }
 
+// SetEdns0Version sets the EDNS version in the OPT RR of the message.
+// If there is none, an OPT RR for 512 byte UDP messages is added first.
+func (dns *Msg) SetEdns0Version(v uint8) *Msg {
+	dns.edns0().SetVersion(v)
+	return dns
+}
+
+// SetEdns0UDPSize sets the UDP buffer size in the OPT RR of the message,
+// an OPT RR is added if there is none.
+func (dns *Msg) SetEdns0UDPSize(size uint16) *Msg {
+	dns.edns0().SetUDPSize(size)
+	return dns
+}
+
+// SetEdns0Do sets or clears the DO (DNSSEC OK) bit in the OPT RR of the
+// message, an OPT RR for 512 byte UDP messages is added if there is none.
+func (dns *Msg) SetEdns0Do(do bool) *Msg {
+	opt := dns.edns0()
+	if do {
+		opt.SetDo()
+	} else {
+		opt.Hdr.Ttl &^= _DO << 8
+	}
+	return dns
+}
+
+// edns0 returns the OPT RR of the message, adding one for 512 byte UDP
+// messages if there is none.
+func (dns *Msg) edns0() *RR_OPT {
+	if opt := dns.IsEdns0(); opt != nil {
+		return opt
+	}
+	dns.SetEdns0(udpMsgSize, false)
+	return dns.IsEdns0()
+}
+
 // IsTsig checks if the message has a TSIG record as the last record
 // in the additional section. It returns the TSIG record found or nil.
 func (dns *Msg) IsTsig() *RR_TSIG {
@@ -145,8 +303,8 @@ func (dns *Msg) IsTsig() *RR_TSIG {
 // found or nil.
 func (dns *Msg) IsEdns0() *RR_OPT {
 	for _, r := range dns.Extra {
-		if r.Header().Rrtype == TypeOPT {
-			return r.(*RR_OPT)
+		if opt, ok := r.(*RR_OPT); ok {
+			return opt
 		}
 	}
 	return nil
@@ -224,13 +382,22 @@ func IsSubDomain(parent, child string) bool {
 	return CompareLabels(strings.ToLower(parent), strings.ToLower(child)) == LenLabels(parent)
 }
 
-// IsFqdn checks if a domain name is fully qualified.
+// IsFqdn checks if a domain name is fully qualified, it must end in a dot
+// that is not escaped.
 func IsFqdn(s string) bool {
 	l := len(s)
 	if l == 0 {
 		return false // ?
 	}
-	return s[l-1] == '.'
+	if s[l-1] != '.' {
+		return false
+	}
+	// An odd number of backslashes before the dot escapes it
+	i := l - 2
+	for i >= 0 && s[i] == '\\' {
+		i--
+	}
+	return (l-2-i)%2 == 0
 }
 
 // Fqdns return the fully qualified domain name from s.
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"net"
+	"strconv"
 	"testing"
 )
 
@@ -146,3 +147,320 @@ func TestCompressLenght(t *testing.T) {
 		t.Fatalf("Should be equal")
 	}
 }
+
+func TestCompressRepeatedNames(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, &RR_A{Hdr: RR_Header{Name: "miek.nl.", Rrtype: TypeA, Class: ClassINET, Ttl: 3600}, A: net.IPv4(127, 0, 0, byte(i))})
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Packing failed: %s", err.Error())
+	}
+	m.Compress = true
+	cbuf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Packing failed: %s", err.Error())
+	}
+	if len(cbuf) >= len(buf) {
+		t.Logf("Compressed message of %d bytes should be smaller than %d", len(cbuf), len(buf))
+		t.Fail()
+	}
+	if m.Len() != len(cbuf) {
+		t.Logf("Len %d should be the packed length %d", m.Len(), len(cbuf))
+		t.Fail()
+	}
+}
+
+func TestCompressPastPointerRange(t *testing.T) {
+	// Names first seen past 16K can not be pointed to, Pack must still
+	// have room for them written out in full.
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.Compress = true
+	for i := 0; i < 1500; i++ {
+		name := "host" + strconv.Itoa(i) + ".miek.nl."
+		m.Answer = append(m.Answer,
+			&RR_A{Hdr: RR_Header{Name: name, Rrtype: TypeA, Class: ClassINET, Ttl: 3600}, A: net.IPv4(127, 0, 0, 1)},
+			&RR_A{Hdr: RR_Header{Name: name, Rrtype: TypeA, Class: ClassINET, Ttl: 3600}, A: net.IPv4(127, 0, 0, 2)})
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Packing failed: %s", err.Error())
+	}
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil || len(r.Answer) != len(m.Answer) {
+		t.Logf("Expected %d answers back, got %v", len(m.Answer), err)
+		t.Fail()
+	}
+}
+
+func TestUncompressedExtra(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeMX)
+	m.Compress = true
+	m.UncompressedExtra = true
+	mx1, _ := NewRR("miek.nl. 3600 IN MX 10 mx1.miek.nl.")
+	mx2, _ := NewRR("miek.nl. 3600 IN MX 20 mx2.miek.nl.")
+	a, _ := NewRR("miek.nl. 3600 IN A 127.0.0.1")
+	m.Answer = []RR{mx1, mx2}
+
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Packing failed: %s", err.Error())
+	}
+	l := len(buf)
+	m.Extra = []RR{a}
+	buf, err = m.Pack()
+	if err != nil {
+		t.Fatalf("Packing failed: %s", err.Error())
+	}
+	// The answer owner names must point back to the question
+	if buf[12+13] != 0xC0 || buf[12+14] != 12 {
+		t.Log("Answer section should be compressed")
+		t.Fail()
+	}
+	// The additional section must hold the name in full
+	name := []byte{4, 'm', 'i', 'e', 'k', 2, 'n', 'l', 0}
+	if string(buf[l:l+len(name)]) != string(name) {
+		t.Logf("Additional section should not be compressed: %v", buf[l:])
+		t.Fail()
+	}
+	if m.Len() < len(buf) {
+		t.Logf("Len %d should not be smaller than packed length %d", m.Len(), len(buf))
+		t.Fail()
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	for i := 0; i < 10; i++ {
+		a, _ := NewRR("miek.nl. 3600 IN A 127.0.0." + strconv.Itoa(i))
+		m.Answer = append(m.Answer, a)
+	}
+	full, _ := m.Pack()
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeA)
+	question, _ := q.Pack()
+
+	// A message that fits exactly is left alone
+	m.Truncate(len(full))
+	if m.Truncated || len(m.Answer) != 10 {
+		t.Log("Message that fits should not be truncated")
+		t.Fail()
+	}
+	m.Truncate(len(full) - 1)
+	if !m.Truncated || len(m.Answer) != 9 {
+		t.Logf("Expected 9 answers and TC, got %d and %v", len(m.Answer), m.Truncated)
+		t.Fail()
+	}
+	if buf, _ := m.Pack(); len(buf) > len(full)-1 {
+		t.Logf("Truncated message is %d bytes, larger than %d", len(buf), len(full)-1)
+		t.Fail()
+	}
+	m.Truncate(len(question) + 1)
+	if len(m.Answer) != 0 || len(m.Question) != 1 {
+		t.Logf("Expected only the question to remain, got %d answers", len(m.Answer))
+		t.Fail()
+	}
+	// Not even the question fits, it is kept anyway
+	m.Truncate(12)
+	if !m.Truncated || len(m.Question) != 1 {
+		t.Log("Question should be kept")
+		t.Fail()
+	}
+}
+
+func TestTruncateSections(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeMX)
+	mx, _ := NewRR("miek.nl. 3600 IN MX 10 mx.miek.nl.")
+	ns, _ := NewRR("miek.nl. 3600 IN NS ns.miek.nl.")
+	m.Answer = []RR{mx}
+	m.Ns = []RR{ns}
+	for i := 0; i < 10; i++ {
+		a, _ := NewRR("mx.miek.nl. 3600 IN A 127.0.0." + strconv.Itoa(i))
+		m.Extra = append(m.Extra, a)
+	}
+	m.SetEdns0(4096, true)
+	full, _ := m.Pack()
+
+	// Dropping additional records does not need TC
+	m.Truncate(len(full) - 1)
+	if m.Truncated || len(m.Extra) != 10 || m.IsEdns0() == nil {
+		t.Logf("Expected 9 additional records plus OPT and no TC, got %d and TC=%v", len(m.Extra), m.Truncated)
+		t.Fail()
+	}
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeMX)
+	q.Answer = []RR{mx}
+	q.SetEdns0(4096, true)
+	answer, _ := q.Pack()
+	m.Truncate(len(answer))
+	if !m.Truncated || len(m.Answer) != 1 || len(m.Ns) != 0 || len(m.Extra) != 1 || m.IsEdns0() == nil {
+		t.Logf("Expected the answer and OPT only, with TC for the authority, got %s", m.String())
+		t.Fail()
+	}
+	if buf, _ := m.Pack(); len(buf) > len(answer) {
+		t.Logf("Truncated message is %d bytes, larger than %d", len(buf), len(answer))
+		t.Fail()
+	}
+	m.Truncate(len(answer) - 1)
+	if len(m.Answer) != 0 || len(m.Question) != 1 || m.IsEdns0() == nil {
+		t.Logf("Expected the question and OPT only, got %s", m.String())
+		t.Fail()
+	}
+}
+
+func TestSetRcodeHelpers(t *testing.T) {
+	req := new(Msg)
+	req.SetQuestion("miek.nl.", TypeA)
+	req.Opcode = OpcodeNotify
+	tests := []struct {
+		set    func(*Msg, *Msg) *Msg
+		rcode  int
+		opcode int
+	}{
+		{(*Msg).SetRcodeFormatError, RcodeFormatError, OpcodeQuery},
+		{(*Msg).SetRcodeNotImplemented, RcodeNotImplemented, OpcodeNotify},
+		{(*Msg).SetRcodeRefused, RcodeRefused, OpcodeQuery},
+		{(*Msg).SetRcodeNameError, RcodeNameError, OpcodeQuery},
+	}
+	for _, tc := range tests {
+		m := new(Msg)
+		m.Authoritative = true
+		m.Answer = []RR{&RR_A{Hdr: RR_Header{Name: "miek.nl.", Rrtype: TypeA, Class: ClassINET}, A: net.IPv4(127, 0, 0, 1)}}
+		tc.set(m, req)
+		if m.Rcode != tc.rcode || m.Opcode != tc.opcode || m.Id != req.Id || !m.Response || m.Authoritative {
+			t.Logf("Expected rcode %s and opcode %d with QR and without AA, got %s", Rcode_str[tc.rcode], tc.opcode, m.String())
+			t.Fail()
+		}
+		if tc.rcode != RcodeFormatError && (len(m.Question) != 1 || m.Question[0] != req.Question[0] || len(m.Answer) != 0) {
+			t.Logf("Expected the question and no answer for %s, got %s", Rcode_str[tc.rcode], m.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestEdns0Version(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.SetEdns0(4096, true)
+	m.SetEdns0Version(1)
+	buf, _ := m.Pack()
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatalf("Failed to unpack: %s", err.Error())
+	}
+	opt := r.IsEdns0()
+	if opt.Version() != 1 || !opt.Do() || opt.UDPSize() != 4096 || r.Rcode != RcodeSuccess {
+		t.Logf("Expected EDNS version 1 with DO and a 4096 buffer, got %s", opt.String())
+		t.Fail()
+	}
+	// without an OPT RR one is added
+	m = new(Msg)
+	m.SetEdns0Version(2)
+	if opt := m.IsEdns0(); opt == nil || opt.Version() != 2 || opt.UDPSize() != 512 {
+		t.Log("Expected an OPT RR with version 2 to be added")
+		t.Fail()
+	}
+}
+
+func TestExtendedRcode(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.Rcode = RcodeBadVers
+	// Without an OPT RR it is packed as before, not an error.
+	if _, err := m.Pack(); err != nil {
+		t.Logf("Expected an extended rcode without OPT to pack, got %v", err)
+		t.Fail()
+	}
+	m.SetEdns0(4096, false)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack: %s", err.Error())
+	}
+	if buf[3]&0xF != 0 {
+		t.Logf("Expected the lower bits of BADVERS, 0, in the header, got %d", buf[3]&0xF)
+		t.Fail()
+	}
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatalf("Failed to unpack: %s", err.Error())
+	}
+	if r.Rcode != RcodeBadVers || r.IsEdns0().ExtendedRcode() != 1 {
+		t.Logf("Expected rcode BADVERS, got %d", r.Rcode)
+		t.Fail()
+	}
+	if m.IsEdns0().ExtendedRcode() != 0 {
+		t.Log("Pack should not change the OPT RR of the message")
+		t.Fail()
+	}
+
+	// Packing again with a lower rcode clears the upper bits, also when
+	// the OPT RR still has them from an unpacked message.
+	r.Rcode = RcodeSuccess
+	if buf, err = r.Pack(); err != nil {
+		t.Fatalf("Failed to pack: %s", err.Error())
+	}
+	if err := r.Unpack(buf); err != nil || r.Rcode != RcodeSuccess {
+		t.Logf("Expected rcode NOERROR after packing again, got %d", r.Rcode)
+		t.Fail()
+	}
+}
+
+func TestIsEdns0(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	if m.IsEdns0() != nil {
+		t.Log("Expected no OPT RR")
+		t.Fail()
+	}
+	a, _ := NewRR("miek.nl. 3600 IN A 127.0.0.1")
+	m.Extra = append(m.Extra, a)
+	m.SetEdns0(1232, true)
+	m.SetTsig("axfr.", HmacMD5, 300, 0)
+	buf, _ := m.Pack()
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatalf("Failed to unpack: %s", err.Error())
+	}
+	opt := r.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1232 || !opt.Do() {
+		t.Fatalf("Expected an OPT RR with a 1232 byte buffer and DO, got %v", opt)
+	}
+
+	r.SetEdns0UDPSize(4096).SetEdns0Do(false)
+	if len(r.Extra) != 3 || opt.UDPSize() != 4096 || opt.Do() {
+		t.Logf("Expected the OPT RR to be changed in place, got %s", opt.String())
+		t.Fail()
+	}
+	r.SetEdns0Do(true)
+	if !opt.Do() {
+		t.Log("Expected DO to be set")
+		t.Fail()
+	}
+
+	req := new(Msg)
+	req.SetQuestion("miek.nl.", TypeA)
+	m = new(Msg)
+	if m.SetReplyEdns0(req, 1232).IsEdns0() != nil {
+		t.Log("Expected no OPT RR in the reply to a request without one")
+		t.Fail()
+	}
+	req.SetEdns0(4096, true)
+	m = new(Msg)
+	if opt := m.SetReplyEdns0(req, 1232).IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 1232 {
+		t.Logf("Expected an OPT RR with DO and a 1232 byte buffer in the reply, got %v", opt)
+		t.Fail()
+	}
+
+	m = new(Msg)
+	m.SetEdns0Do(true)
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 512 {
+		t.Log("Expected an OPT RR with DO to be added")
+		t.Fail()
+	}
+}
@@ -646,42 +646,7 @@ func rawSignatureData(rrset []RR, s *RR_RRSIG) (buf []byte) {
 			// Wildcard
 			r1.Header().Name = "*." + strings.Join(labels[len(labels)-int(s.Labels):], ".") + "."
 		}
-		// RFC 4034: 6.2.  Canonical RR Form. (2) - domain name to lowercase
-		r1.Header().Name = strings.ToLower(r1.Header().Name)
-		// 6.2. Canonical RR Form. (3) - domain rdata to lowercase.
-		//   NS, MD, MF, CNAME, SOA, MB, MG, MR, PTR,
-		//   HINFO, MINFO, MX, RP, AFSDB, RT, SIG, PX, NXT, NAPTR, KX,
-		//   SRV, DNAME, A6
-		switch x := r.(type) {
-		case *RR_NS:
-			x.Ns = strings.ToLower(x.Ns)
-		case *RR_CNAME:
-			x.Target = strings.ToLower(x.Target)
-		case *RR_SOA:
-			x.Ns = strings.ToLower(x.Ns)
-			x.Mbox = strings.ToLower(x.Mbox)
-		case *RR_MB:
-			x.Mb = strings.ToLower(x.Mb)
-		case *RR_MG:
-			x.Mg = strings.ToLower(x.Mg)
-		case *RR_MR:
-			x.Mr = strings.ToLower(x.Mr)
-		case *RR_PTR:
-			x.Ptr = strings.ToLower(x.Ptr)
-		case *RR_MINFO:
-			x.Rmail = strings.ToLower(x.Rmail)
-			x.Email = strings.ToLower(x.Email)
-		case *RR_MX:
-			x.Mx = strings.ToLower(x.Mx)
-		case *RR_NAPTR:
-			x.Replacement = strings.ToLower(x.Replacement)
-		case *RR_KX:
-			x.Exchanger = strings.ToLower(x.Exchanger)
-		case *RR_SRV:
-			x.Target = strings.ToLower(x.Target)
-		case *RR_DNAME:
-			x.Target = strings.ToLower(x.Target)
-		}
+		canonicalize(r1)
 		// 6.2. Canonical RR Form. (5) - origTTL
 		wire := make([]byte, r.Len()*2)
 		off, err1 := PackRR(r1, wire, 0, nil, false)
@@ -698,6 +663,83 @@ func rawSignatureData(rrset []RR, s *RR_RRSIG) (buf []byte) {
 	return
 }
 
+// canonicalize lowercases the owner name of r and the domain names in
+// its rdata, RFC 4034 section 6.2. The record is changed, so r should be
+// a copy.
+func canonicalize(r RR) {
+	// RFC 4034: 6.2.  Canonical RR Form. (2) - domain name to lowercase
+	r.Header().Name = strings.ToLower(r.Header().Name)
+	// 6.2. Canonical RR Form. (3) - domain rdata to lowercase.
+	//   NS, MD, MF, CNAME, SOA, MB, MG, MR, PTR,
+	//   HINFO, MINFO, MX, RP, AFSDB, RT, SIG, PX, NXT, NAPTR, KX,
+	//   SRV, DNAME, A6
+	switch x := r.(type) {
+	case *RR_NS:
+		x.Ns = strings.ToLower(x.Ns)
+	case *RR_CNAME:
+		x.Target = strings.ToLower(x.Target)
+	case *RR_SOA:
+		x.Ns = strings.ToLower(x.Ns)
+		x.Mbox = strings.ToLower(x.Mbox)
+	case *RR_MB:
+		x.Mb = strings.ToLower(x.Mb)
+	case *RR_MG:
+		x.Mg = strings.ToLower(x.Mg)
+	case *RR_MR:
+		x.Mr = strings.ToLower(x.Mr)
+	case *RR_PTR:
+		x.Ptr = strings.ToLower(x.Ptr)
+	case *RR_MINFO:
+		x.Rmail = strings.ToLower(x.Rmail)
+		x.Email = strings.ToLower(x.Email)
+	case *RR_MX:
+		x.Mx = strings.ToLower(x.Mx)
+	case *RR_NAPTR:
+		x.Replacement = strings.ToLower(x.Replacement)
+	case *RR_KX:
+		x.Exchanger = strings.ToLower(x.Exchanger)
+	case *RR_SRV:
+		x.Target = strings.ToLower(x.Target)
+	case *RR_DNAME:
+		x.Target = strings.ToLower(x.Target)
+	}
+}
+
+// SortRRset sorts the records of the RRset rrs in the canonical order of
+// RFC 4034 section 6.3: by their rdata in canonical form, compared as
+// left justified unsigned octet sequences. This differs from sorting the
+// presentation format, 9.0.0.1 sorts before 10.0.0.1 and the TXT "zz"
+// before "aaa". Signing does not need this, the signed data is sorted
+// anyway, but it makes the order of the records reproducible.
+func SortRRset(rrs []RR) {
+	rdata := make([][]byte, len(rrs))
+	for i, r := range rrs {
+		r1 := r.Copy()
+		canonicalize(r1)
+		wire := make([]byte, r1.Len()*2)
+		off, err := PackRR(r1, wire, 0, nil, false)
+		if err != nil {
+			continue // sorts first
+		}
+		_, start, _ := UnpackDomainName(wire, 0)
+		rdata[i] = wire[start+10 : off]
+	}
+	sort.Stable(rdataOrder{rrs, rdata})
+}
+
+// rdataOrder sorts records by their canonical rdata, see SortRRset.
+type rdataOrder struct {
+	rrs   []RR
+	rdata [][]byte
+}
+
+func (c rdataOrder) Len() int           { return len(c.rrs) }
+func (c rdataOrder) Less(i, j int) bool { return bytes.Compare(c.rdata[i], c.rdata[j]) < 0 }
+func (c rdataOrder) Swap(i, j int) {
+	c.rrs[i], c.rrs[j] = c.rrs[j], c.rrs[i]
+	c.rdata[i], c.rdata[j] = c.rdata[j], c.rdata[i]
+}
+
 // Map for algorithm names.
 var Alg_str = map[uint8]string{
 	RSAMD5:           "RSAMD5",
@@ -332,3 +332,38 @@ func TestKeyToDS(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSortRRset(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		// the rdata is compared, not the presentation format
+		{[]string{"miek.nl. IN A 10.0.0.2", "miek.nl. IN A 10.0.0.1", "miek.nl. IN A 9.255.0.0"},
+			[]string{"9.255.0.0", "10.0.0.1", "10.0.0.2"}},
+		{[]string{"miek.nl. IN MX 10 b.miek.nl.", "miek.nl. IN MX 9 z.miek.nl.", "miek.nl. IN MX 10 A.miek.nl."},
+			[]string{"9 z.miek.nl.", "10 A.miek.nl.", "10 b.miek.nl."}},
+		// a length octet precedes each string
+		{[]string{`miek.nl. IN TXT "aaa"`, `miek.nl. IN TXT "zz"`},
+			[]string{`"zz"`, `"aaa"`}},
+		// and each label, the names in the rdata are lowercased
+		{[]string{"miek.nl. IN NS ns.miek.nl.", "miek.nl. IN NS A.miek.nl.", "miek.nl. IN NS a.b.nl."},
+			[]string{"a.b.nl.", "A.miek.nl.", "ns.miek.nl."}},
+	}
+	for _, tc := range tests {
+		var rrs []RR
+		for _, s := range tc.in {
+			r, err := NewRR(s)
+			if err != nil {
+				t.Fatalf("Failed to parse %s: %s", s, err.Error())
+			}
+			rrs = append(rrs, r)
+		}
+		SortRRset(rrs)
+		for i, r := range rrs {
+			if !strings.HasSuffix(r.String(), tc.want[i]) {
+				t.Logf("Record %d should end in %s, got %s", i, tc.want[i], r.String())
+				t.Fail()
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package dns
+
+// DNS over HTTPS, RFC 8484.
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// MimeType is the content type of DNS messages carried over HTTP.
+const MimeType = "application/dns-message"
+
+// maxHTTPBody is the largest POST body accepted, the size of the largest
+// DNS message.
+const maxHTTPBody = 65535
+
+// NewHTTPHandler returns an http.Handler that serves DNS over HTTPS
+// requests by handing them to h. Both GET requests, with the base64url
+// encoded message in the "dns" query parameter, and POST requests, with the
+// message in the body, are supported. Basic use pattern:
+//
+//	http.Handle("/dns-query", dns.NewHTTPHandler(dns.DefaultServeMux))
+//	http.ListenAndServeTLS(":443", "cert.pem", "key.pem", nil)
+//
+// A HandlerContext is given the context of the HTTP request, which is
+// canceled when the client goes away. No TSIG processing is done, a
+// message with a TSIG record will have its TsigStatus set to ErrSecret.
+func NewHTTPHandler(h Handler) http.Handler {
+	return &httpHandler{h}
+}
+
+type httpHandler struct {
+	h Handler
+}
+
+// httpResponse is the ResponseWriter given to handlers serving DNS over HTTPS.
+// The reply is buffered and written back after the handler returns.
+type httpResponse struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	tsigStatus error
+	buf        []byte // the reply
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (d *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch r.Method {
+	case "GET":
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		if r.Header.Get("Content-Type") != MimeType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(buf) == 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	req := new(Msg)
+	if req.Unpack(buf) != nil {
+		http.Error(w, "bad message", http.StatusBadRequest)
+		return
+	}
+
+	rw := new(httpResponse)
+	rw.localAddr, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		p, _ := strconv.Atoi(port)
+		rw.remoteAddr = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	if req.IsTsig() != nil {
+		rw.tsigStatus = ErrSecret
+	}
+	serveDNSContext(r.Context(), d.h, rw, req)
+	if rw.buf == nil {
+		http.Error(w, "no reply", http.StatusInternalServerError)
+		return
+	}
+
+	reply := new(Msg)
+	if reply.Unpack(rw.buf) == nil && len(reply.Answer) > 0 {
+		ttl := reply.Answer[0].Header().Ttl
+		for _, rr := range reply.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+	}
+	w.Header().Set("Content-Type", MimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(rw.buf)))
+	w.Write(rw.buf)
+}
+
+// RemoteAddr implements the ResponseWriter.RemoteAddr method.
+func (w *httpResponse) RemoteAddr() net.Addr { return w.remoteAddr }
+
+// LocalAddr implements the ResponseWriter.LocalAddr method.
+func (w *httpResponse) LocalAddr() net.Addr { return w.localAddr }
+
+// Network implements the ResponseWriter.Network method, it returns
+// "https". Only one reply can be written.
+func (w *httpResponse) Network() string { return "https" }
+
+// Write implements the ResponseWriter.Write method.
+func (w *httpResponse) Write(m *Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	return w.WriteBuf(data)
+}
+
+// WriteBuf implements the ResponseWriter.WriteBuf method.
+func (w *httpResponse) WriteBuf(m []byte) error {
+	if w.buf != nil {
+		return &Error{Err: "reply already written"}
+	}
+	w.buf = m
+	return nil
+}
+
+// Close implements the ResponseWriter.Close method, it is a no-op.
+func (w *httpResponse) Close() error { return nil }
+
+// TsigStatus implements the ResponseWriter.TsigStatus method.
+func (w *httpResponse) TsigStatus() error { return w.tsigStatus }
+
+// TsigTimersOnly implements the ResponseWriter.TsigTimersOnly method, it is a no-op.
+func (w *httpResponse) TsigTimersOnly(b bool) {}
+
+// Hijack implements the ResponseWriter.Hijack method, the HTTP connection
+// can not be taken over and an error is returned.
+func (w *httpResponse) Hijack() (net.Conn, error) {
+	return nil, &Error{Err: "can not hijack a DNS over HTTPS request"}
+}
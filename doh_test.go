@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func HelloServerTTL(w ResponseWriter, req *Msg) {
+	m := new(Msg)
+	m.SetReply(req)
+	a1, _ := NewRR(req.Question[0].Name + " 3600 IN A 127.0.0.1")
+	a2, _ := NewRR(req.Question[0].Name + " 60 IN A 127.0.0.2")
+	m.Answer = []RR{a1, a2}
+	w.Write(m)
+}
+
+func TestHTTPHandler(t *testing.T) {
+	var remote net.Addr
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		remote = w.RemoteAddr()
+		HelloServerTTL(w, r)
+	})
+	srv := httptest.NewServer(NewHTTPHandler(h))
+	defer srv.Close()
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	buf, _ := m.Pack()
+
+	resp, err := http.Post(srv.URL, MimeType, bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("Failed to POST: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != MimeType {
+		t.Fatalf("Bad response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+		t.Logf("Cache-Control should be derived from the lowest TTL: %s", cc)
+		t.Fail()
+	}
+	r := new(Msg)
+	if err := r.Unpack(body); err != nil || r.Id != m.Id || len(r.Answer) != 2 {
+		t.Logf("Bad answer: %v", r)
+		t.Fail()
+	}
+	if a, ok := remote.(*net.TCPAddr); !ok || !a.IP.IsLoopback() {
+		t.Logf("RemoteAddr should be the HTTP client: %v", remote)
+		t.Fail()
+	}
+
+	resp, err = http.Get(srv.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(buf))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Log("Failed to GET")
+		t.Fail()
+	}
+	resp.Body.Close()
+
+	resp, err = http.Post(srv.URL, MimeType, bytes.NewReader([]byte{0, 1, 2}))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Log("Malformed message should give 400")
+		t.Fail()
+	}
+	resp.Body.Close()
+
+	resp, err = http.Post(srv.URL, MimeType, bytes.NewReader(make([]byte, maxHTTPBody+1)))
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Log("Oversized body should give 413")
+		t.Fail()
+	}
+	resp.Body.Close()
+}
@@ -9,8 +9,8 @@
 //	o.Hdr.Rrtype = dns.TypeOPT
 //
 // The rdata of an OPT RR consists out of a slice of EDNS0 interfaces. Currently
-// only a few have been standardized: EDNS0_NSID (RFC 5001) and EDNS0_SUBNET (draft). Note that
-// these options may be combined in an OPT RR.
+// only a few have been standardized: EDNS0_NSID (RFC 5001), EDNS0_COOKIE (RFC 7873) and
+// EDNS0_SUBNET (draft). Note that these options may be combined in an OPT RR.
 // Basic use pattern for a server to check if (and which) options are set:
 //
 //	// o is a dns.RR_OPT
@@ -37,6 +37,7 @@ const (
 	EDNS0LLQ             // not used
 	EDNS0UL              // not used
 	EDNS0NSID            // nsid (RFC5001)
+	EDNS0COOKIE = 0xa    // DNS cookies (RFC7873)
 	EDNS0SUBNET = 0x50fa // client-subnet draft
 	_DO         = 1 << 7 // dnssec ok
 )
@@ -73,6 +74,8 @@ func (rr *RR_OPT) String() string {
 			}
 		case *EDNS0_SUBNET:
 			s += "\n; SUBNET: " + o.String()
+		case *EDNS0_COOKIE:
+			s += "\n; COOKIE: " + o.String()
 		}
 	}
 	return s
@@ -93,12 +96,23 @@ func (rr *RR_OPT) Copy() RR {
 
 // Version returns the EDNS version used. Only zero is defined.
 func (rr *RR_OPT) Version() uint8 {
-	return uint8(rr.Hdr.Ttl & 0x00FF00FFFF)
+	return uint8(rr.Hdr.Ttl >> 16)
 }
 
 // SetVersion sets the version of EDNS. This is usually zero.
 func (rr *RR_OPT) SetVersion(v uint8) {
-	rr.Hdr.Ttl = rr.Hdr.Ttl&0xFF00FFFF | uint32(v)
+	rr.Hdr.Ttl = rr.Hdr.Ttl&0xFF00FFFF | uint32(v)<<16
+}
+
+// ExtendedRcode returns the upper 8 bits of the message's 12 bit rcode.
+// Msg.Pack and Msg.Unpack take care of this, see Msg.Rcode.
+func (rr *RR_OPT) ExtendedRcode() uint8 {
+	return uint8(rr.Hdr.Ttl >> 24)
+}
+
+// SetExtendedRcode sets the upper 8 bits of the message's 12 bit rcode.
+func (rr *RR_OPT) SetExtendedRcode(v uint8) {
+	rr.Hdr.Ttl = rr.Hdr.Ttl&0x00FFFFFF | uint32(v)<<24
 }
 
 // UDPSize returns the UDP buffer size.
@@ -278,3 +292,41 @@ func (e *EDNS0_SUBNET) String() (s string) {
 	s += "/" + strconv.Itoa(int(e.SourceNetmask)) + "/" + strconv.Itoa(int(e.SourceScope))
 	return
 }
+
+// The cookie EDNS0 option is used to protect against off-path spoofing,
+// see RFC 7873. A client sends an 8 byte client cookie, the server replies
+// with it followed by a server cookie of 8 to 32 bytes, which the client
+// returns in its next queries. The cookie is hex encoded.
+// Basic use pattern for creating a cookie option:
+//
+//	o := new(dns.RR_OPT)
+//	o.Hdr.Name = "."
+//	o.Hdr.Rrtype = dns.TypeOPT
+//	e := new(dns.EDNS0_COOKIE)
+//	e.Code = dns.EDNS0COOKIE
+//	e.Cookie = "24a5ac1223ab2dc5"	// the client cookie
+//	o.Option = append(o.Option, e)
+type EDNS0_COOKIE struct {
+	Code   uint16 // Always EDNS0COOKIE
+	Cookie string // Client cookie, optionally followed by the server cookie, hex encoded
+}
+
+func (e *EDNS0_COOKIE) Option() uint16 {
+	return EDNS0COOKIE
+}
+
+func (e *EDNS0_COOKIE) pack() ([]byte, error) {
+	h, err := hex.DecodeString(e.Cookie)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (e *EDNS0_COOKIE) unpack(b []byte) {
+	e.Cookie = hex.EncodeToString(b)
+}
+
+func (e *EDNS0_COOKIE) String() string {
+	return e.Cookie
+}
@@ -0,0 +1,70 @@
+package dns
+
+// A forwarding handler, relays requests to an upstream nameserver.
+
+import (
+	"time"
+)
+
+// Forward is a Handler that relays each request to an upstream nameserver
+// and copies the answer back to the client. Basic use pattern:
+//
+//	dns.Handle(".", &dns.Forward{Upstream: "8.8.8.8:53"})
+//
+// Unless Validating is set the AD bit is cleared in the relayed answer,
+// as the upstream's claim of authenticity has not been checked by us.
+type Forward struct {
+	Upstream   string   // address of the upstream nameserver
+	Client     *Client  // client used to reach the upstream, if nil new(Client) is used
+	Validating bool     // if true the forwarder validates the answers and leaves AD alone
+	Fallback   []string // addresses of nameservers tried in order when Upstream does not answer
+	Net        string   // "udp" or "tcp" to reach the upstreams, if empty the network the request came in on
+}
+
+// NewForwardHandler returns a Forward for the nameservers in upstream,
+// the first one is asked first and the others when it does not answer.
+// They are reached over network, see Forward.Net, and each exchange may
+// take timeout.
+func NewForwardHandler(upstream []string, network string, timeout time.Duration) Handler {
+	f := &Forward{Net: network, Client: &Client{ReadTimeout: timeout, WriteTimeout: timeout}}
+	if len(upstream) > 0 {
+		f.Upstream, f.Fallback = upstream[0], upstream[1:]
+	}
+	return f
+}
+
+// ServeDNS implements the Handler interface. The request is sent with a
+// new id, so the upstream's answer can not be spoofed with the client's,
+// and the answer gets the id of the request back. An answer that is
+// truncated over UDP is asked again over TCP. If no upstream can be
+// reached a SERVFAIL is returned to the client.
+func (f *Forward) ServeDNS(w ResponseWriter, r *Msg) {
+	c := new(Client)
+	if f.Client != nil {
+		*c = *f.Client
+	}
+	c.Net = f.Net
+	if c.Net == "" && w.Network() == "tcp" {
+		c.Net = "tcp"
+	}
+	q := *r
+	q.Id = Id()
+	for _, a := range append([]string{f.Upstream}, f.Fallback...) {
+		in, err := c.Exchange(&q, a)
+		if err == nil && in.Truncated && c.Net != "tcp" {
+			t := *c
+			t.Net = "tcp"
+			in, err = t.Exchange(&q, a)
+		}
+		if err != nil || in.Id != q.Id {
+			continue
+		}
+		in.Id = r.Id
+		if !f.Validating {
+			in.ClearAD()
+		}
+		w.Write(in)
+		return
+	}
+	HandleFailed(w, r)
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func HelloServerAD(w ResponseWriter, req *Msg) {
+	m := new(Msg)
+	m.SetReply(req)
+	m.AuthenticatedData = true
+	m.Extra = make([]RR, 1)
+	m.Extra[0] = &RR_TXT{Hdr: RR_Header{Name: m.Question[0].Name, Rrtype: TypeTXT, Class: ClassINET, Ttl: 0}, Txt: []string{"Hello AD"}}
+	w.Write(m)
+}
+
+func TestForwardClearAD(t *testing.T) {
+	go func() {
+		err := ListenAndServe("127.0.0.1:8054", "udp", HandlerFunc(HelloServerAD))
+		if err != nil {
+			t.Log("ListenAndServe: ", err.Error())
+			t.Fail()
+		}
+	}()
+	go func() {
+		err := ListenAndServe("127.0.0.1:8055", "udp", &Forward{Upstream: "127.0.0.1:8054"})
+		if err != nil {
+			t.Log("ListenAndServe: ", err.Error())
+			t.Fail()
+		}
+	}()
+	time.Sleep(4e8)
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+
+	r, err := c.Exchange(m, "127.0.0.1:8054")
+	if err != nil || !r.AuthenticatedData {
+		t.Log("Upstream should set the AD bit")
+		t.FailNow()
+	}
+	r, err = c.Exchange(m, "127.0.0.1:8055")
+	if err != nil {
+		t.Log("Failed to exchange with the forwarder: ", err.Error())
+		t.FailNow()
+	}
+	if r.AuthenticatedData {
+		t.Log("Non-validating forwarder should clear the AD bit")
+		t.Fail()
+	}
+	if txt := r.Extra[0].(*RR_TXT).Txt[0]; txt != "Hello AD" {
+		t.Log("Unexpected result for miek.nl", txt, "!= Hello AD")
+		t.Fail()
+	}
+}
+
+func TestNewForwardHandler(t *testing.T) {
+	// The upstream truncates over UDP, so the forwarder must retry over TCP.
+	networks := make(chan string, 4)
+	h := HandlerFunc(func(w ResponseWriter, req *Msg) {
+		networks <- w.Network()
+		if w.Network() == "udp" {
+			m := new(Msg)
+			m.SetReply(req)
+			m.Truncated = true
+			w.Write(m)
+			return
+		}
+		HelloServerAD(w, req)
+	})
+	tcp := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h}
+	go tcp.ListenAndServe()
+	defer tcp.Shutdown()
+	upstream := serverAddr(tcp)
+	udp := &Server{Addr: upstream, Net: "udp", Handler: h}
+	go udp.ListenAndServe()
+	defer udp.Shutdown()
+	serverAddr(udp)
+
+	// Nothing listens on the first upstream.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	dead := l.LocalAddr().String()
+	l.Close()
+
+	fwd := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: NewForwardHandler([]string{dead, upstream}, "", 500*time.Millisecond)}
+	go fwd.ListenAndServe()
+	defer fwd.Shutdown()
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	r, err := new(Client).Exchange(m, serverAddr(fwd))
+	if err != nil {
+		t.Fatalf("Failed to exchange with the forwarder: %s", err.Error())
+	}
+	if r.Id != m.Id || !r.RecursionDesired || r.Truncated || r.AuthenticatedData {
+		t.Logf("Expected the id and RD of the request, without TC and AD, got %v", r)
+		t.Fail()
+	}
+	if len(r.Extra) == 0 || r.Extra[0].(*RR_TXT).Txt[0] != "Hello AD" {
+		t.Logf("Expected the answer of the upstream, got %v", r)
+		t.Fail()
+	}
+	if a, b := <-networks, <-networks; a != "udp" || b != "tcp" {
+		t.Logf("Expected the upstream to be asked over UDP and then TCP, got %s and %s", a, b)
+		t.Fail()
+	}
+
+	// No upstream answers.
+	w := new(RecordingResponseWriter)
+	NewForwardHandler([]string{dead}, "udp", 500*time.Millisecond).ServeDNS(w, m)
+	if len(w.Msgs) != 1 || w.Msgs[0].Rcode != RcodeServerFailure {
+		t.Log("Expected SERVFAIL when no upstream answers")
+		t.Fail()
+	}
+}
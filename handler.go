@@ -0,0 +1,160 @@
+package dns
+
+// Handlers that wrap other handlers.
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// TimeoutHandler returns a Handler that runs h with a time limit of dt.
+// When h has not written a reply within dt, SERVFAIL is sent to the
+// client and later writes by h fail with ErrTimeout. A handler that
+// implements HandlerContext gets a context that is cancelled after dt.
+// A panic in h is passed on to the caller.
+func TimeoutHandler(h Handler, dt time.Duration) Handler {
+	return &timeoutHandler{h, dt}
+}
+
+type timeoutHandler struct {
+	h  Handler
+	dt time.Duration
+}
+
+func (t *timeoutHandler) ServeDNS(w ResponseWriter, r *Msg) {
+	t.ServeDNSContext(context.Background(), w, r)
+}
+
+func (t *timeoutHandler) ServeDNSContext(ctx context.Context, w ResponseWriter, r *Msg) {
+	ctx, cancel := context.WithTimeout(ctx, t.dt)
+	defer cancel()
+	tw := &timeoutWriter{ResponseWriter: w}
+	done := make(chan bool)
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicked <- p
+			}
+		}()
+		serveDNSContext(ctx, t.h, tw, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case p := <-panicked:
+		panic(p)
+	case <-ctx.Done():
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		if !tw.wrote {
+			HandleFailed(w, r)
+		}
+		tw.timedOut = true
+	}
+}
+
+// timeoutWriter is the ResponseWriter given to the handler of a
+// TimeoutHandler, it drops writes after the timeout.
+type timeoutWriter struct {
+	ResponseWriter
+	mu       sync.Mutex
+	wrote    bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) Write(m *Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return ErrTimeout
+	}
+	w.wrote = true
+	return w.ResponseWriter.Write(m)
+}
+
+func (w *timeoutWriter) WriteBuf(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return ErrTimeout
+	}
+	w.wrote = true
+	return w.ResponseWriter.WriteBuf(b)
+}
+
+// Chain returns h wrapped in the middleware mw, the first one being the
+// outermost: Chain(h, a, b) is a(b(h)). A middleware is a function
+// returning a Handler that does its work and calls the Handler it got,
+// just like with net/http.
+func Chain(h Handler, mw ...func(Handler) Handler) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// A CaptureWriter is a ResponseWriter that remembers the reply written
+// through it, before passing it on to the wrapped ResponseWriter.
+// Middleware can use it to look at the rcode of the reply.
+type CaptureWriter struct {
+	ResponseWriter
+	Msg *Msg // the last message written, nil if none
+}
+
+// Write implements ResponseWriter.
+func (w *CaptureWriter) Write(m *Msg) error {
+	w.Msg = m
+	return w.ResponseWriter.Write(m)
+}
+
+// WriteBuf implements ResponseWriter, buf is unpacked to set Msg.
+func (w *CaptureWriter) WriteBuf(buf []byte) error {
+	m := new(Msg)
+	if m.Unpack(buf) == nil {
+		w.Msg = m
+	}
+	return w.ResponseWriter.WriteBuf(buf)
+}
+
+// LogHandler returns a middleware, see Chain, that logs for each request
+// the client, the question, the rcode of the reply and how long the
+// handler took to l. Use the server's ErrorLog for l to have it in the
+// same place as the server's errors, when l is nil the log package's
+// standard logger is used.
+func LogHandler(l *log.Logger) func(Handler) Handler {
+	return func(h Handler) Handler {
+		return &logHandler{h, l}
+	}
+}
+
+type logHandler struct {
+	h Handler
+	l *log.Logger
+}
+
+func (lh *logHandler) ServeDNS(w ResponseWriter, r *Msg) {
+	lh.ServeDNSContext(context.Background(), w, r)
+}
+
+func (lh *logHandler) ServeDNSContext(ctx context.Context, w ResponseWriter, r *Msg) {
+	cw := &CaptureWriter{ResponseWriter: w}
+	start := time.Now()
+	serveDNSContext(ctx, lh.h, cw, r)
+	rtt := time.Since(start)
+	q := "<no question>"
+	if len(r.Question) > 0 {
+		q = r.Question[0].Name + " " + Class_str[r.Question[0].Qclass] + " " + Rr_str[r.Question[0].Qtype]
+	}
+	rcode := "<no reply>"
+	if cw.Msg != nil {
+		rcode = Rcode_str[cw.Msg.Rcode]
+	}
+	if lh.l != nil {
+		lh.l.Printf("dns: %s %s %s %v", w.RemoteAddr(), q, rcode, rtt)
+		return
+	}
+	log.Printf("dns: %s %s %s %v", w.RemoteAddr(), q, rcode, rtt)
+}
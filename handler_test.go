@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	late := make(chan error, 1)
+	slow := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		time.Sleep(2e8)
+		m := new(Msg)
+		m.SetReply(r)
+		late <- w.Write(m)
+	})
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	TimeoutHandler(slow, 5e7).ServeDNS(w, m)
+	if lastMsg(w) == nil || lastMsg(w).Rcode != RcodeServerFailure {
+		t.Fatalf("A slow handler should get SERVFAIL, got %v", lastMsg(w))
+	}
+	if err := <-late; err != ErrTimeout {
+		t.Logf("A late write should fail with ErrTimeout, got %v", err)
+		t.Fail()
+	}
+	if len(w.Msgs) != 1 {
+		t.Log("A late write should be dropped")
+		t.Fail()
+	}
+
+	w = new(RecordingResponseWriter)
+	TimeoutHandler(HandlerFunc(HelloServer), time.Second).ServeDNS(w, m)
+	if lastMsg(w) == nil || lastMsg(w).Rcode != RcodeSuccess || len(lastMsg(w).Extra) != 1 {
+		t.Logf("A fast handler should get its own answer, got %v", lastMsg(w))
+		t.Fail()
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) func(Handler) Handler {
+		return func(h Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Msg) {
+				order = append(order, name+" before")
+				h.ServeDNS(w, r)
+				order = append(order, name+" after")
+			})
+		}
+	}
+	base := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		order = append(order, "handler")
+		HelloServer(w, r)
+	})
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	Chain(base, mw("a"), mw("b"), mw("c")).ServeDNS(w, m)
+	want := "a before,b before,c before,handler,c after,b after,a after"
+	if got := strings.Join(order, ","); got != want {
+		t.Logf("Expected %s, got %s", want, got)
+		t.Fail()
+	}
+	if lastMsg(w) == nil || len(lastMsg(w).Extra) != 1 {
+		t.Logf("Reply should reach the client, got %v", lastMsg(w))
+		t.Fail()
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h := Chain(HandlerFunc(HandleFailed), LogHandler(log.New(buf, "", 0)))
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	h.ServeDNS(new(RecordingResponseWriter), m)
+	if s := buf.String(); !strings.Contains(s, "miek.nl. IN TXT SERVFAIL") {
+		t.Logf("Log line should show the question and rcode, got %q", s)
+		t.Fail()
+	}
+}
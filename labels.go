@@ -2,9 +2,13 @@ package dns
 
 // Holds a bunch of helper functions for dealing with labels.
 
+import "strings"
+
 // SplitLabels splits a domainname string into its labels.
 // www.miek.nl. returns []string{"www", "miek", "nl"}
-// The root label (.) returns nil.
+// The root label (.) returns nil. Escapes (RFC 1035, section 5.1) are
+// kept in the labels: an escaped dot (\.) does not end a label, while the
+// dot in \\. (an escaped backslash) does.
 func SplitLabels(s string) []string {
 	if s == "." {
 		return nil
@@ -12,22 +16,15 @@ func SplitLabels(s string) []string {
 
 	k := 0
 	labels := make([]string, 0)
-	last := byte('.')
-	lastlast := byte('.')
 	s = Fqdn(s) // Make fully qualified
 	for i := 0; i < len(s); i++ {
-		if s[i] == '.' {
-			if last == '\\' {
-				if lastlast != '\\' {
-					// do nothing
-					continue
-				}
-			}
+		switch s[i] {
+		case '\\':
+			i++ // skip the escaped byte, the digits of \DDD are no dots
+		case '.':
 			labels = append(labels, s[k:i])
 			k = i + 1 // + dot
 		}
-		lastlast = last
-		last = s[i]
 	}
 	return labels
 }
@@ -65,21 +62,49 @@ func LenLabels(s string) (labels int) {
 	if s == "." {
 		return
 	}
-	last := byte('.')
-	lastlast := byte('.')
 	s = Fqdn(s) // Make fully qualified
 	for i := 0; i < len(s); i++ {
-		if s[i] == '.' {
-			if last == '\\' {
-				if lastlast != '\\' {
-					// do nothing
-					continue
-				}
-			}
+		switch s[i] {
+		case '\\':
+			i++
+		case '.':
 			labels++
 		}
-		lastlast = last
-		last = s[i]
 	}
 	return
 }
+
+// lowerASCII returns s with the ASCII letters lowercased. Names are case
+// insensitive for ASCII only (RFC 4343), other bytes, which may not be
+// valid UTF-8, are left alone.
+func lowerASCII(s string) string {
+	i := 0
+	for i < len(s) && (s[i] < 'A' || s[i] > 'Z') {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	b := []byte(s)
+	for ; i < len(b); i++ {
+		if 'A' <= b[i] && b[i] <= 'Z' {
+			b[i] += 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// canonicalLess returns true when the name a sorts before b in the
+// canonical DNS name order of RFC 4034, section 6.1: names are compared
+// label by label starting from the right, the labels as lowercase octets.
+func canonicalLess(a, b string) bool {
+	la := SplitLabels(strings.ToLower(a))
+	lb := SplitLabels(strings.ToLower(b))
+	i, j := len(la)-1, len(lb)-1
+	for ; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return i < j
+}
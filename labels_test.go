@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -60,3 +61,31 @@ func TestSplitLabels(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSplitLabelsEscapes(t *testing.T) {
+	tests := map[string][]string{
+		`www\.miek.nl.`:   {`www\.miek`, "nl"},
+		`www\\.miek.nl.`:  {`www\\`, "miek", "nl"},
+		`www\\\.miek.nl.`: {`www\\\.miek`, "nl"},
+		`www\046miek.nl.`: {`www\046miek`, "nl"},
+		`\\\\.\..nl`:      {`\\\\`, `\.`, "nl"},
+		`miek\.`:          {`miek\.`},
+	}
+	for s, labels := range tests {
+		l := SplitLabels(s)
+		if strings.Join(l, "|") != strings.Join(labels, "|") {
+			t.Logf("%s should split in %q, not %q", s, labels, l)
+			t.Fail()
+		}
+		if n := LenLabels(s); n != len(labels) {
+			t.Logf("%s should have %d labels, not %d", s, len(labels), n)
+			t.Fail()
+		}
+	}
+	for s, fqdn := range map[string]bool{"miek.nl.": true, "miek.nl": false, `miek\.`: false, `miek\\.`: true, `miek\\\.`: false} {
+		if IsFqdn(s) != fqdn {
+			t.Logf("IsFqdn(%s) should be %v", s, fqdn)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package dns
+
+// Response rate limiting.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A Limiter decides whether a request from remote may be answered, see
+// Server.Limiter.
+type Limiter interface {
+	Allow(remote net.Addr, r *Msg) bool
+}
+
+// RateLimiter is a Limiter with a token bucket per client network: a /24
+// for IPv4 and a /56 for IPv6 clients. Each bucket holds up to Burst
+// tokens and is refilled with Rate tokens per second, a request takes
+// one token. This limits how much traffic a spoofed source address can
+// draw, as in reflection attacks, while normal clients are not affected.
+type RateLimiter struct {
+	Rate  float64 // tokens added per second
+	Burst int     // size of the buckets
+
+	lock    sync.Mutex
+	buckets map[string]*bucket // the networks seen since old was filled
+	old     map[string]*bucket // the networks seen before that, dropped when buckets is full
+	now     func() time.Time   // time.Now, can be replaced in tests
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets is the number of buckets in a generation. When the current
+// one is full it becomes the old one and the oldest is thrown away, so at
+// most twice this many buckets are kept, also under a spoofed flood from
+// many networks. A network that is thrown away starts with a full bucket.
+const maxBuckets = 10000
+
+// NewRateLimiter returns a RateLimiter that allows rate requests per
+// second, with bursts of up to burst requests, per client network.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// Allow implements the Limiter interface.
+func (l *RateLimiter) Allow(remote net.Addr, r *Msg) bool {
+	key := clientNetwork(remote)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if b, ok = l.old[key]; ok {
+			delete(l.old, key)
+		} else {
+			b = &bucket{tokens: float64(l.Burst), last: now}
+		}
+		if len(l.buckets) >= maxBuckets {
+			l.old, l.buckets = l.buckets, make(map[string]*bucket)
+		}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// addrIP returns the IP address of a, or nil if a is not a UDP or TCP
+// address.
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// clientNetwork returns the network of the address a, as used by
+// RateLimiter.
+func clientNetwork(a net.Addr) string {
+	ip := addrIP(a)
+	if ip == nil {
+		return a.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
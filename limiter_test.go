@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	l := NewRateLimiter(2, 5)
+	l.now = func() time.Time { return now }
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 53000}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53000}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.Allow(client, nil) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Logf("A burst of 10 should allow 5 requests, got %d", allowed)
+		t.Fail()
+	}
+	if l.Allow(neighbour, nil) {
+		t.Log("Clients in the same /24 should share a bucket")
+		t.Fail()
+	}
+	if !l.Allow(other, nil) {
+		t.Log("Other networks should not be limited")
+		t.Fail()
+	}
+
+	// Steady traffic at the configured rate passes
+	for i := 0; i < 20; i++ {
+		now = now.Add(500 * time.Millisecond)
+		if !l.Allow(client, nil) {
+			t.Fatalf("Steady request %d was not allowed", i)
+		}
+	}
+
+	v6a := &net.UDPAddr{IP: net.ParseIP("2001:db8:0:1::1")}
+	v6b := &net.UDPAddr{IP: net.ParseIP("2001:db8:0:ff::1")}
+	if clientNetwork(v6a) != clientNetwork(v6b) {
+		t.Logf("IPv6 clients should be grouped per /56: %s != %s", clientNetwork(v6a), clientNetwork(v6b))
+		t.Fail()
+	}
+}
+
+func TestRateLimiterFlood(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	l := NewRateLimiter(1, 1)
+	l.now = func() time.Time { return now }
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000}
+	l.Allow(client, nil)
+
+	// Spoofed requests from many networks do not grow the limiter without
+	// bound, and a client that keeps sending keeps its bucket.
+	for i := 0; i < 3*maxBuckets; i++ {
+		spoofed := &net.UDPAddr{IP: net.IPv4(10, byte(i>>8), byte(i), 1), Port: 53}
+		l.Allow(spoofed, nil)
+		if i%1000 == 0 && l.Allow(client, nil) {
+			t.Fatalf("Client should still be limited after %d spoofed networks", i)
+		}
+	}
+	if n := len(l.buckets) + len(l.old); n > 2*maxBuckets || n < maxBuckets {
+		t.Logf("Expected between %d and %d buckets, got %d", maxBuckets, 2*maxBuckets, n)
+		t.Fail()
+	}
+}
+
+func TestServerLimiter(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		l := NewRateLimiter(0.001, 2)
+		srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer), Limiter: l, LimitTruncate: truncate}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		c := &Client{ReadTimeout: 2e8}
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		for i := 0; i < 2; i++ {
+			r, err := c.Exchange(m, addr)
+			if err != nil || r.Truncated || len(r.Extra) != 1 {
+				t.Fatalf("Request %d within the burst should be answered, got %v, %v", i, r, err)
+			}
+		}
+		r, err := c.Exchange(m, addr)
+		if truncate {
+			if err != nil || !r.Truncated || len(r.Extra) != 0 {
+				t.Logf("Request beyond the burst should be truncated, got %v, %v", r, err)
+				t.Fail()
+			}
+		} else if err == nil {
+			t.Logf("Request beyond the burst should be dropped, got %v", r)
+			t.Fail()
+		}
+		if st := srv.Stats(); st.Limited != 1 {
+			t.Logf("Expected 1 limited request, got %d", st.Limited)
+			t.Fail()
+		}
+		srv.Shutdown()
+	}
+}
@@ -38,6 +38,7 @@ var (
 	ErrPrivKey     error = &Error{Err: "bad private key"}
 	ErrKeySize     error = &Error{Err: "bad key size"}
 	ErrKeyAlg      error = &Error{Err: "bad key algorithm"}
+	ErrKeyName     error = &Error{Err: "unknown key name"}
 	ErrAlg         error = &Error{Err: "bad algorithm"}
 	ErrTime        error = &Error{Err: "bad time"}
 	ErrNoSig       error = &Error{Err: "no signature found"}
@@ -46,6 +47,7 @@ var (
 	ErrSigGen      error = &Error{Err: "bad signature generation"}
 	ErrAuth        error = &Error{Err: "bad authentication"}
 	ErrSoa         error = &Error{Err: "no SOA"}
+	ErrCnameLoop   error = &Error{Err: "CNAME loop"}
 	ErrRRset       error = &Error{Err: "bad rrset"}
 	ErrDenialNsec3 error = &Error{Err: "no NSEC3 records"}
 	ErrDenialCe    error = &Error{Err: "no matching closest encloser found"}
@@ -54,6 +56,9 @@ var (
 	ErrDenialBit   error = &Error{Err: "type not denied in NSEC3 bitmap"}
 	ErrDenialWc    error = &Error{Err: "wildcard exist, but closest encloser is denied"}
 	ErrDenialHdr   error = &Error{Err: "message rcode conflicts with message content"}
+	ErrNotStarted  error = &Error{Err: "server not started"}
+	ErrTimeout     error = &Error{Err: "handler timeout", Timeout: true}
+	ErrCookie      error = &Error{Err: "bad cookie"}
 )
 
 // A manually-unpacked version of (id, bits).
@@ -75,12 +80,13 @@ type MsgHdr struct {
 // The layout of a DNS message.
 type Msg struct {
 	MsgHdr
-	Compress bool       // If true, the message will be compressed when converted to wire format.
-	Size     int        // Number of octects in the message received from the wire.
-	Question []Question // Holds the RR(s) of the question section.
-	Answer   []RR       // Holds the RR(s) of the answer section.
-	Ns       []RR       // Holds the RR(s) of the authority section.
-	Extra    []RR       // Holds the RR(s) of the additional section.
+	Compress          bool       // If true, the message will be compressed when converted to wire format.
+	UncompressedExtra bool       // If true, the additional section is never compressed, even when Compress is true.
+	Size              int        // Number of octects in the message received from the wire.
+	Question          []Question // Holds the RR(s) of the question section.
+	Answer            []RR       // Holds the RR(s) of the answer section.
+	Ns                []RR       // Holds the RR(s) of the authority section.
+	Extra             []RR       // Holds the RR(s) of the additional section.
 }
 
 // Map of strings for each RR wire type.
@@ -671,7 +677,6 @@ func unpackStructValue(val reflect.Value, msg []byte, off int) (off1 int, err er
 				}
 				fv.Set(reflect.ValueOf(txt))
 			case `dns:"opt"`: // edns0
-				// TODO: multiple EDNS0 options
 				rdlength := int(val.FieldByName("Hdr").FieldByName("Rdlength").Uint())
 				if rdlength == 0 {
 					// This is an EDNS0 (OPT Record) with no rdata
@@ -679,29 +684,36 @@ func unpackStructValue(val reflect.Value, msg []byte, off int) (off1 int, err er
 					break
 				}
 				edns := make([]EDNS0, 0)
-				code := uint16(0)
-				if off+2 > lenmsg {
-					return lenmsg, &Error{Err: "overflow unpacking opt"}
-				}
-				code, off = unpackUint16(msg, off)
-				optlen, off1 := unpackUint16(msg, off)
-				if off1+int(optlen) > off+rdlength {
+				end := off + rdlength
+				if end > lenmsg {
 					return lenmsg, &Error{Err: "overflow unpacking opt"}
 				}
-				switch code {
-				case EDNS0NSID:
-					e := new(EDNS0_NSID)
-					e.unpack(msg[off1 : off1+int(optlen)])
-					edns = append(edns, e)
-					off = off1 + int(optlen)
-				case EDNS0SUBNET:
-					e := new(EDNS0_SUBNET)
-					e.unpack(msg[off1 : off1+int(optlen)])
-					edns = append(edns, e)
+				for off < end {
+					if off+4 > end {
+						return lenmsg, &Error{Err: "overflow unpacking opt"}
+					}
+					code, off1 := unpackUint16(msg, off)
+					optlen, off1 := unpackUint16(msg, off1)
+					if off1+int(optlen) > end {
+						return lenmsg, &Error{Err: "overflow unpacking opt"}
+					}
+					var e EDNS0
+					switch code {
+					case EDNS0NSID:
+						e = new(EDNS0_NSID)
+					case EDNS0SUBNET:
+						e = new(EDNS0_SUBNET)
+					case EDNS0COOKIE:
+						e = new(EDNS0_COOKIE)
+					}
+					// unknown options are skipped
+					if e != nil {
+						e.unpack(msg[off1 : off1+int(optlen)])
+						edns = append(edns, e)
+					}
 					off = off1 + int(optlen)
 				}
 				fv.Set(reflect.ValueOf(edns))
-				// multiple EDNS codes?
 			case `dns:"a"`:
 				if off+net.IPv4len > lenmsg {
 					return lenmsg, &Error{Err: "overflow unpacking a"}
@@ -1112,6 +1124,11 @@ func (h *MsgHdr) String() string {
 
 // Pack packs a Msg: it is converted to to wire format.
 // If the dns.Compress is true the message will be in compressed wire format.
+// If dns.UncompressedExtra is also true, the names in the additional section
+// are written out in full, some resolvers mishandle compressed glue and OPT
+// records. An rcode larger than 15, such as RcodeBadVers, needs an OPT RR to
+// hold its upper bits. Without one the rcode is put in the header as it
+// always was, where only the lower 4 bits fit.
 func (dns *Msg) Pack() (msg []byte, err error) {
 	var dh Header
 	var compression map[string]int
@@ -1123,7 +1140,12 @@ func (dns *Msg) Pack() (msg []byte, err error) {
 
 	// Convert convenient Msg into wire-like Header.
 	dh.Id = dns.Id
-	dh.Bits = uint16(dns.Opcode)<<11 | uint16(dns.Rcode)
+	rcode := uint16(dns.Rcode)
+	if dns.IsEdns0() != nil {
+		// The upper 8 bits of an extended rcode go into the OPT RR, see below.
+		rcode &= 0xF
+	}
+	dh.Bits = uint16(dns.Opcode)<<11 | rcode
 	if dns.Response {
 		dh.Bits |= _QR
 	}
@@ -1161,7 +1183,11 @@ func (dns *Msg) Pack() (msg []byte, err error) {
 	dh.Arcount = uint16(len(extra))
 
 	// TODO(mg): still a little too much, but better than 64K...
-	msg = make([]byte, dns.Len()+10)
+	// The uncompressed length is used, as not every name Len counts as
+	// compressed can be: pointers only reach the first 16K of a message.
+	u := *dns
+	u.Compress = false
+	msg = make([]byte, u.Len()+10)
 
 	// Pack it in: header and then the pieces.
 	off := 0
@@ -1185,7 +1211,15 @@ func (dns *Msg) Pack() (msg []byte, err error) {
 		}
 	}
 	for i := 0; i < len(extra); i++ {
-		off, err = PackRR(extra[i], msg, off, compression, dns.Compress)
+		rr := extra[i]
+		if opt, ok := rr.(*RR_OPT); ok {
+			// Set the bits on a copy, the caller's OPT RR is left alone
+			// and a smaller rcode packed later clears them.
+			o := *opt
+			o.SetExtendedRcode(uint8(dns.Rcode >> 4))
+			rr = &o
+		}
+		off, err = PackRR(rr, msg, off, compression, dns.Compress && !dns.UncompressedExtra)
 		if err != nil {
 			return nil, err
 		}
@@ -1243,6 +1277,9 @@ func (dns *Msg) Unpack(msg []byte) (err error) {
 			return err
 		}
 	}
+	if opt := dns.IsEdns0(); opt != nil {
+		dns.Rcode |= int(opt.ExtendedRcode()) << 4
+	}
 	if off != len(msg) {
 		// TODO(mg) remove eventually
 		// println("extra bytes in dns packet", off, "<", len(msg))
@@ -1332,7 +1369,7 @@ func (dns *Msg) Len() int {
 		l += dns.Ns[i].Len()
 	}
 	for i := 0; i < len(dns.Extra); i++ {
-		if dns.Compress {
+		if dns.Compress && !dns.UncompressedExtra {
 			if v, ok := compression[dns.Extra[i].Header().Name]; ok {
 				l += dns.Extra[i].Len() - v
 				continue
@@ -1344,11 +1381,13 @@ func (dns *Msg) Len() int {
 	return l
 }
 
+// compressionHelper adds the names s ends with to c, with the number of
+// bytes a pointer to them saves: their length on the wire minus 2.
 func compressionHelper(c map[string]int, s string) {
 	pref := ""
 	lbs := SplitLabels(s)
 	for j := len(lbs) - 1; j >= 0; j-- {
-		c[lbs[j]+"."+pref] = 1 + len(pref) + len(lbs[j])
+		c[lbs[j]+"."+pref] = len(pref) + len(lbs[j]) // +1 length byte, +1 root label, -2 pointer
 		pref = lbs[j] + "." + pref
 	}
 }
@@ -0,0 +1,132 @@
+package dns
+
+// NOTIFY, RFC 1996, lets a primary tell its secondaries a zone has changed.
+
+import (
+	"net"
+	"time"
+)
+
+// HandleNotify handles the NOTIFY message r: when it is a valid NOTIFY,
+// with a single SOA question, for a zone that has a handler registered
+// for exactly its name in DefaultServeMux, onNotify is called with the name
+// of the zone and the NOTIFY is acknowledged with an empty NOERROR
+// reply. A NOTIFY for a zone that is not served gets NOTAUTH, other
+// messages get FORMERR. A signed NOTIFY must verify, see Server.TsigSecret,
+// or it gets NOTAUTH. The reply to a signed NOTIFY has a TSIG record, with
+// the TSIG error when it did not verify, as RFC 8945 has it. Typical use
+// in a secondary:
+//
+//	dns.HandleOpcode("miek.nl.", dns.OpcodeNotify, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+//		dns.HandleNotify(w, r, refresh)
+//	}))
+//
+// Use HandleNotifyMux with a ServeMux of your own.
+func HandleNotify(w ResponseWriter, r *Msg, onNotify func(zone string)) {
+	HandleNotifyMux(w, r, DefaultServeMux, onNotify)
+}
+
+// HandleNotifyMux works like HandleNotify, but the zone must have a
+// handler registered in mux. If mux is nil every zone is accepted and
+// onNotify is left to ignore the zones that are not served.
+func HandleNotifyMux(w ResponseWriter, r *Msg, mux *ServeMux, onNotify func(zone string)) {
+	m := new(Msg)
+	write := func() {
+		setReplyTsig(w, m, r)
+		w.Write(m)
+	}
+	if r.Opcode != OpcodeNotify || len(r.Question) != 1 || r.Question[0].Qtype != TypeSOA {
+		m.SetRcodeFormatError(r)
+		m.Opcode = r.Opcode
+		write()
+		return
+	}
+	m.SetReply(r)
+	m.Opcode = OpcodeNotify
+	zone := Fqdn(r.Question[0].Name)
+	if mux != nil && !mux.serves(zone) || r.IsTsig() != nil && w.TsigStatus() != nil {
+		m.Rcode = RcodeNotAuth
+		write()
+		return
+	}
+	m.Authoritative = true
+	if onNotify != nil {
+		onNotify(zone)
+	}
+	write()
+}
+
+// A Notify holds the settings for sending NOTIFY messages, see Send. The
+// zero value sends them unsigned.
+type Notify struct {
+	ReadTimeout   time.Duration     // the net.Conn.SetReadTimeout value for the acknowledgement, defaults to 2 * 1e9
+	WriteTimeout  time.Duration     // the net.Conn.SetWriteTimeout value for the NOTIFY, defaults to 2 * 1e9
+	TsigSecret    map[string]string // secret(s) for Tsig map[<zonename>]<base64 secret>
+	TsigName      string            // if set, the NOTIFY is signed with this key, see Send
+	TsigAlgorithm string            // the algorithm of the TsigName key, defaults to HmacSHA256
+	TsigFudge     uint16            // allowed clock skew in seconds for the TsigName signature, defaults to 300
+	LocalAddr     net.Addr          // the local address to send from, see Client.LocalAddr
+}
+
+// SendNotify sends a NOTIFY for zone to the secondary at addr, over UDP,
+// and waits at most timeout for the acknowledgement. An error is
+// returned when there is no reply or the reply's rcode is not NOERROR.
+func SendNotify(addr, zone string, timeout time.Duration) error {
+	return SendNotifyFrom(nil, addr, zone, timeout)
+}
+
+// SendNotifyFrom works like SendNotify, but sends the NOTIFY from the
+// local address local, for secondaries that only accept NOTIFY messages
+// from a known address on a primary with more than one. If local is nil
+// the kernel picks the address.
+func SendNotifyFrom(local net.Addr, addr, zone string, timeout time.Duration) error {
+	n := &Notify{ReadTimeout: timeout, WriteTimeout: timeout, LocalAddr: local}
+	return n.Send(addr, zone)
+}
+
+// Send sends a NOTIFY for zone to the secondary at addr, over UDP, and
+// waits for the acknowledgement. An error is returned when there is no
+// reply or the reply's rcode is not NOERROR. When TsigName is set the
+// NOTIFY is signed with that key, using TsigAlgorithm and the secret for
+// TsigName in TsigSecret, and the acknowledgement must be signed with
+// the same key.
+func (n *Notify) Send(addr, zone string) error {
+	if n == nil {
+		n = new(Notify)
+	}
+	m := new(Msg)
+	m.SetNotify(Fqdn(zone))
+	if n.TsigName != "" {
+		setTsig(m, n.TsigName, n.TsigAlgorithm, n.TsigFudge)
+	}
+	w := new(reply)
+	w.client = &Client{ReadTimeout: n.ReadTimeout, WriteTimeout: n.WriteTimeout, TsigSecret: n.TsigSecret, LocalAddr: n.LocalAddr}
+	w.addr = addr
+	if err := w.dial(); err != nil {
+		return err
+	}
+	defer w.conn.Close()
+	if err := w.send(m); err != nil {
+		return err
+	}
+	r, err := w.receive()
+	if err != nil {
+		return err
+	}
+	if r.Id != m.Id {
+		return ErrId
+	}
+	if r.Opcode != OpcodeNotify || !r.Response {
+		return &Error{Err: "not a notify response", Name: zone}
+	}
+	if r.Rcode != RcodeSuccess {
+		return &Error{Err: "notify failed: " + Rcode_str[r.Rcode], Name: zone}
+	}
+	if n.TsigName != "" {
+		if r.IsTsig() == nil {
+			return ErrNoSig
+		}
+		return w.tsigStatus
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	notified := make(chan string, 1)
+	HandleOpcode("notify.example.", OpcodeNotify, HandlerFunc(func(w ResponseWriter, r *Msg) {
+		HandleNotify(w, r, func(zone string) { notified <- zone })
+	}))
+	defer HandleRemoveOpcode("notify.example.", OpcodeNotify)
+	secondary := &Server{Addr: "127.0.0.1:0", Net: "udp"}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	addr := serverAddr(secondary)
+
+	// The primary
+	if err := SendNotify(addr, "notify.example", time.Second); err != nil {
+		t.Fatalf("Failed to send NOTIFY: %s", err.Error())
+	}
+	select {
+	case zone := <-notified:
+		if zone != "notify.example." {
+			t.Logf("Expected a NOTIFY for notify.example., got %s", zone)
+			t.Fail()
+		}
+	default:
+		t.Log("Secondary was not notified")
+		t.Fail()
+	}
+
+	w := new(RecordingResponseWriter)
+	r := new(Msg)
+	r.SetNotify("sub.notify.example.")
+	HandleNotify(w, r, func(zone string) { notified <- zone })
+	if lastMsg(w).Rcode != RcodeNotAuth || lastMsg(w).Opcode != OpcodeNotify || len(notified) != 0 {
+		t.Logf("A NOTIFY for a zone not served should get NOTAUTH, got %s", lastMsg(w).String())
+		t.Fail()
+	}
+	r = new(Msg)
+	r.SetQuestion("notify.example.", TypeSOA)
+	HandleNotify(w, r, nil)
+	if lastMsg(w).Rcode != RcodeFormatError {
+		t.Logf("A query is not a NOTIFY, expected FORMERR, got %s", lastMsg(w).String())
+		t.Fail()
+	}
+
+	// A ServeMux of one's own decides which zones are served.
+	mux := NewServeMux()
+	mux.HandleOpcode("own.example.", OpcodeNotify, HandlerFunc(HelloServer))
+	r = new(Msg)
+	r.SetNotify("own.example.")
+	HandleNotifyMux(w, r, mux, func(zone string) { notified <- zone })
+	if lastMsg(w).Rcode != RcodeSuccess || len(notified) != 1 {
+		t.Logf("A NOTIFY for a zone in the given ServeMux should be accepted, got %s", lastMsg(w).String())
+		t.Fail()
+	}
+	<-notified
+	HandleNotify(w, r, nil)
+	if lastMsg(w).Rcode != RcodeNotAuth {
+		t.Logf("The zone is not in DefaultServeMux, expected NOTAUTH, got %s", lastMsg(w).String())
+		t.Fail()
+	}
+}
+
+func TestSendNotifyFrom(t *testing.T) {
+	from := make(chan net.Addr, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		from <- w.RemoteAddr()
+		m := new(Msg)
+		m.SetReply(r)
+		m.Opcode = OpcodeNotify
+		w.Write(m)
+	})
+	secondary := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	addr := serverAddr(secondary)
+
+	// Find a free port to send from, so the secondary can tell.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	local := l.LocalAddr().(*net.UDPAddr)
+	l.Close()
+	if err := SendNotifyFrom(local, addr, "notify.example.", time.Second); err != nil {
+		t.Fatalf("Failed to send NOTIFY: %s", err.Error())
+	}
+	if a := (<-from).String(); a != local.String() {
+		t.Logf("Expected the NOTIFY from %s, got it from %s", local, a)
+		t.Fail()
+	}
+
+	// A UDP address works for TCP as well, the port is taken along.
+	tcp := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h}
+	go tcp.ListenAndServe()
+	defer tcp.Shutdown()
+	c := &Client{Net: "tcp", LocalAddr: local}
+	m := new(Msg)
+	m.SetNotify("notify.example.")
+	if _, err := c.Exchange(m, serverAddr(tcp)); err != nil {
+		t.Fatalf("Failed to exchange over TCP: %s", err.Error())
+	}
+	if a := (<-from).String(); a != local.String() {
+		t.Logf("Expected the TCP connection from %s, got it from %s", local, a)
+		t.Fail()
+	}
+}
+
+func TestNotifyTsig(t *testing.T) {
+	notified := make(chan string, 1)
+	HandleOpcode("notify.example.", OpcodeNotify, HandlerFunc(func(w ResponseWriter, r *Msg) {
+		HandleNotify(w, r, func(zone string) { notified <- zone })
+	}))
+	defer HandleRemoveOpcode("notify.example.", OpcodeNotify)
+	secret := map[string]string{"notify.": "so6ZGir4GPAqINNh9U5c3A=="}
+	secondary := &Server{Addr: "127.0.0.1:0", Net: "udp", TsigSecret: secret}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	addr := serverAddr(secondary)
+
+	// The empty algorithm is HmacSHA256.
+	for _, alg := range []string{"", HmacSHA512, HmacMD5} {
+		n := &Notify{TsigSecret: secret, TsigName: "notify", TsigAlgorithm: alg}
+		if err := n.Send(addr, "notify.example."); err != nil {
+			t.Fatalf("Failed to send a NOTIFY signed with %q: %s", alg, err.Error())
+		}
+		if len(notified) != 1 {
+			t.Logf("Secondary was not notified with %q", alg)
+			t.Fail()
+		}
+		<-notified
+	}
+
+	bad := &Notify{TsigSecret: map[string]string{"notify.": "pRZgBrBvI4NAHZYhxmhs/Q=="}, TsigName: "notify."}
+	if err := bad.Send(addr, "notify.example."); err == nil {
+		t.Log("Expected a NOTIFY signed with the wrong secret to fail")
+		t.Fail()
+	}
+	if len(notified) != 0 {
+		t.Log("Secondary should not be notified by a NOTIFY that does not verify")
+		t.Fail()
+	}
+
+	// The NOTAUTH reply carries BADSIG in a TSIG record without a MAC.
+	m := new(Msg)
+	m.SetNotify("notify.example.")
+	m.SetTsig("notify.", HmacSHA256, 300, time.Now().Unix())
+	buf, _, err := TsigGenerate(m, "pRZgBrBvI4NAHZYhxmhs/Q==", "", false)
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err.Error())
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(buf)
+	reply := make([]byte, DefaultMsgSize)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatalf("Failed to read the reply: %s", err.Error())
+	}
+	r := new(Msg)
+	if err := r.Unpack(reply[:n]); err != nil {
+		t.Fatalf("Failed to unpack the reply: %s", err.Error())
+	}
+	if tsig := r.IsTsig(); r.Rcode != RcodeNotAuth || tsig == nil || tsig.Error != RcodeBadSig || tsig.MACSize != 0 {
+		t.Logf("Expected NOTAUTH with a BADSIG TSIG record without MAC, got %v", r)
+		t.Fail()
+	}
+}
+
+func TestHandleNotifyTsigErrors(t *testing.T) {
+	r := new(Msg)
+	r.SetNotify("notify.example.")
+	r.SetTsig("notify.", HmacSHA256, 300, time.Now().Unix())
+	tests := []struct {
+		status error
+		rcode  int
+		tsig   uint16
+	}{
+		{nil, RcodeSuccess, 0},
+		{ErrSig, RcodeNotAuth, RcodeBadSig},
+		{ErrKeyName, RcodeNotAuth, RcodeBadKey},
+		{ErrTime, RcodeNotAuth, RcodeBadTime},
+	}
+	for _, tc := range tests {
+		w := &RecordingResponseWriter{Tsig: tc.status}
+		HandleNotifyMux(w, r, nil, nil)
+		if len(w.Msgs) != 1 {
+			t.Fatalf("Expected one reply for %v, got %d", tc.status, len(w.Msgs))
+		}
+		m := w.Msgs[0]
+		if tsig := m.IsTsig(); m.Rcode != tc.rcode || tsig == nil || tsig.Error != tc.tsig {
+			t.Logf("Expected rcode %d and TSIG error %d for %v, got %v", tc.rcode, tc.tsig, tc.status, m)
+			t.Fail()
+		}
+	}
+}
@@ -17,3 +17,22 @@ func TestPackNsec3(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// Hashes from RFC 5155, Appendix A.
+func TestHashNameRFC5155(t *testing.T) {
+	for name, hash := range map[string]string{
+		"example.":       "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM",
+		"a.example.":     "35MTHGPGCU1QG68FAB165KLNSNK3DPVL",
+		"ai.example.":    "GJEQE526PLBF1G8MKLP59ENFD789NJGI",
+		"ns1.example.":   "2T7B4G4VSA5SMI47K61MV5BV1A22BOJR",
+		"w.example.":     "K8UDEMVP1J2F7EG6JEBPS17VP3N8I58H",
+		"*.w.example.":   "R53BQ7CC2UVMUBFU5OCMM6PERS9TK9EN",
+		"x.y.w.example.": "2VPTU5TIMAMQTTGL4LUU9KG21E0AOR3S",
+		"XX.Example.":    "T644EBQK9BIBCNA874GIVR6JOJ62MLHV",
+	} {
+		if h := HashName(name, SHA1, 12, "aabbccdd"); h != hash {
+			t.Logf("Hash of %s should be %s, got %s", name, hash, h)
+			t.Fail()
+		}
+	}
+}
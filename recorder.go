@@ -0,0 +1,98 @@
+package dns
+
+// A ResponseWriter for testing handlers without a network.
+
+import (
+	"net"
+	"sync"
+)
+
+// A RecordingResponseWriter is a ResponseWriter that records what the
+// handler does with it, like httptest.ResponseRecorder does for HTTP.
+// The zero value is ready to use:
+//
+//	w := new(dns.RecordingResponseWriter)
+//	dns.HandleVersion(w, r)
+//	// w.Msgs[0] holds the reply
+//
+// It is safe to use from more than one goroutine, but the fields should
+// only be read after the handler has returned.
+type RecordingResponseWriter struct {
+	Remote     net.Addr // returned by RemoteAddr, 127.0.0.1:53000 over UDP if nil
+	Local      net.Addr // returned by LocalAddr, 127.0.0.1:53 over UDP if nil
+	Net        string   // returned by Network, "udp" if empty
+	Tsig       error    // returned by TsigStatus
+	Msgs       []*Msg   // the messages given to Write
+	Bufs       [][]byte // copies of the buffers given to WriteBuf
+	TimersOnly bool     // the last value given to TsigTimersOnly
+	Hijacked   bool     // Hijack was called
+	Conn       net.Conn // returned by Hijack
+	Closed     bool     // Close was called
+	mu         sync.Mutex
+}
+
+// RemoteAddr implements ResponseWriter.
+func (w *RecordingResponseWriter) RemoteAddr() net.Addr {
+	if w.Remote == nil {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53000}
+	}
+	return w.Remote
+}
+
+// LocalAddr implements ResponseWriter.
+func (w *RecordingResponseWriter) LocalAddr() net.Addr {
+	if w.Local == nil {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	}
+	return w.Local
+}
+
+// Network implements ResponseWriter.
+func (w *RecordingResponseWriter) Network() string {
+	if w.Net == "" {
+		return "udp"
+	}
+	return w.Net
+}
+
+// Write implements ResponseWriter, m is added to Msgs.
+func (w *RecordingResponseWriter) Write(m *Msg) error {
+	w.mu.Lock()
+	w.Msgs = append(w.Msgs, m)
+	w.mu.Unlock()
+	return nil
+}
+
+// WriteBuf implements ResponseWriter, a copy of b is added to Bufs.
+func (w *RecordingResponseWriter) WriteBuf(b []byte) error {
+	w.mu.Lock()
+	w.Bufs = append(w.Bufs, append([]byte(nil), b...))
+	w.mu.Unlock()
+	return nil
+}
+
+// Close implements ResponseWriter.
+func (w *RecordingResponseWriter) Close() error {
+	w.mu.Lock()
+	w.Closed = true
+	w.mu.Unlock()
+	return nil
+}
+
+// TsigStatus implements ResponseWriter, it returns Tsig.
+func (w *RecordingResponseWriter) TsigStatus() error { return w.Tsig }
+
+// TsigTimersOnly implements ResponseWriter.
+func (w *RecordingResponseWriter) TsigTimersOnly(b bool) {
+	w.mu.Lock()
+	w.TimersOnly = b
+	w.mu.Unlock()
+}
+
+// Hijack implements ResponseWriter, it returns Conn.
+func (w *RecordingResponseWriter) Hijack() (net.Conn, error) {
+	w.mu.Lock()
+	w.Hijacked = true
+	w.mu.Unlock()
+	return w.Conn, nil
+}
@@ -0,0 +1,48 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRecordingResponseWriter(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("version.bind.", TypeTXT)
+	m.Question[0].Qclass = ClassCHAOS
+	w := new(RecordingResponseWriter)
+	HandleVersion(w, m)
+	if len(w.Msgs) != 1 {
+		t.Fatalf("Expected one reply, got %d", len(w.Msgs))
+	}
+	r := w.Msgs[0]
+	if r.Rcode != RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("Expected one answer, got %v", r)
+	}
+	txt, ok := r.Answer[0].(*RR_TXT)
+	if !ok || len(txt.Txt) != 1 || txt.Txt[0] != Version || txt.Hdr.Class != ClassCHAOS {
+		t.Logf("Expected a CHAOS TXT record with %q, got %v", Version, r.Answer[0])
+		t.Fail()
+	}
+
+	// Other names fail, see HandleFailed.
+	m.SetQuestion("miek.nl.", TypeTXT)
+	HandleVersion(w, m)
+	if len(w.Msgs) != 2 || w.Msgs[1].Rcode != RcodeServerFailure {
+		t.Log("Expected a second reply with SERVFAIL")
+		t.Fail()
+	}
+	if w.Hijacked || w.Closed || len(w.Bufs) != 0 {
+		t.Log("Expected no hijack, close or raw writes")
+		t.Fail()
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+	w = &RecordingResponseWriter{Remote: remote}
+	w.WriteBuf([]byte{1, 2})
+	w.Hijack()
+	w.Close()
+	if w.RemoteAddr() != remote || len(w.Bufs) != 1 || !w.Hijacked || !w.Closed {
+		t.Log("Expected the remote address, the buffer, the hijack and the close to be recorded")
+		t.Fail()
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package dns
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define.
+// MIPS uses a different value, there the option is not supported.
+const soReusePort = 0xf
+
+// listenUDPReusePort opens n UDP sockets on addr with SO_REUSEPORT set,
+// the kernel spreads the packets sent to addr over them. When the port in
+// addr is 0, all sockets use the port picked for the first one.
+func listenUDPReusePort(network, addr string, n int) ([]net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if e := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); e != nil {
+			return e
+		}
+		return err
+	}}
+	ls := make([]net.PacketConn, 0, n)
+	for len(ls) < n {
+		l, err := lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+		addr = l.LocalAddr().String()
+	}
+	return ls, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package dns
+
+import (
+	"net"
+)
+
+// SO_REUSEPORT is only used on Linux, elsewhere Server.NumListeners larger
+// than one is an error.
+
+func listenUDPReusePort(network, addr string, n int) ([]net.PacketConn, error) {
+	return nil, &Error{Err: "multiple UDP listeners are not supported on this platform"}
+}
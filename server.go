@@ -7,9 +7,18 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"github.com/miekg/radix"
 	"io"
+	"log"
 	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,24 +26,63 @@ type Handler interface {
 	ServeDNS(w ResponseWriter, r *Msg)
 }
 
+// HandlerContext is implemented by handlers that want to learn when the
+// request is no longer needed. The context is cancelled when the handler
+// returns, when a TCP client closes the connection or when the server is
+// shut down, if Server.WriteTimeout is set it also carries a deadline. The
+// context of a hijacked TCP connection lives on until it is closed.
+// Handlers not implementing this interface are called via ServeDNS.
+type HandlerContext interface {
+	ServeDNSContext(ctx context.Context, w ResponseWriter, r *Msg)
+}
+
+// serveDNSContext calls h with ctx if h implements HandlerContext and
+// without it otherwise.
+func serveDNSContext(ctx context.Context, h Handler, w ResponseWriter, r *Msg) {
+	if hc, ok := h.(HandlerContext); ok {
+		hc.ServeDNSContext(ctx, w, r)
+		return
+	}
+	h.ServeDNS(w, r)
+}
+
 // A ResponseWriter interface is used by an DNS handler to
-// construct an DNS response.
+// construct an DNS response. Note that LocalAddr and Network have been
+// added to it, implementations outside this package must add them too.
 type ResponseWriter interface {
 	// RemoteAddr returns the net.Addr of the client that sent the current request.
 	RemoteAddr() net.Addr
-	// Write writes a reply back to the client.
+	// LocalAddr returns the net.Addr on which the current request was received.
+	LocalAddr() net.Addr
+	// Network returns the transport the current request came in over:
+	// "udp", "tcp", TLS included, or "https" for DNS over HTTPS, where only
+	// one reply can be written. Handlers can use it to refuse a zone
+	// transfer over anything but TCP.
+	Network() string
+	// Write writes a reply back to the client. Over TCP it may be called
+	// more than once, as for a zone transfer. A reply with a TSIG record
+	// is signed, including the MAC of the request or, for the next
+	// replies, the MAC of the previous reply (RFC 2845, section 4.4).
+	// When the request had an OPT record and the reply has none, one is
+	// added with the server's UDP size and the DO bit of the request.
 	Write(*Msg) error
-	// WriteBuf writes a raw buffer back to the client.
+	// WriteBuf writes a raw buffer back to the client. If less than all
+	// of a UDP reply is sent io.ErrShortWrite is returned.
 	WriteBuf([]byte) error
-	// Close closes the connection.
+	// Close closes the connection. Over UDP the server's socket is shared
+	// with the other requests and stays open, only the response ends.
 	Close() error
 	// TsigStatus returns the status of the Tsig. 
 	TsigStatus() error
-	// TsigTimersOnly sets the tsig timers only boolean.
+	// TsigTimersOnly sets the tsig timers only boolean, it should be true
+	// for the replies after the first one of a multi-message answer.
 	TsigTimersOnly(bool)
-	// Hijack lets the caller take over the connection.
-	// After a call to Hijack(), the DNS package will not do anything with the connection
-	Hijack()
+	// Hijack lets the caller take over the connection, which is returned.
+	// After a call to Hijack(), the DNS package will not do anything with the connection.
+	// For TCP the caller must close it, no data has been read beyond the
+	// request. For UDP it is the server's socket, shared with the other
+	// requests, that must not be closed; replies go to RemoteAddr.
+	Hijack() (net.Conn, error)
 }
 
 type conn struct {
@@ -46,14 +94,29 @@ type conn struct {
 
 type response struct {
 	//	conn           *conn
-	hijacked       bool // connection has been hijacked by handler
+	hijacked       bool   // connection has been hijacked by handler
+	written        bool   // a reply has been written for the current request
+	udpSize        int    // largest UDP reply the client accepts
+	ednsSize       uint16 // UDP size to put in an OPT record in the reply, 0 if the request had none
+	ednsDo         bool   // DO bit to put in that OPT record, copied from the request
 	tsigStatus     error
 	tsigTimersOnly bool
 	tsigRequestMAC string
 	tsigSecret     map[string]string // the tsig secrets
-	_UDP           *net.UDPConn      // i/o connection if UDP was used
-	_TCP           *net.TCPConn      // i/o connection if TCP was used
+	tsigFudge      uint16            // the allowed clock skew for tsig
+	maxMsgSize     int               // largest TCP message to write, see Server.MaxMsgSize
+	writeTimeout   time.Duration     // write deadline for each reply, see Server.WriteTimeout
+	_UDP           net.PacketConn    // i/o connection if UDP was used
+	udpSession     *sessionUDP       // remote and local address of a UDP request, if known
+	_TCP           net.Conn          // i/o connection if TCP was used
 	remoteAddr     net.Addr          // address of the client
+	cancel         func()            // cancels the request's context
+	watch          *tcpWatch         // notices a TCP client going away while the handler runs
+	stats          *Stats            // counters of the server
+	cookie         *EDNS0_COOKIE     // cookie option to put in the reply, see Server.CookieSecret
+	minimalAny     bool              // the request is an ANY query to answer with HINFO, see Server.MinimalAny
+	uncompressed   bool              // only compress replies with Msg.Compress set, see Server.Uncompressed
+	maxAnswerRRs   int               // replies with more answers are sent truncated, see Server.MaxAnswerRRs
 }
 
 // ServeMux is an DNS request multiplexer. It matches the
@@ -62,12 +125,41 @@ type response struct {
 // that most closely matches the zone name. ServeMux is DNSSEC aware, meaning
 // that queries for the DS record are redirected to the parent zone (if that
 // is also registered), otherwise the child gets the query.
+// A pattern starting with a wildcard label, such as "*.example.com.", matches
+// all names below example.com. for which no closer pattern is registered.
+// Handlers registered with HandleClass are only used for requests in that
+// class and take precedence over the ones registered with Handle.
+// Handlers registered with HandleOpcode are only used for messages with
+// that opcode, such as UPDATE or NOTIFY, and are matched on the zone
+// in the question (zone) section. Messages with an opcode other than QUERY
+// for which no such handler matches go to the other handlers. Messages
+// with an opcode other than QUERY, NOTIFY and UPDATE, for which no handler
+// is registered with HandleOpcode, are answered with NOTIMP.
+// Requests without exactly one question are answered with FORMERR (none)
+// or NOTIMP (more than one), see SetQuestionRcodes.
+// The request's context is forwarded to matched handlers that implement
+// HandlerContext, this includes the DefaultServeMux.
+// Handlers may be added and removed while the ServeMux is serving.
 type ServeMux struct {
 	m *radix.Radix
+	c map[uint16]*radix.Radix // class specific handlers
+	o map[int]*radix.Radix    // opcode specific handlers
+	d Handler                 // handler for names that do not match, see SetDefaultHandler
+	q [2]int                  // rcodes for requests with no or multiple questions, see SetQuestionRcodes
+	n bool                    // the server does not recurse, see SetNoRecursion
+	l sync.RWMutex            // protects m, c, o, d, q and n
+}
+
+// muxEntry is what is stored in the trees of a ServeMux.
+type muxEntry struct {
+	pattern string
+	handler Handler
 }
 
 // NewServeMux allocates and returns a new ServeMux.
-func NewServeMux() *ServeMux { return &ServeMux{m: radix.New()} }
+func NewServeMux() *ServeMux {
+	return &ServeMux{m: radix.New(), q: [2]int{RcodeFormatError, RcodeNotImplemented}}
+}
 
 // DefaultServeMux is the default ServeMux used by Serve.
 var DefaultServeMux = NewServeMux()
@@ -78,6 +170,11 @@ var Authors = []string{"Miek Gieben", "Ask Bjørn Hansen", "Dave Cheney", "Dusty
 // Version holds the current version.
 var Version = "Go DNS"
 
+// ChaosTTL is the TTL of the TXT records HandleAuthors, HandleVersion and
+// ChaosTXTHandler answer with, 0 by default. A small TTL keeps caches in
+// between from asking for them all the time.
+var ChaosTTL uint32
+
 // The HandlerFunc type is an adapter to allow the use of
 // ordinary functions as DNS handlers.  If f is a function
 // with the appropriate signature, HandlerFunc(f) is a
@@ -98,6 +195,14 @@ func HandleFailed(w ResponseWriter, r *Msg) {
 	w.Write(m)
 }
 
+// HandleNotImplemented returns NOTIMP for every request it gets, with
+// the opcode of the request copied into the reply.
+func HandleNotImplemented(w ResponseWriter, r *Msg) {
+	m := new(Msg)
+	m.SetRcodeNotImplemented(r)
+	w.Write(m)
+}
+
 // AuthorHandler returns a HandlerFunc that returns the authors
 // of Go DNS for 'authors.bind' or 'authors.server' queries in the
 // CHAOS Class. Note with 
@@ -105,29 +210,17 @@ func HandleFailed(w ResponseWriter, r *Msg) {
 //	HandleFunc("authors.bind.", HandleAuthors)
 //
 // The handler is registered for all DNS classes, thereby potentially
-// hijacking the authors.bind. zone in the IN class. If you need the
-// authors.bind zone to exist in the IN class, you need to register
-// some other handler, check the class in there and then call HandleAuthors.
+// hijacking the authors.bind. zone in the IN class. Use
+//
+//	HandleClass("authors.bind.", ClassCHAOS, HandlerFunc(HandleAuthors))
+//
+// to only register it for the CHAOS class.
 func HandleAuthors(w ResponseWriter, r *Msg) {
-	if len(r.Question) != 1 {
-		HandleFailed(w, r)
-		return
-	}
-	if r.Question[0].Qtype != ClassCHAOS && r.Question[0].Qtype != TypeTXT {
-		HandleFailed(w, r)
-		return
-	}
-	if r.Question[0].Name != "authors.server." && r.Question[0].Name != "authors.bind." {
+	if len(r.Question) != 1 || (r.Question[0].Name != "authors.server." && r.Question[0].Name != "authors.bind.") {
 		HandleFailed(w, r)
 		return
 	}
-	m := new(Msg)
-	m.SetReply(r)
-	for _, author := range Authors {
-		h := RR_Header{r.Question[0].Name, TypeTXT, ClassCHAOS, 0, 0}
-		m.Answer = append(m.Answer, &RR_TXT{h, []string{author}})
-	}
-	w.Write(m)
+	ChaosTXTHandler(r.Question[0].Name, Authors)(w, r)
 }
 
 // VersionHandler returns a HandlerFunc that returns the version
@@ -137,33 +230,56 @@ func HandleAuthors(w ResponseWriter, r *Msg) {
 //	HandleFunc("version.bind.", HandleVersion)
 //
 // The handler is registered for all DNS classes, thereby potentially
-// hijacking the version.bind. zone in the IN class. If you need the
-// version.bind zone to exist in the IN class, you need to register
-// some other handler, check the class in there and then call HandleVersion.
+// hijacking the version.bind. zone in the IN class. Use
+//
+//	HandleClass("version.bind.", ClassCHAOS, HandlerFunc(HandleVersion))
+//
+// to only register it for the CHAOS class.
 func HandleVersion(w ResponseWriter, r *Msg) {
-	if len(r.Question) != 1 {
+	if len(r.Question) != 1 || (r.Question[0].Name != "version.server." && r.Question[0].Name != "version.bind.") {
 		HandleFailed(w, r)
 		return
 	}
-	if r.Question[0].Qtype != ClassCHAOS && r.Question[0].Qtype != TypeTXT {
-		HandleFailed(w, r)
-		return
-	}
-	if r.Question[0].Name != "version.server." && r.Question[0].Name != "version.bind." {
-		HandleFailed(w, r)
-		return
+	ChaosTXTHandler(r.Question[0].Name, []string{Version})(w, r)
+}
+
+// ChaosTXTHandler returns a HandlerFunc that answers a TXT query in the
+// CHAOS class for name with one TXT record for each of the values, with
+// a TTL of ChaosTTL. Other queries get SERVFAIL. For instance to tell
+// which server answered:
+//
+//	HandleFunc("id.server.", ChaosTXTHandler("id.server.", []string{hostname}))
+func ChaosTXTHandler(name string, values []string) HandlerFunc {
+	name = Fqdn(name)
+	return func(w ResponseWriter, r *Msg) {
+		if len(r.Question) != 1 || r.Question[0].Qclass != ClassCHAOS || r.Question[0].Qtype != TypeTXT ||
+			!strings.EqualFold(r.Question[0].Name, name) {
+			HandleFailed(w, r)
+			return
+		}
+		m := new(Msg)
+		m.SetReply(r)
+		for _, v := range values {
+			h := RR_Header{Name: r.Question[0].Name, Rrtype: TypeTXT, Class: ClassCHAOS, Ttl: ChaosTTL}
+			m.Answer = append(m.Answer, &RR_TXT{h, []string{v}})
+		}
+		w.Write(m)
 	}
-	m := new(Msg)
-	m.SetReply(r)
-	h := RR_Header{r.Question[0].Name, TypeTXT, ClassCHAOS, 0, 0}
-	m.Answer = append(m.Answer, &RR_TXT{h, []string{Version}})
-	w.Write(m)
 }
 
 func authorHandler() Handler  { return HandlerFunc(HandleAuthors) }
 func failedHandler() Handler  { return HandlerFunc(HandleFailed) }
 func versionHandler() Handler { return HandlerFunc(HandleVersion) }
 
+// rcodeHandler returns a handler that replies with rcode.
+func rcodeHandler(rcode int) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		m := new(Msg)
+		m.SetRcode(r, rcode)
+		w.Write(m)
+	})
+}
+
 // Start a server on addresss and network speficied. Invoke handler
 // for any incoming queries.
 func ListenAndServe(addr string, network string, handler Handler) error {
@@ -172,25 +288,118 @@ func ListenAndServe(addr string, network string, handler Handler) error {
 }
 
 func (mux *ServeMux) match(zone string, t uint16) Handler {
-	zone = toRadixName(zone)
-	if h, e := mux.m.Find(zone); e {
-		// If we got queried for a DS record, we must see if we
-		// if we also serve the parent. We then redirect the query to it.
-		if t != TypeDS {
-			return h.Value.(Handler)
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	if e := matchTree(mux.m, zone, t); e != nil {
+		return e.handler
+	}
+	return nil
+}
+
+// matchClass works like match, but first looks at the handlers
+// registered for class c.
+func (mux *ServeMux) matchClass(zone string, c, t uint16) *muxEntry {
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	if r, ok := mux.c[c]; ok {
+		if e := matchTree(r, zone, t); e != nil {
+			return e
 		}
-		if d := h.Up(); d != nil {
-			return d.Value.(Handler)
+	}
+	return matchTree(mux.m, zone, t)
+}
+
+// matchOpcode returns the entry registered for opcode op and zone, or nil.
+func (mux *ServeMux) matchOpcode(zone string, op int) *muxEntry {
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	if r, ok := mux.o[op]; ok {
+		return matchTree(r, zone, TypeSOA)
+	}
+	return nil
+}
+
+// matchTree returns the entry in r for zone, or nil. The names are
+// compared label by label, a pattern for the root only matches when
+// nothing closer to zone does.
+func matchTree(r *radix.Radix, zone string, t uint16) *muxEntry {
+	zone = Fqdn(zone)
+	if h := exact(r, zone); h != nil {
+		// If we got queried for a DS record, we must see if we
+		// also serve the parent. We then redirect the query to it.
+		if t == TypeDS && zone != "." {
+			if p := matchTree(r, parentOf(zone), TypeSOA); p != nil {
+				return p
+			}
 		}
 		// No parent zone found, let the original handler take care of it
-		return h.Value.(Handler)
-	} else {
-		if h == nil {
+		return h
+	}
+	// Walk up the tree, at each level a pattern for the name itself is
+	// closer than a wildcard for its siblings, which is closer than a
+	// pattern for the parent. See RFC 4592.
+	for s := zone; ; {
+		if s != zone {
+			if h := exact(r, s); h != nil {
+				return h
+			}
+		}
+		if s == "." {
 			return nil
 		}
-		return h.Value.(Handler)
+		parent := parentOf(s)
+		wildcard := "*." + parent
+		if parent == "." {
+			wildcard = "*."
+		}
+		if h := exact(r, wildcard); h != nil {
+			return h
+		}
+		s = parent
 	}
-	panic("dns: not reached")
+}
+
+// parentOf returns the fully qualified name s without its first label,
+// the parent of a top level name and of the root is the root.
+func parentOf(s string) string {
+	for i := 0; i < len(s)-1; i++ {
+		switch s[i] {
+		case '\\':
+			i++ // an escaped dot does not end the label
+		case '.':
+			return s[i+1:]
+		}
+	}
+	return "."
+}
+
+// exact returns the entry registered in r for zone, or nil.
+func exact(r *radix.Radix, zone string) *muxEntry {
+	if h, e := r.Find(toRadixName(zone)); e {
+		return h.Value.(*muxEntry)
+	}
+	return nil
+}
+
+// serves returns true if a handler is registered for exactly zone, in
+// any class or for any opcode.
+func (mux *ServeMux) serves(zone string) bool {
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	if exact(mux.m, zone) != nil {
+		return true
+	}
+	for _, r := range mux.c {
+		if exact(r, zone) != nil {
+			return true
+		}
+	}
+	for _, r := range mux.o {
+		if exact(r, zone) != nil {
+			return true
+		}
+	}
+	return false
 }
 
 // Handle adds a handler to the ServeMux for pattern.
@@ -198,7 +407,131 @@ func (mux *ServeMux) Handle(pattern string, handler Handler) {
 	if pattern == "" {
 		panic("dns: invalid pattern " + pattern)
 	}
-	mux.m.Insert(toRadixName(Fqdn(pattern)), handler)
+	mux.l.Lock()
+	mux.m.Insert(toRadixName(Fqdn(pattern)), &muxEntry{Fqdn(pattern), handler})
+	mux.l.Unlock()
+}
+
+// SetDefaultHandler sets the handler that is called when no pattern
+// matches the request. When h is nil, or SetDefaultHandler is not
+// called, SERVFAIL is returned for those requests.
+func (mux *ServeMux) SetDefaultHandler(h Handler) {
+	mux.l.Lock()
+	mux.d = h
+	mux.l.Unlock()
+}
+
+// SetQuestionRcodes sets the rcodes of the replies to requests without a
+// question, none, and to those with more than one question, multiple. The
+// defaults are RcodeFormatError and RcodeNotImplemented. These requests
+// are not handed to any handler.
+func (mux *ServeMux) SetQuestionRcodes(none, multiple int) {
+	mux.l.Lock()
+	mux.q = [2]int{none, multiple}
+	mux.l.Unlock()
+}
+
+// SetNoRecursion tells the ServeMux the server never recurses, as for an
+// authoritative only server. The RA bit is then cleared in every reply,
+// and requests with the RD bit set that match no pattern are REFUSED,
+// instead of being passed to the default handler or given SERVFAIL.
+func (mux *ServeMux) SetNoRecursion(on bool) {
+	mux.l.Lock()
+	mux.n = on
+	mux.l.Unlock()
+}
+
+// Handlers returns the patterns registered in the ServeMux, for all
+// classes and opcodes, as fully qualified names in sorted order.
+func (mux *ServeMux) Handlers() []string {
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	seen := make(map[string]bool)
+	collect := func(i interface{}) {
+		seen[i.(*muxEntry).pattern] = true
+	}
+	mux.m.Do(collect)
+	for _, r := range mux.c {
+		r.Do(collect)
+	}
+	for _, r := range mux.o {
+		r.Do(collect)
+	}
+	patterns := make([]string, 0, len(seen))
+	for p := range seen {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// Walk calls fn with the pattern, as a fully qualified name, and the
+// handler of each registration in the ServeMux. The handlers for all
+// classes come first, then the class specific and the opcode specific
+// ones, so a pattern registered more than once is visited more than once.
+// The ServeMux is locked for reading during the walk, fn must not change
+// it.
+func (mux *ServeMux) Walk(fn func(pattern string, h Handler)) {
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	visit := func(i interface{}) {
+		e := i.(*muxEntry)
+		fn(e.pattern, e.handler)
+	}
+	mux.m.Do(visit)
+	classes := make([]int, 0, len(mux.c))
+	for c := range mux.c {
+		classes = append(classes, int(c))
+	}
+	sort.Ints(classes)
+	for _, c := range classes {
+		mux.c[uint16(c)].Do(visit)
+	}
+	opcodes := make([]int, 0, len(mux.o))
+	for op := range mux.o {
+		opcodes = append(opcodes, op)
+	}
+	sort.Ints(opcodes)
+	for _, op := range opcodes {
+		mux.o[op].Do(visit)
+	}
+}
+
+// HandleClass adds a handler to the ServeMux for pattern in class c.
+func (mux *ServeMux) HandleClass(pattern string, c uint16, handler Handler) {
+	if pattern == "" {
+		panic("dns: invalid pattern " + pattern)
+	}
+	mux.l.Lock()
+	if mux.c == nil {
+		mux.c = make(map[uint16]*radix.Radix)
+	}
+	r, ok := mux.c[c]
+	if !ok {
+		r = radix.New()
+		mux.c[c] = r
+	}
+	r.Insert(toRadixName(Fqdn(pattern)), &muxEntry{Fqdn(pattern), handler})
+	mux.l.Unlock()
+}
+
+// HandleOpcode adds a handler to the ServeMux for pattern, for messages
+// with opcode op, such as OpcodeUpdate or OpcodeNotify.
+func (mux *ServeMux) HandleOpcode(pattern string, op int, handler Handler) {
+	if pattern == "" {
+		panic("dns: invalid pattern " + pattern)
+	}
+	mux.l.Lock()
+	if mux.o == nil {
+		mux.o = make(map[int]*radix.Radix)
+	}
+	r, ok := mux.o[op]
+	if !ok {
+		r = radix.New()
+		mux.o[op] = r
+	}
+	r.Insert(toRadixName(Fqdn(pattern)), &muxEntry{Fqdn(pattern), handler})
+	mux.l.Unlock()
 }
 
 // Handle adds a handler to the ServeMux for pattern.
@@ -212,26 +545,151 @@ func (mux *ServeMux) HandleRemove(pattern string) {
 		panic("dns: invalid pattern " + pattern)
 	}
 	// if its there, its gone
+	mux.l.Lock()
 	mux.m.Remove(toRadixName(Fqdn(pattern)))
+	mux.l.Unlock()
+}
+
+// HandleRemoveClass deregistrars the handler specific for pattern in
+// class c from the ServeMux.
+func (mux *ServeMux) HandleRemoveClass(pattern string, c uint16) {
+	if pattern == "" {
+		panic("dns: invalid pattern " + pattern)
+	}
+	mux.l.Lock()
+	if r, ok := mux.c[c]; ok {
+		r.Remove(toRadixName(Fqdn(pattern)))
+	}
+	mux.l.Unlock()
+}
+
+// HandleRemoveOpcode deregistrars the handler specific for pattern and
+// opcode op from the ServeMux.
+func (mux *ServeMux) HandleRemoveOpcode(pattern string, op int) {
+	if pattern == "" {
+		panic("dns: invalid pattern " + pattern)
+	}
+	mux.l.Lock()
+	if r, ok := mux.o[op]; ok {
+		r.Remove(toRadixName(Fqdn(pattern)))
+	}
+	mux.l.Unlock()
 }
 
 // ServeDNS dispatches the request to the handler whose
 // pattern most closely matches the request message. If DefaultServeMux
 // is used the correct thing for DS queries is done: a possible parent
 // is sought.
-// If no handler is found a standard SERVFAIL message is returned
+// If no handler is found the default handler is called, see SetDefaultHandler,
+// which returns a standard SERVFAIL message unless set.
 // If the request message does not have a single question in the
-// question section a SERVFAIL is returned.
+// question section a FORMERR (no question) or NOTIMP (more than one) is
+// returned, see SetQuestionRcodes.
 func (mux *ServeMux) ServeDNS(w ResponseWriter, request *Msg) {
+	mux.ServeDNSContext(context.Background(), w, request)
+}
+
+// ServeDNSContext works like ServeDNS, the context ctx is handed down
+// to the matched handler if it implements HandlerContext.
+func (mux *ServeMux) ServeDNSContext(ctx context.Context, w ResponseWriter, request *Msg) {
 	var h Handler
-	if len(request.Question) != 1 {
-		h = failedHandler()
+	if !mux.knowsOpcode(request.Opcode) {
+		h = HandlerFunc(HandleNotImplemented)
+	} else if len(request.Question) != 1 {
+		mux.l.RLock()
+		rcode := mux.q[0]
+		if len(request.Question) > 1 {
+			rcode = mux.q[1]
+		}
+		mux.l.RUnlock()
+		h = rcodeHandler(rcode)
 	} else {
-		if h = mux.match(request.Question[0].Name, request.Question[0].Qtype); h == nil {
+		q := request.Question[0]
+		var e *muxEntry
+		if request.Opcode != OpcodeQuery {
+			// The question is the zone, there is no type to look at
+			if e = mux.matchOpcode(q.Name, request.Opcode); e == nil {
+				e = mux.matchClass(q.Name, q.Qclass, TypeSOA)
+			}
+		} else {
+			e = mux.matchClass(q.Name, q.Qclass, q.Qtype)
+		}
+		if e != nil {
+			h = e.handler
+			ctx = context.WithValue(ctx, patternKey{}, e.pattern)
+		}
+		if h == nil {
+			mux.l.RLock()
+			h = mux.d
+			if mux.n && request.RecursionDesired {
+				h = rcodeHandler(RcodeRefused)
+			}
+			mux.l.RUnlock()
+		}
+		if h == nil {
 			h = failedHandler()
 		}
 	}
-	h.ServeDNS(w, request)
+	mux.l.RLock()
+	if mux.n {
+		w = &noRecursionWriter{w}
+	}
+	mux.l.RUnlock()
+	serveDNSContext(ctx, h, w, request)
+}
+
+// noRecursionWriter clears the RA bit in the replies written through it,
+// see SetNoRecursion.
+type noRecursionWriter struct {
+	ResponseWriter
+}
+
+// Write clears the RA bit in a copy of m, m itself may be shared.
+func (w *noRecursionWriter) Write(m *Msg) error {
+	if m.RecursionAvailable {
+		c := *m
+		c.RecursionAvailable = false
+		m = &c
+	}
+	return w.ResponseWriter.Write(m)
+}
+
+// WriteBuf clears the RA bit in a copy of b. A TSIG signed b is passed
+// through unchanged, as changing it would break the MAC.
+func (w *noRecursionWriter) WriteBuf(b []byte) error {
+	if len(b) > 3 && b[3]&_RA != 0 {
+		c := append([]byte(nil), b...)
+		if _, _, err := stripTsig(c); err == ErrNoSig {
+			c[3] &^= _RA
+			b = c
+		}
+	}
+	return w.ResponseWriter.WriteBuf(b)
+}
+
+// knowsOpcode returns true when the ServeMux handles messages with
+// opcode op.
+func (mux *ServeMux) knowsOpcode(op int) bool {
+	switch op {
+	case OpcodeQuery, OpcodeNotify, OpcodeUpdate:
+		return true
+	}
+	mux.l.RLock()
+	defer mux.l.RUnlock()
+	_, ok := mux.o[op]
+	return ok
+}
+
+// patternKey is the context key for the pattern a ServeMux matched.
+type patternKey struct{}
+
+// MatchedPattern returns the pattern, as a fully qualified name, that a
+// ServeMux matched to dispatch the request to the handler that was given
+// ctx, see HandlerContext. For the default handler, or when the handler
+// was not called by a ServeMux, the empty string is returned.
+func MatchedPattern(ctx context.Context) string {
+	p, _ := ctx.Value(patternKey{}).(string)
+	return p
 }
 
 // Handle registers the handler with the given pattern
@@ -243,6 +701,26 @@ func Handle(pattern string, handler Handler) { DefaultServeMux.Handle(pattern, h
 // in the DefaultServeMux.
 func HandleRemove(pattern string) { DefaultServeMux.HandleRemove(pattern) }
 
+// HandleClass registers the handler with the given pattern for
+// class c in the DefaultServeMux.
+func HandleClass(pattern string, c uint16, handler Handler) {
+	DefaultServeMux.HandleClass(pattern, c, handler)
+}
+
+// HandleRemoveClass deregisters the handle with the given pattern
+// for class c in the DefaultServeMux.
+func HandleRemoveClass(pattern string, c uint16) { DefaultServeMux.HandleRemoveClass(pattern, c) }
+
+// HandleOpcode registers the handler with the given pattern for
+// opcode op in the DefaultServeMux.
+func HandleOpcode(pattern string, op int, handler Handler) {
+	DefaultServeMux.HandleOpcode(pattern, op, handler)
+}
+
+// HandleRemoveOpcode deregisters the handle with the given pattern
+// for opcode op in the DefaultServeMux.
+func HandleRemoveOpcode(pattern string, op int) { DefaultServeMux.HandleRemoveOpcode(pattern, op) }
+
 // HandleFunc registers the handler function with the given pattern
 // in the DefaultServeMux.
 func HandleFunc(pattern string, handler func(ResponseWriter, *Msg)) {
@@ -252,14 +730,146 @@ func HandleFunc(pattern string, handler func(ResponseWriter, *Msg)) {
 // A Server defines parameters for running an DNS server.
 type Server struct {
 	Addr         string            // address to listen on, ":dns" if empty
-	Net          string            // if "tcp" it will invoke a TCP listener, otherwise an UDP one
+	Net          string            // if "tcp" it will invoke a TCP listener, "tcp-tls" a DNS over TLS one, otherwise an UDP one
 	Handler      Handler           // handler to invoke, dns.DefaultServeMux if nil
-	UDPSize      int               // default buffer size to use to read incoming UDP messages
-	ReadTimeout  time.Duration     // the net.Conn.SetReadTimeout value for new connections
-	WriteTimeout time.Duration     // the net.Conn.SetWriteTimeout value for new connections
+	UDPSize      int               // largest UDP message to receive and send, defaults to 4096
+	ReadTimeout  time.Duration     // how long to wait for the first request on a TCP connection, see IdleTimeout, and the UDP read deadline
+	WriteTimeout time.Duration     // how long writing each reply may take, the deadline is set right before the write
 	TsigSecret   map[string]string // secret(s) for Tsig map[<zonename>]<base64 secret>
+	TsigFudge    uint16            // allowed clock skew in seconds for Tsig, defaults to 300
+	IdleTimeout  time.Duration     // how long to wait for a next request on a TCP connection, defaults to 8 * 1e9
+	TLSConfig    *tls.Config       // TLS configuration, must be set when Net is "tcp-tls"
+	Listener     net.Listener      // TCP listener to use, see ActivateAndServe
+	PacketConn   net.PacketConn    // UDP "listener" to use, see ActivateAndServe
+	// PanicHandler is called when a handler panics, with the request and
+	// the value given to panic. If nil the panic is logged and SERVFAIL is
+	// returned to the client.
+	PanicHandler func(w ResponseWriter, r *Msg, p interface{})
+	// ErrorLog is used to log errors that do not stop the server, such as
+	// failed accepts, reads and unpacks. If nil the log package's standard
+	// logger is used.
+	ErrorLog *log.Logger
+	// Limiter, when set, is asked for each UDP request whether it may be
+	// answered, see RateLimiter. A request that is not allowed is dropped,
+	// or, when LimitTruncate is true, answered with an empty reply with
+	// the TC bit set, which makes real clients retry over TCP.
+	Limiter       Limiter
+	LimitTruncate bool
+	// MaxTCPConns is the maximum number of TCP connections served at the
+	// same time, zero means no limit. Connections beyond the limit are
+	// closed right after they are accepted, or, when MaxTCPConnsBlock is
+	// true, wait until another connection is done.
+	MaxTCPConns      int
+	MaxTCPConnsBlock bool
+	// TCPKeepAlive, when positive, enables TCP keep-alives with this period
+	// on accepted connections, so connections of clients that went away
+	// are closed. The default is off.
+	TCPKeepAlive time.Duration
+	// NotifyStartedFunc, when set, is called once the server is bound,
+	// right before it starts serving requests.
+	NotifyStartedFunc func()
+	// NumWorkers, when positive, is the number of goroutines that serve
+	// UDP requests. If zero a new goroutine is started for each request.
+	NumWorkers int
+	// NumListeners, when larger than one, is the number of UDP sockets
+	// ListenAndServe opens on Addr with SO_REUSEPORT, each with its own
+	// read loop, so the kernel spreads the requests over the CPUs. This is
+	// only supported on Linux.
+	NumListeners int
+	// MaxMsgSize is the largest message written over TCP, larger replies
+	// fail with an error. It defaults to, and can not be more than, 65535,
+	// the largest length the 2 byte prefix holds.
+	MaxMsgSize int
+	// CookieSecret, when set, enables DNS cookies (RFC 7873). Requests with
+	// a client cookie get a server cookie derived from it, the address of
+	// the client and CookieSecret. UDP requests that return a valid server
+	// cookie skip the Limiter, the others get replies of at most 512 bytes.
+	CookieSecret []byte
+	// UDPRecvBuf and UDPSendBuf, when positive, set the size of the kernel's
+	// receive and send buffers (SO_RCVBUF and SO_SNDBUF) of the UDP socket.
+	// A larger receive buffer drops fewer packets under load; the kernel
+	// may cap the size, see net.core.rmem_max on Linux.
+	UDPRecvBuf int
+	UDPSendBuf int
+	// DropMalformed, when true, drops requests that can not be unpacked,
+	// after logging them, instead of answering with FORMERR. This keeps
+	// the server from replying to spoofed junk, the reply being larger
+	// than the request.
+	DropMalformed bool
+	// MinimalAny, when true, replaces the answer of replies to ANY queries
+	// by a single HINFO record with "RFC8482" as the CPU (RFC 8482), so
+	// these queries can not be used to get large replies. The handler is
+	// still called, replies without an answer, such as NXDOMAIN, are sent
+	// as they are.
+	MinimalAny bool
+	// Uncompressed, when true, leaves name compression of the replies to
+	// the handlers, a reply is only compressed when Msg.Compress is set.
+	// By default all replies are compressed.
+	Uncompressed bool
+	// MinUDPSize is the largest UDP reply to a request without EDNS0, and
+	// the least a request with EDNS0 gets, a larger reply is truncated. It
+	// defaults to 512 (RFC 1035), a server on a network known to carry
+	// larger datagrams may use more. It is capped by UDPSize.
+	MinUDPSize int
+	// MaxAnswerRRs, when positive, is the most records the answer section
+	// of a UDP reply may hold. A reply with more is sent without records
+	// and with the TC bit set, so the client retries over TCP, where the
+	// whole answer is sent. This guards against huge RRsets being used for
+	// amplification, also when they fit in the UDP size.
+	MaxAnswerRRs int
+
+	lock        sync.Mutex        // protects started, activated, ctx, cancel, listener, packetConn, packetConns and tcpConns
+	started     bool              // true when listening, false after Shutdown
+	activated   bool              // listener and packetConn were given to ActivateAndServe, they are not closed
+	ctx         context.Context   // parent of the requests' contexts, cancelled on Shutdown
+	cancel      func()            // cancels ctx
+	wg          sync.WaitGroup    // tracks the running serve goroutines
+	stats       *Stats            // allocated when the server is first started
+	udpPool     sync.Pool         // read buffers for serveUDP, see udpBuffer
+	listener    net.Listener      // the TCP listener being served
+	packetConn  net.PacketConn    // the UDP socket being served
+	packetConns []net.PacketConn  // the sockets besides packetConn, see NumListeners
+	tcpConns    map[net.Conn]bool // the TCP connections being served, not the hijacked ones
+}
+
+// Stats holds the counters of a server. The counters are updated
+// atomically, use Server.Stats to get a consistent copy.
+type Stats struct {
+	Queries      uint64 // requests received
+	Responses    uint64 // responses written
+	TCPQueries   uint64 // requests received over TCP
+	UDPQueries   uint64 // requests received over UDP
+	TsigFailures uint64 // requests with a TSIG that did not verify
+	FormatErrors uint64 // requests that could not be unpacked
+	Limited      uint64 // requests dropped or truncated by the Limiter
+	TCPConns     uint64 // TCP connections served, requests per connection is TCPQueries / TCPConns
+}
+
+// Stats returns a snapshot of the server's counters.
+func (srv *Server) Stats() Stats {
+	srv.lock.Lock()
+	st := srv.stats
+	srv.lock.Unlock()
+	if st == nil {
+		return Stats{}
+	}
+	return Stats{
+		Queries:      atomic.LoadUint64(&st.Queries),
+		Responses:    atomic.LoadUint64(&st.Responses),
+		TCPQueries:   atomic.LoadUint64(&st.TCPQueries),
+		UDPQueries:   atomic.LoadUint64(&st.UDPQueries),
+		TsigFailures: atomic.LoadUint64(&st.TsigFailures),
+		FormatErrors: atomic.LoadUint64(&st.FormatErrors),
+		Limited:      atomic.LoadUint64(&st.Limited),
+		TCPConns:     atomic.LoadUint64(&st.TCPConns),
+	}
 }
 
+const (
+	shutdownTimeout    = 5 * time.Second // how long Shutdown waits for running handlers
+	defaultIdleTimeout = 8 * time.Second // default for Server.IdleTimeout
+)
+
 // ListenAndServe starts a nameserver on the configured address in *Server.
 func (srv *Server) ListenAndServe() error {
 	addr := srv.Addr
@@ -276,8 +886,44 @@ func (srv *Server) ListenAndServe() error {
 		if e != nil {
 			return e
 		}
+		defer l.Close()
+		srv.lock.Lock()
+		srv.listener = l
+		srv.start()
+		srv.lock.Unlock()
+		srv.notifyStarted()
 		return srv.serveTCP(l)
+	case "tcp-tls", "tcp4-tls", "tcp6-tls":
+		// DNS over TLS, RFC 7858
+		if srv.TLSConfig == nil {
+			return &Error{Err: "no TLSConfig for " + srv.Net}
+		}
+		network := srv.Net[:len(srv.Net)-len("-tls")]
+		if srv.Addr == "" {
+			addr = ":853"
+		}
+		a, e := net.ResolveTCPAddr(network, addr)
+		if e != nil {
+			return e
+		}
+		l, e := net.ListenTCP(network, a)
+		if e != nil {
+			return e
+		}
+		// The handshake is done on the first read in serve, if it
+		// fails the connection is dropped.
+		tl := tls.NewListener(l, srv.TLSConfig)
+		defer tl.Close()
+		srv.lock.Lock()
+		srv.listener = tl
+		srv.start()
+		srv.lock.Unlock()
+		srv.notifyStarted()
+		return srv.serveTCP(tl)
 	case "udp", "udp4", "udp6":
+		if srv.NumListeners > 1 {
+			return srv.listenAndServeUDPReusePort(addr)
+		}
 		a, e := net.ResolveUDPAddr(srv.Net, addr)
 		if e != nil {
 			return e
@@ -286,187 +932,1003 @@ func (srv *Server) ListenAndServe() error {
 		if e != nil {
 			return e
 		}
+		defer l.Close()
+		srv.lock.Lock()
+		srv.packetConn = l
+		srv.start()
+		srv.lock.Unlock()
+		srv.notifyStarted()
 		return srv.serveUDP(l)
 	}
 	return &Error{Err: "bad network"}
 }
 
+// listenAndServeUDPReusePort opens srv.NumListeners UDP sockets on addr and
+// serves each of them, it returns when the first one is closed and then
+// closes the others.
+func (srv *Server) listenAndServeUDPReusePort(addr string) error {
+	ls, e := listenUDPReusePort(srv.Net, addr, srv.NumListeners)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+	// serveUDP sets the default, do that here before it runs concurrently.
+	if srv.UDPSize == 0 {
+		srv.UDPSize = DefaultMsgSize
+	}
+	srv.lock.Lock()
+	srv.packetConn = ls[0]
+	srv.packetConns = ls[1:]
+	srv.start()
+	srv.lock.Unlock()
+	srv.notifyStarted()
+	for _, l := range ls[1:] {
+		go srv.serveUDP(l)
+	}
+	return srv.serveUDP(ls[0])
+}
+
+// ActivateAndServe starts a nameserver with the PacketConn or Listener
+// configured in *Server. The connection is already bound, so this can be
+// used with socket activation or to drop privileges after binding. If
+// both are set, both are served, the first one to stop tells the error
+// and the other one is stopped as well. The connections belong to the
+// caller and are not closed, Shutdown stops serving them by setting a
+// deadline in the past, which is cleared again when ActivateAndServe
+// returns. A Listener without a SetDeadline method is closed by Shutdown.
+// If neither is set the server falls back to ListenAndServe, when Net
+// tells how to bind.
+func (srv *Server) ActivateAndServe() error {
+	srv.lock.Lock()
+	l, p := srv.Listener, srv.PacketConn
+	if l == nil && p == nil {
+		srv.lock.Unlock()
+		switch srv.Net {
+		case "tcp", "tcp4", "tcp6", "tcp-tls", "tcp4-tls", "tcp6-tls", "udp", "udp4", "udp6":
+			return srv.ListenAndServe()
+		}
+		return &Error{Err: "no Listener or PacketConn set and bad network"}
+	}
+	srv.listener, srv.packetConn = l, p
+	srv.start()
+	srv.activated = true
+	srv.lock.Unlock()
+	srv.notifyStarted()
+	defer srv.release(l, p)
+	switch {
+	case p == nil:
+		return srv.serveTCP(l)
+	case l == nil:
+		return srv.serveUDP(p)
+	}
+	// serveUDP sets the default, do that here before it runs concurrently.
+	if srv.UDPSize == 0 {
+		srv.UDPSize = DefaultMsgSize
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- srv.serveUDP(p) }()
+	go func() { errs <- srv.serveTCP(l) }()
+	e := <-errs
+	srv.Shutdown() // stops the other one, unless it was called already
+	<-errs
+	return e
+}
+
+// deadliner is implemented by listeners that support a deadline, such as
+// *net.TCPListener.
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// release forgets the connections l and p given to ActivateAndServe, so
+// Shutdown no longer touches them, and clears the deadline Shutdown set.
+func (srv *Server) release(l net.Listener, p net.PacketConn) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.listener, srv.packetConn = nil, nil
+	if d, ok := l.(deadliner); ok {
+		d.SetDeadline(time.Time{})
+	}
+	if p != nil {
+		p.SetReadDeadline(time.Time{})
+	}
+}
+
+// Shutdown stops a server started with ListenAndServe or
+// ActivateAndServe. The listener is closed, so no new requests are
+// accepted, and the running handlers are given some time to finish.
+// After this ListenAndServe returns nil. If the server is not (yet)
+// listening ErrNotStarted is returned.
+func (srv *Server) Shutdown() error {
+	srv.lock.Lock()
+	if !srv.started {
+		srv.lock.Unlock()
+		return ErrNotStarted
+	}
+	srv.started = false
+	srv.cancel()
+	// The first error is returned. The connections given to
+	// ActivateAndServe are not closed, but get a deadline in the past.
+	var e error
+	if srv.listener != nil {
+		if d, ok := srv.listener.(deadliner); ok && srv.activated {
+			e = d.SetDeadline(time.Now())
+		} else {
+			e = srv.listener.Close()
+		}
+		srv.listener = nil
+	}
+	if srv.packetConn != nil {
+		var pe error
+		if srv.activated {
+			pe = srv.packetConn.SetReadDeadline(time.Now())
+		} else {
+			pe = srv.packetConn.Close()
+		}
+		if e == nil {
+			e = pe
+		}
+		srv.packetConn = nil
+	}
+	for _, l := range srv.packetConns {
+		l.Close()
+	}
+	srv.packetConns = nil
+	// Connections waiting for a next request give up at once, a running
+	// handler still finishes and its reply is written.
+	for c := range srv.tcpConns {
+		c.SetReadDeadline(time.Now())
+	}
+	srv.lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		srv.wg.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		return &Error{Err: "server shutdown timed out"}
+	}
+	return e
+}
+
+// start marks the server as started, srv.lock must be held.
+func (srv *Server) start() {
+	srv.started = true
+	srv.activated = false
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	if srv.stats == nil {
+		srv.stats = new(Stats)
+	}
+}
+
+// notifyStarted calls srv.NotifyStartedFunc if it is set.
+func (srv *Server) notifyStarted() {
+	if srv.NotifyStartedFunc != nil {
+		srv.NotifyStartedFunc()
+	}
+}
+
+// context returns a new context for a request.
+func (srv *Server) context() (context.Context, func()) {
+	srv.lock.Lock()
+	ctx := srv.ctx
+	srv.lock.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if srv.WriteTimeout != 0 {
+		return context.WithTimeout(ctx, srv.WriteTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isStarted reports if the server is still listening.
+func (srv *Server) isStarted() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.started
+}
+
 // serveTCP starts a TCP listener for the server.
 // Each request is handled in a seperate goroutine.
-func (srv *Server) serveTCP(l *net.TCPListener) error {
-	defer l.Close()
+func (srv *Server) serveTCP(l net.Listener) error {
 	handler := srv.Handler
 	if handler == nil {
 		handler = DefaultServeMux
 	}
-forever:
+	var delay time.Duration // how long to sleep on temporary accept failures
+	var conns chan bool     // holds a value for each connection, see MaxTCPConns
+	if srv.MaxTCPConns > 0 {
+		conns = make(chan bool, srv.MaxTCPConns)
+	}
+	var done <-chan struct{}
+	srv.lock.Lock()
+	if srv.ctx != nil {
+		done = srv.ctx.Done()
+	}
+	srv.lock.Unlock()
 	for {
-		rw, e := l.AcceptTCP()
+		rw, e := l.Accept()
 		if e != nil {
-			// don't bail out, but wait for a new request  
-			continue
-		}
-		if srv.ReadTimeout != 0 {
-			rw.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
-		}
-		if srv.WriteTimeout != 0 {
-			rw.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+			if !srv.isStarted() {
+				return nil
+			}
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				srv.logf("dns: accept error: %v; retrying in %v", e, delay)
+				time.Sleep(delay)
+				continue
+			}
+			srv.logf("dns: accept error: %v", e)
+			return e
 		}
-		l := make([]byte, 2)
-		n, err := rw.Read(l)
-		if err != nil || n != 2 {
-			continue
+		delay = 0
+		if conns != nil {
+			if srv.MaxTCPConnsBlock {
+				select {
+				case conns <- true:
+				case <-done:
+					rw.Close()
+					return nil
+				}
+			} else {
+				select {
+				case conns <- true:
+				default:
+					srv.logf("dns: too many TCP connections, closing connection from %s", rw.RemoteAddr())
+					rw.Close()
+					continue
+				}
+			}
 		}
-		length, _ := unpackUint16(l, 0)
-		if length == 0 {
-			continue
+		if srv.TCPKeepAlive > 0 {
+			if ka, ok := rw.(keepAliver); ok {
+				ka.SetKeepAlive(true)
+				ka.SetKeepAlivePeriod(srv.TCPKeepAlive)
+			}
 		}
-		m := make([]byte, int(length))
-		n, err = rw.Read(m[:int(length)])
-		if err != nil || n == 0 {
-			continue
+		srv.lock.Lock()
+		if srv.tcpConns == nil {
+			srv.tcpConns = make(map[net.Conn]bool)
 		}
-		i := n
-		for i < int(length) {
-			j, err := rw.Read(m[i:int(length)])
-			if err != nil {
-				continue forever
+		srv.tcpConns[rw] = true
+		srv.lock.Unlock()
+		srv.wg.Add(1)
+		go func() {
+			srv.serve(rw.RemoteAddr(), handler, nil, nil, nil, rw)
+			srv.lock.Lock()
+			delete(srv.tcpConns, rw)
+			srv.lock.Unlock()
+			if conns != nil {
+				<-conns
 			}
-			i += j
-		}
-		n = i
-		go serve(rw.RemoteAddr(), handler, m, nil, rw, srv.TsigSecret)
+			srv.wg.Done()
+		}()
 	}
 	panic("dns: not reached")
 }
 
+// keepAliver is implemented by connections that support TCP keep-alives,
+// such as *net.TCPConn.
+type keepAliver interface {
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+}
+
+// logTCPReadError logs the error e of reading a request from a, after
+// which the connection is closed.
+func (srv *Server) logTCPReadError(a net.Addr, e error) {
+	if e == ErrShortRead {
+		srv.logf("dns: TCP read error from %s: zero length message, closing connection", a)
+		return
+	}
+	srv.logf("dns: TCP read error from %s: %v", a, e)
+}
+
+// readTCP reads a single length prefixed message from r. Both the
+// length and the message itself may arrive in multiple reads. A zero
+// length is a protocol error, ErrShortRead is returned for it.
+func readTCP(r io.Reader) ([]byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return nil, err
+	}
+	length, _ := unpackUint16(l, 0)
+	if length == 0 {
+		return nil, ErrShortRead
+	}
+	m := make([]byte, int(length))
+	if _, err := io.ReadFull(r, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// A tcpWatch reads from a TCP connection while the handler runs, so the
+// request's context is cancelled when the client closes the connection. A
+// byte read that belongs to the next request is kept for readTCP.
+type tcpWatch struct {
+	conn    net.Conn
+	stopped int32 // set when stop aborts the read
+	done    chan struct{}
+	b       [1]byte
+	n       int
+}
+
+// watchTCP starts watching c, cancel is called when the client goes away.
+func watchTCP(c net.Conn, cancel func()) *tcpWatch {
+	tw := &tcpWatch{conn: c, done: make(chan struct{})}
+	c.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(tw.done)
+		n, err := c.Read(tw.b[:])
+		tw.n = n
+		if n == 0 && err != nil && atomic.LoadInt32(&tw.stopped) == 0 {
+			cancel()
+		}
+	}()
+	return tw
+}
+
+// stop ends the read of tw and returns what it read.
+func (tw *tcpWatch) stop() []byte {
+	atomic.StoreInt32(&tw.stopped, 1)
+	tw.conn.SetReadDeadline(time.Unix(1, 0))
+	<-tw.done
+	tw.conn.SetReadDeadline(time.Time{})
+	return tw.b[:tw.n]
+}
+
+// stopWatch stops the watch of w, if any. A byte it read is put in front
+// of the connection.
+func (w *response) stopWatch() {
+	if w.watch == nil {
+		return
+	}
+	b := w.watch.stop()
+	w.watch = nil
+	if len(b) == 0 || w._TCP == nil {
+		return
+	}
+	if p, ok := w._TCP.(*prefixConn); ok {
+		p.buf = append(p.buf, b...)
+		return
+	}
+	w._TCP = &prefixConn{w._TCP, append([]byte(nil), b...)}
+}
+
+// prefixConn is a net.Conn whose reads return buf before reading from the
+// connection.
+type prefixConn struct {
+	net.Conn
+	buf []byte
+}
+
+// Read implements the net.Conn interface.
+func (p *prefixConn) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 {
+		return p.Conn.Read(b)
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
 // serveUDP starts a UDP listener for the server.
 // Each request is handled in a seperate goroutine.
-func (srv *Server) serveUDP(l *net.UDPConn) error {
-	defer l.Close()
+func (srv *Server) serveUDP(l net.PacketConn) error {
 	handler := srv.Handler
 	if handler == nil {
 		handler = DefaultServeMux
 	}
 	if srv.UDPSize == 0 {
-		srv.UDPSize = udpMsgSize
+		srv.UDPSize = DefaultMsgSize
+	}
+	u, isUDP := l.(*net.UDPConn)
+	if isUDP {
+		setUDPSocketOptions(u)
+		if srv.UDPRecvBuf > 0 {
+			if e := u.SetReadBuffer(srv.UDPRecvBuf); e != nil {
+				srv.logf("dns: failed to set the UDP receive buffer: %v", e)
+			}
+		}
+		if srv.UDPSendBuf > 0 {
+			if e := u.SetWriteBuffer(srv.UDPSendBuf); e != nil {
+				srv.logf("dns: failed to set the UDP send buffer: %v", e)
+			}
+		}
+	}
+	var work chan udpRequest
+	if srv.NumWorkers > 0 {
+		work = make(chan udpRequest, srv.NumWorkers)
+		defer close(work)
+		for i := 0; i < srv.NumWorkers; i++ {
+			go func() {
+				for r := range work {
+					srv.serve(r.a, handler, r.m, l, r.s, nil)
+					srv.udpPool.Put(r.bp)
+					srv.wg.Done()
+				}
+			}()
+		}
 	}
 	for {
 		if srv.ReadTimeout != 0 {
 			l.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
+			// Checked after setting the deadline, so the one Shutdown
+			// sets is never overwritten.
+			if !srv.isStarted() {
+				return nil
+			}
 		}
-		if srv.WriteTimeout != 0 {
-			l.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+		var (
+			n int
+			a net.Addr
+			s *sessionUDP
+			e error
+		)
+		bp := srv.udpBuffer()
+		m := *bp
+		if isUDP {
+			if n, s, e = readFromSessionUDP(u, m); e == nil {
+				a = s.RemoteAddr()
+			}
+		} else {
+			n, a, e = l.ReadFrom(m)
 		}
-		m := make([]byte, srv.UDPSize)
-		n, a, e := l.ReadFromUDP(m)
 		if e != nil || n == 0 {
+			srv.udpPool.Put(bp)
+			if !srv.isStarted() {
+				return nil
+			}
+			if e == nil || isTimeout(e) {
+				// nothing there, wait for a new request
+				continue
+			}
+			srv.logf("dns: UDP read error: %v", e)
+			if errors.Is(e, net.ErrClosed) {
+				// the connection was closed under us, nothing more to read
+				return e
+			}
 			// don't bail out, but wait for a new request
 			continue
 		}
 		m = m[:n]
-		go serve(a, handler, m, l, nil, srv.TsigSecret)
+		srv.wg.Add(1)
+		if work != nil {
+			work <- udpRequest{a, s, m, bp}
+			continue
+		}
+		go func() {
+			srv.serve(a, handler, m, l, s, nil)
+			srv.udpPool.Put(bp)
+			srv.wg.Done()
+		}()
 	}
 	panic("dns: not reached")
 }
 
-// Serve a new connection.
-func serve(a net.Addr, h Handler, m []byte, u *net.UDPConn, t *net.TCPConn, tsigSecret map[string]string) {
-	// for block to make it easy to break out to close the tcp connection
-	for {
-		// Request has been read in serveUDP or serveTCP
-		w := new(response)
-		w.tsigSecret = tsigSecret
-		w._UDP = u
-		w._TCP = t
-		w.remoteAddr = a
-		req := new(Msg)
-		if req.Unpack(m) != nil {
+// udpRequest is a UDP request handed to a worker, see Server.NumWorkers.
+type udpRequest struct {
+	a  net.Addr
+	s  *sessionUDP
+	m  []byte
+	bp *[]byte // backing buffer of m, returned to srv.udpPool
+}
+
+// udpBuffer returns a buffer of srv.UDPSize bytes from the pool, it
+// must be given back with srv.udpPool.Put.
+func (srv *Server) udpBuffer() *[]byte {
+	if bp, ok := srv.udpPool.Get().(*[]byte); ok && cap(*bp) >= srv.UDPSize {
+		*bp = (*bp)[:srv.UDPSize]
+		return bp
+	}
+	b := make([]byte, srv.UDPSize)
+	return &b
+}
+
+// Serve a new connection. For UDP the request m has been read in serveUDP,
+// together with the session s if available, and it is the only one
+// answered. For TCP the requests are read from the connection t, one after
+// the other, until the client closes it, it has been idle for too long,
+// the handler hijacks or closes it, or the server shuts down. For UDP m is
+// a pooled buffer that is reused when serve returns, so nothing may keep a
+// reference to it: Unpack copies all it needs and the TSIG check is done
+// before the handler runs.
+func (srv *Server) serve(a net.Addr, h Handler, m []byte, u net.PacketConn, s *sessionUDP, t net.Conn) {
+	srv.lock.Lock()
+	stats := srv.stats
+	srv.lock.Unlock()
+	if t == nil {
+		srv.serveMsg(a, h, m, u, s, nil, stats)
+		return
+	}
+	atomic.AddUint64(&stats.TCPConns, 1)
+	timeout := srv.ReadTimeout // for the first request, the idle timeout after that
+	for first := true; ; first = false {
+		if timeout != 0 {
+			t.SetReadDeadline(time.Now().Add(timeout))
+		}
+		// Checked after setting the deadline, so the one Shutdown sets is
+		// never overwritten.
+		if !srv.isStarted() {
+			t.Close()
+			return
+		}
+		var e error
+		if m, e = readTCP(t); e != nil {
+			// EOF: the client is done, or closed the connection without asking anything
+			if e != io.EOF && srv.isStarted() && (first || !isTimeout(e)) {
+				srv.logTCPReadError(a, e)
+			}
+			t.Close()
+			return
+		}
+		w := srv.serveMsg(a, h, m, nil, nil, t, stats)
+		if w.hijacked {
+			// client takes care of the connection, i.e. calls Close()
+			return
+		}
+		if w._TCP == nil {
+			// the handler closed the connection, or it was closed after an error
+			return
+		}
+		if !srv.isStarted() {
+			w.Close()
+			return
+		}
+		t = w._TCP // it may hold the start of the next request, see tcpWatch
+		timeout = srv.IdleTimeout
+		if timeout == 0 {
+			timeout = defaultIdleTimeout
+		}
+	}
+}
+
+// serveMsg answers the single request m, which is read from u or t. The
+// request is checked against the settings of the server and then given
+// to h, or answered here when a check fails. The response is returned, for
+// TCP its connection is nil when it has been closed. Each request gets a
+// new response, so the TSIG status and MAC of one request never carry
+// over to the next one on a TCP connection; MACs are only chained over
+// the replies to a single request, see TsigTimersOnly.
+func (srv *Server) serveMsg(a net.Addr, h Handler, m []byte, u net.PacketConn, s *sessionUDP, t net.Conn, stats *Stats) *response {
+	w := new(response)
+	w.tsigSecret = srv.TsigSecret
+	w.tsigFudge = srv.TsigFudge
+	if w.tsigFudge == 0 {
+		w.tsigFudge = TsigDefaultFudge
+	}
+	w.maxMsgSize = srv.MaxMsgSize
+	w.writeTimeout = srv.WriteTimeout
+	w.uncompressed = srv.Uncompressed
+	w._UDP = u
+	w.udpSession = s
+	w._TCP = t
+	w.remoteAddr = a
+	w.stats = stats
+	size := srv.UDPSize
+	if size == 0 {
+		size = DefaultMsgSize
+	}
+	w.udpSize = udpMsgSize
+	if srv.MinUDPSize > 0 {
+		w.udpSize = srv.MinUDPSize
+	}
+	if w.udpSize > size {
+		w.udpSize = size
+	}
+	ctx, cancel := srv.context()
+	w.cancel = cancel
+	// done ends the request, a TCP connection is closed when abort is true
+	done := func(abort bool) *response {
+		cancel()
+		if abort && t != nil {
+			w.Close()
+		}
+		return w
+	}
+	atomic.AddUint64(&stats.Queries, 1)
+	if t != nil {
+		atomic.AddUint64(&stats.TCPQueries, 1)
+	} else {
+		atomic.AddUint64(&stats.UDPQueries, 1)
+	}
+	req := new(Msg)
+	if e := req.Unpack(m); e != nil {
+		srv.logf("dns: unpack error from %s: %v", a, e)
+		atomic.AddUint64(&stats.FormatErrors, 1)
+		if !srv.DropMalformed {
 			// Send a format error back
 			x := new(Msg)
 			x.SetRcodeFormatError(req)
 			w.Write(x)
-			break
 		}
-
-		w.tsigStatus = nil
-		if w.tsigSecret != nil {
-			if t := req.IsTsig(); t != nil {
-				secret := t.Hdr.Name
-				if _, ok := tsigSecret[secret]; !ok {
-					w.tsigStatus = ErrKeyAlg
-				}
-				w.tsigStatus = TsigVerify(m, tsigSecret[secret], "", false)
-				w.tsigTimersOnly = false
-				w.tsigRequestMAC = req.Extra[len(req.Extra)-1].(*RR_TSIG).MAC
-			}
+		return done(true)
+	}
+	w.minimalAny = srv.MinimalAny && req.Opcode == OpcodeQuery && len(req.Question) == 1 && req.Question[0].Qtype == TypeANY
+	validated := false
+	if srv.CookieSecret != nil {
+		var e error
+		if w.cookie, validated, e = srv.checkCookie(a, req); e != nil {
+			x := new(Msg)
+			x.SetRcodeFormatError(req)
+			w.Write(x)
+			return done(true)
 		}
-		h.ServeDNS(w, req) // this does the writing back to the client
-		if w.hijacked {
-			// client takes care of the connection, i.e. calls Close()
-			break
+	}
+	if t == nil && srv.Limiter != nil && !validated && !srv.Limiter.Allow(a, req) {
+		atomic.AddUint64(&stats.Limited, 1)
+		if srv.LimitTruncate {
+			x := new(Msg)
+			x.SetReply(req)
+			x.Truncated = true
+			w.Write(x)
+		}
+		return done(false)
+	}
+	opt := req.IsEdns0()
+	if opt != nil {
+		w.ednsSize = uint16(size)
+		w.ednsDo = opt.Do()
+		if int(opt.UDPSize()) > w.udpSize {
+			w.udpSize = int(opt.UDPSize())
+		}
+		if w.udpSize > size {
+			w.udpSize = size
 		}
+	}
+	if srv.CookieSecret != nil && !validated {
+		w.udpSize = udpMsgSize
+	}
+	if t == nil {
+		w.maxAnswerRRs = srv.MaxAnswerRRs
+	}
+	srv.verifyTsig(w, req, m)
+
+	if opt != nil && opt.Version() != 0 {
+		// Only version 0 is defined, RFC 6891 section 6.1.3
+		x := new(Msg)
+		x.SetRcode(req, RcodeBadVers)
+		x.SetEdns0(w.ednsSize, w.ednsDo)
+		w.Write(x)
+	} else {
 		if t != nil {
-			w.Close()
+			w.watch = watchTCP(t, cancel)
 		}
-		break
+		srv.serveHandler(ctx, h, w, req) // this does the writing back to the client
+		w.stopWatch()
+	}
+	if w.hijacked && t != nil {
+		// the context lives on until the client calls Close()
+		return w
 	}
-	return
+	return done(false)
+}
+
+// verifyTsig checks the TSIG record of req, with m as it was received,
+// and sets the TSIG status and request MAC of w for the reply.
+func (srv *Server) verifyTsig(w *response, req *Msg, m []byte) {
+	if w.tsigSecret == nil {
+		return
+	}
+	t := req.IsTsig()
+	if t == nil {
+		return
+	}
+	secret := t.Hdr.Name
+	if s, ok := w.tsigSecret[secret]; ok {
+		w.tsigStatus = TsigVerifyFudge(m, s, "", false, w.tsigFudge)
+	} else {
+		w.tsigStatus = ErrKeyName
+	}
+	if w.tsigStatus != nil {
+		srv.logf("dns: TSIG verification failed for %s from %s: %v", secret, w.remoteAddr, w.tsigStatus)
+		atomic.AddUint64(&w.stats.TsigFailures, 1)
+	}
+	w.tsigTimersOnly = false
+	w.tsigRequestMAC = t.MAC
+}
+
+// Ping checks if the server answers: an "id.server." TXT query in the
+// CHAOS class is sent to the address the server listens on, and a reply,
+// with any rcode, must come back within timeout. For a wildcard address
+// the loopback address is used. ErrNotStarted is returned when the
+// server is not listening. A DNS over TLS server can not be pinged.
+func (srv *Server) Ping(timeout time.Duration) error {
+	srv.lock.Lock()
+	started, l, p := srv.started, srv.listener, srv.packetConn
+	srv.lock.Unlock()
+	if !started {
+		return ErrNotStarted
+	}
+	c := &Client{ReadTimeout: timeout, WriteTimeout: timeout}
+	var a net.Addr
+	switch {
+	case strings.HasSuffix(srv.Net, "-tls"):
+		return &Error{Err: "can not ping a server over TLS"}
+	case l != nil:
+		c.Net = "tcp"
+		a = l.Addr()
+	case p != nil:
+		a = p.LocalAddr()
+	default:
+		return ErrNotStarted
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if strings.HasSuffix(srv.Net, "6") {
+			host = "::1"
+		}
+	}
+	m := new(Msg)
+	m.SetQuestion("id.server.", TypeTXT)
+	m.Question[0].Qclass = ClassCHAOS
+	r, err := c.Exchange(m, net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	if r.Id != m.Id || !r.Response {
+		return ErrId
+	}
+	return nil
+}
+
+// logf logs to srv.ErrorLog or, when that is nil, to the standard logger.
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// isTimeout reports whether err is a timeout of a deadline.
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// serveHandler calls the handler and recovers from a panic in it. The
+// panic is given to srv.PanicHandler, or, if that is not set, logged
+// and answered with SERVFAIL when nothing has been written yet.
+func (srv *Server) serveHandler(ctx context.Context, h Handler, w *response, req *Msg) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		if srv.PanicHandler != nil {
+			srv.PanicHandler(w, req, p)
+			return
+		}
+		srv.logf("dns: panic serving %s: %v\n%s", w.remoteAddr, p, debug.Stack())
+		if w.hijacked || w.written {
+			return
+		}
+		x := new(Msg)
+		x.SetRcode(req, RcodeServerFailure)
+		w.Write(x)
+	}()
+	serveDNSContext(ctx, h, w, req)
 }
 
 // Write implements the ResponseWriter.Write method.
 func (w *response) Write(m *Msg) (err error) {
-	var data []byte
-	if w.tsigSecret != nil { // if no secrets, dont check for the tsig (which is a longer check)
-		if t := m.IsTsig(); t != nil {
-			data, w.tsigRequestMAC, err = TsigGenerate(m, w.tsigSecret[t.Hdr.Name], w.tsigRequestMAC, w.tsigTimersOnly)
-			if err != nil {
-				return err
-			}
-			return w.WriteBuf(data)
-		}
+	if w.ednsSize > 0 && m.IsEdns0() == nil {
+		m = withEdns0(m, w.ednsSize, w.ednsDo)
+	}
+	if w.cookie != nil && m.IsEdns0() != nil {
+		m = withCookie(m, w.cookie)
 	}
-	data, err = m.Pack()
+	if w.minimalAny {
+		m = withMinimalAny(m)
+	}
+	if w.maxAnswerRRs > 0 && len(m.Answer) > w.maxAnswerRRs {
+		m = withoutRecords(m)
+	}
+	if !w.uncompressed && !m.Compress {
+		t := *m
+		t.Compress = true
+		m = &t
+	}
+	data, mac, err := w.pack(m)
 	if err != nil {
 		return err
 	}
+	if w._UDP != nil && w.udpSize > 0 && len(data) > w.udpSize {
+		// too large for the client, send a truncated copy so it retries over TCP
+		size := w.udpSize
+		if tsig := m.IsTsig(); tsig != nil && w.tsigSecret != nil {
+			// Truncate measures the TSIG record without the MAC pack adds
+			size -= tsigMACSize(tsig.Algorithm)
+		}
+		t := *m
+		t.Truncate(size)
+		if data, mac, err = w.pack(&t); err != nil {
+			return err
+		}
+	}
+	w.tsigRequestMAC = mac
 	return w.WriteBuf(data)
 }
 
+// NewResponseWriter returns a ResponseWriter that writes its replies to
+// conn, each prefixed with its length as for TCP. The replies are sent to
+// remote, if it is nil conn.RemoteAddr() is used. This can be used to run
+// handlers without a Server, in tests or over other transports.
+func NewResponseWriter(conn net.Conn, remote net.Addr) ResponseWriter {
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &response{_TCP: conn, remoteAddr: remote}
+}
+
+// NewPacketResponseWriter is like NewResponseWriter, but it writes each
+// reply as a single packet to remote, as for UDP. Replies are not
+// truncated, as the size the client accepts is not known.
+func NewPacketResponseWriter(conn net.PacketConn, remote net.Addr) ResponseWriter {
+	return &response{_UDP: conn, remoteAddr: remote}
+}
+
+// withEdns0 returns a copy of m with an OPT record advertising size, and
+// with the DO bit when do is true, added to it. The OPT record is put
+// before a TSIG record, if any.
+func withEdns0(m *Msg, size uint16, do bool) *Msg {
+	t := *m
+	extra := m.Extra
+	var tsig []RR
+	if m.IsTsig() != nil {
+		extra, tsig = extra[:len(extra)-1], extra[len(extra)-1:]
+	}
+	t.Extra = append([]RR{}, extra...)
+	t.SetEdns0(size, do)
+	t.Extra = append(t.Extra, tsig...)
+	return &t
+}
+
+// minimalAnyTTL is the TTL of the HINFO record of withMinimalAny.
+const minimalAnyTTL = 3600
+
+// withMinimalAny returns a copy of m, a reply to an ANY query, with its
+// answer replaced by a HINFO record for the name in the question, see
+// Server.MinimalAny. A reply without an answer is returned as is.
+func withMinimalAny(m *Msg) *Msg {
+	if len(m.Answer) == 0 || len(m.Question) == 0 {
+		return m
+	}
+	q := m.Question[0]
+	class := q.Qclass
+	if class == ClassANY {
+		class = ClassINET
+	}
+	t := *m
+	t.Answer = []RR{&RR_HINFO{Hdr: RR_Header{Name: q.Name, Rrtype: TypeHINFO, Class: class, Ttl: minimalAnyTTL}, Cpu: "RFC8482"}}
+	return &t
+}
+
+// withoutRecords returns a copy of m with the TC bit set and only the OPT
+// and TSIG records left, see Server.MaxAnswerRRs.
+func withoutRecords(m *Msg) *Msg {
+	t := *m
+	t.Truncated = true
+	t.Answer, t.Ns, t.Extra = nil, nil, nil
+	for _, r := range m.Extra {
+		switch r.Header().Rrtype {
+		case TypeOPT, TypeTSIG:
+			t.Extra = append(t.Extra, r)
+		}
+	}
+	return &t
+}
+
+// pack packs m, and signs it when it has a TSIG record. The new request
+// MAC is returned. A copy of m is signed, the handler may share m and its
+// TSIG record.
+func (w *response) pack(m *Msg) ([]byte, string, error) {
+	if w.tsigSecret != nil { // if no secrets, dont check for the tsig (which is a longer check)
+		if t := m.IsTsig(); t != nil {
+			if t.Error == RcodeBadSig || t.Error == RcodeBadKey {
+				// the request did not verify, the reply has no MAC, see setReplyTsig
+				data, err := m.Pack()
+				return data, w.tsigRequestMAC, err
+			}
+			// TsigGenerate fills in the time signed of the record as well.
+			c, tc := *m, *t
+			if tc.Fudge == 0 {
+				tc.Fudge = w.tsigFudge
+			}
+			c.Extra = append(append([]RR(nil), m.Extra[:len(m.Extra)-1]...), &tc)
+			return TsigGenerate(&c, w.tsigSecret[t.Hdr.Name], w.tsigRequestMAC, w.tsigTimersOnly)
+		}
+	}
+	data, err := m.Pack()
+	return data, w.tsigRequestMAC, err
+}
+
 // WriteBuf implements the ResponseWriter.WriteBuf method.
 func (w *response) WriteBuf(m []byte) (err error) {
 	switch {
 	case w._UDP != nil:
-		_, err := w._UDP.WriteTo(m, w.remoteAddr)
+		var (
+			n   int
+			err error
+		)
+		if w.writeTimeout != 0 {
+			w._UDP.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		}
+		if u, ok := w._UDP.(*net.UDPConn); ok && w.udpSession != nil {
+			n, err = writeToSessionUDP(u, m, w.udpSession)
+		} else {
+			n, err = w._UDP.WriteTo(m, w.remoteAddr)
+		}
 		if err != nil {
 			return err
 		}
+		if n != len(m) {
+			// the client got a partial datagram, if anything
+			return io.ErrShortWrite
+		}
 	case w._TCP != nil:
-		if len(m) > MaxMsgSize {
+		max := w.maxMsgSize
+		if max <= 0 || max > maxTCPMsgSize {
+			max = maxTCPMsgSize
+		}
+		if len(m) > max {
 			return &Error{Err: "message too large"}
 		}
+		if w.writeTimeout != 0 {
+			w._TCP.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		}
 		l := make([]byte, 2)
 		l[0], l[1] = packUint16(uint16(len(m)))
-		n, err := w._TCP.Write(l)
-		if err != nil {
+		if err := writeFull(w._TCP, l); err != nil {
 			return err
 		}
-		if n != 2 {
-			return io.ErrShortWrite
+		if err := writeFull(w._TCP, m); err != nil {
+			return err
 		}
-		n, err = w._TCP.Write(m)
+	}
+	w.written = true
+	if w.stats != nil {
+		atomic.AddUint64(&w.stats.Responses, 1)
+	}
+	return nil
+}
+
+// maxTCPMsgSize is the largest length the 2 byte prefix of a TCP message holds.
+const maxTCPMsgSize = 65535
+
+// writeFull writes all of b to w, a connection may accept less than all
+// of it in one Write.
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
 		if err != nil {
 			return err
 		}
-		i := n
-		if i < len(m) {
-			j, err := w._TCP.Write(m[i:len(m)])
-			if err != nil {
-				return err
-			}
-			i += j
+		if n == 0 {
+			return io.ErrShortWrite
 		}
-		n = i
+		b = b[n:]
 	}
 	return nil
 }
@@ -474,6 +1936,40 @@ func (w *response) WriteBuf(m []byte) (err error) {
 // RemoteAddr implements the ResponseWriter.RemoteAddr method.
 func (w *response) RemoteAddr() net.Addr { return w.remoteAddr }
 
+// LocalAddr implements the ResponseWriter.LocalAddr method. For UDP
+// this is the destination address of the request, when it is known,
+// otherwise the address the socket is bound to. For link-local IPv6
+// requests the zone is the interface the request arrived on.
+func (w *response) LocalAddr() net.Addr {
+	switch {
+	case w._UDP != nil:
+		a := w._UDP.LocalAddr()
+		if w.udpSession == nil {
+			return a
+		}
+		if ip, zone := parseDstFromOOB(w.udpSession.context); ip != nil {
+			if ua, ok := a.(*net.UDPAddr); ok {
+				if zone == "" {
+					zone = ua.Zone
+				}
+				return &net.UDPAddr{IP: ip, Port: ua.Port, Zone: zone}
+			}
+		}
+		return a
+	case w._TCP != nil:
+		return w._TCP.LocalAddr()
+	}
+	return nil
+}
+
+// Network implements the ResponseWriter.Network method.
+func (w *response) Network() string {
+	if w._TCP != nil {
+		return "tcp"
+	}
+	return "udp"
+}
+
 // TsigStatus implements the ResponseWriter.TsigStatus method.
 func (w *response) TsigStatus() error { return w.tsigStatus }
 
@@ -481,14 +1977,28 @@ func (w *response) TsigStatus() error { return w.tsigStatus }
 func (w *response) TsigTimersOnly(b bool) { w.tsigTimersOnly = b }
 
 // Hijack implements the ResponseWriter.Hijack method.
-func (w *response) Hijack() { w.hijacked = true }
+func (w *response) Hijack() (net.Conn, error) {
+	w.stopWatch()
+	if w._TCP != nil {
+		w.hijacked = true
+		return w._TCP, nil
+	}
+	if u, ok := w._UDP.(*net.UDPConn); ok {
+		w.hijacked = true
+		return u, nil
+	}
+	return nil, &Error{Err: "no connection to hijack"}
+}
 
 // Close implements the ResponseWriter.Close method
 func (w *response) Close() error {
+	if w.cancel != nil {
+		w.cancel()
+	}
 	if w._UDP != nil {
-		e := w._UDP.Close()
+		// the socket belongs to the server, closing it would stop it
 		w._UDP = nil
-		return e
+		return nil
 	}
 	if w._TCP != nil {
 		e := w._TCP.Close()
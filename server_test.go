@@ -1,6 +1,21 @@
 package dns
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -71,6 +86,58 @@ func BenchmarkServing(b *testing.B) {
 	}
 }
 
+func BenchmarkServingUDPAllocs(b *testing.B) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		b.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+	reply := make([]byte, DefaultMsgSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(buf)
+		conn.Read(reply)
+	}
+}
+
+func BenchmarkServingUDPGoroutines(b *testing.B) { benchmarkServingUDPParallel(b, 0) }
+func BenchmarkServingUDPWorkers(b *testing.B)    { benchmarkServingUDPParallel(b, 4) }
+
+func benchmarkServingUDPParallel(b *testing.B, workers int) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer), NumWorkers: workers}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Fatalf("Failed to dial: %s", err.Error())
+		}
+		defer conn.Close()
+		reply := make([]byte, DefaultMsgSize)
+		for pb.Next() {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.Write(buf)
+			conn.Read(reply)
+		}
+	})
+}
+
 func TestDotAsCatchAllWildcard(t *testing.T) {
 	mux := NewServeMux()
 	mux.Handle(".", HandlerFunc(HelloServer))
@@ -96,3 +163,2376 @@ func TestDotAsCatchAllWildcard(t *testing.T) {
 		t.Error("boe. match failed")
 	}
 }
+
+// serverAddr waits until srv is listening and returns its address.
+func serverAddr(srv *Server) string {
+	for i := 0; i < 100; i++ {
+		srv.lock.Lock()
+		l, p := srv.listener, srv.packetConn
+		srv.lock.Unlock()
+		if l != nil {
+			return l.Addr().String()
+		}
+		if p != nil {
+			return p.LocalAddr().String()
+		}
+		time.Sleep(1e7)
+	}
+	return ""
+}
+
+func TestShutdown(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: HandlerFunc(HelloServer)}
+		if err := srv.Shutdown(); err != ErrNotStarted {
+			t.Logf("Shutdown of an unstarted server should return ErrNotStarted, got %v", err)
+			t.Fail()
+		}
+		done := make(chan error)
+		go func() {
+			done <- srv.ListenAndServe()
+		}()
+		addr := serverAddr(srv)
+		if addr == "" {
+			t.Fatal("Server did not start")
+		}
+
+		c := new(Client)
+		c.Net = network
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		r, err := c.Exchange(m, addr)
+		if err != nil || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+			t.Logf("Failed to exchange over %s: %v", network, err)
+			t.Fail()
+		}
+		if err := srv.Shutdown(); err != nil {
+			t.Logf("Shutdown failed: %s", err.Error())
+			t.Fail()
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Logf("ListenAndServe should return nil after Shutdown, got %s", err.Error())
+				t.Fail()
+			}
+		case <-time.After(2 * time.Second):
+			t.Log("ListenAndServe did not return after Shutdown")
+			t.Fail()
+		}
+	}
+}
+
+func TestServingUDPClosed(t *testing.T) {
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind: %s", err.Error())
+	}
+	var logs bytes.Buffer
+	srv := &Server{PacketConn: p, Handler: HandlerFunc(HelloServer), ReadTimeout: 20 * time.Millisecond}
+	srv.ErrorLog = log.New(&logs, "", 0)
+	done := make(chan error)
+	go func() {
+		done <- srv.ActivateAndServe()
+	}()
+	defer srv.Shutdown()
+
+	// Idle for a few read deadlines, which are not errors.
+	time.Sleep(100 * time.Millisecond)
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	if _, err := c.Exchange(m, p.LocalAddr().String()); err != nil {
+		t.Fatalf("Failed to exchange after idling: %s", err.Error())
+	}
+
+	// Closing the connection, without Shutdown, ends the read loop.
+	p.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Log("Expected an error after the connection was closed")
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ActivateAndServe did not return after the connection was closed")
+	}
+	if n := strings.Count(logs.String(), "UDP read error"); n != 1 {
+		t.Logf("Expected one logged read error, got %q", logs.String())
+		t.Fail()
+	}
+}
+
+func TestActivateAndServe(t *testing.T) {
+	srv := new(Server)
+	if err := srv.ActivateAndServe(); err == nil {
+		t.Log("ActivateAndServe without a connection or network should fail")
+		t.Fail()
+	}
+
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind: %s", err.Error())
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind: %s", err.Error())
+	}
+	udp := &Server{PacketConn: p, Handler: HandlerFunc(HelloServer)}
+	tcp := &Server{Listener: l, Handler: HandlerFunc(HelloServer)}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	for network, addr := range map[string]string{"udp": p.LocalAddr().String(), "tcp": l.Addr().String()} {
+		c := new(Client)
+		c.Net = network
+		r, err := c.Exchange(m, addr)
+		if err != nil || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+			t.Logf("Failed to exchange over pre-bound %s: %v", network, err)
+			t.Fail()
+		}
+	}
+
+	// With both set, as with socket activation of port 53, both are served.
+	if p, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to bind: %s", err.Error())
+	}
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to bind: %s", err.Error())
+	}
+	both := &Server{PacketConn: p, Listener: l, Handler: HandlerFunc(HelloServer)}
+	fin := make(chan error, 1)
+	go func() { fin <- both.ActivateAndServe() }()
+	serverAddr(both)
+	for network, addr := range map[string]string{"udp": p.LocalAddr().String(), "tcp": l.Addr().String()} {
+		c := &Client{Net: network}
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Logf("Failed to exchange over %s with both set: %s", network, err.Error())
+			t.Fail()
+		}
+	}
+	both.Shutdown()
+	select {
+	case <-fin:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ActivateAndServe did not return after Shutdown")
+	}
+	if both.PacketConn != p || both.Listener != l {
+		t.Log("Shutdown should leave PacketConn and Listener alone")
+		t.Fail()
+	}
+
+	// The connections are the caller's, they are not closed and can be
+	// served again.
+	again := &Server{PacketConn: p, Listener: l, Handler: HandlerFunc(HelloServer)}
+	go func() { fin <- again.ActivateAndServe() }()
+	serverAddr(again)
+	for network, addr := range map[string]string{"udp": p.LocalAddr().String(), "tcp": l.Addr().String()} {
+		c := &Client{Net: network}
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Logf("Failed to exchange over %s served again: %s", network, err.Error())
+			t.Fail()
+		}
+	}
+	// When one of them fails the other one is stopped as well.
+	p.Close()
+	select {
+	case err := <-fin:
+		if err == nil {
+			t.Log("ActivateAndServe should return the error of the closed PacketConn")
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ActivateAndServe did not return after the PacketConn was closed")
+	}
+	defer l.Close()
+	last := &Server{Listener: l, Handler: HandlerFunc(HelloServer)}
+	go last.ActivateAndServe()
+	defer last.Shutdown()
+	serverAddr(last)
+	if _, err := (&Client{Net: "tcp"}).Exchange(m, l.Addr().String()); err != nil {
+		t.Logf("The Listener should still be usable: %s", err.Error())
+		t.Fail()
+	}
+}
+
+func TestReadTCPByteByByte(t *testing.T) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+	a, b := packUint16(uint16(len(buf)))
+	buf = append([]byte{a, b}, buf...)
+
+	r, w := net.Pipe()
+	go func() {
+		for i := 0; i < len(buf); i++ {
+			w.Write(buf[i : i+1])
+		}
+		w.Close()
+	}()
+	in, err := readTCP(r)
+	if err != nil {
+		t.Fatalf("Failed to read message: %s", err.Error())
+	}
+	r1 := new(Msg)
+	if err := r1.Unpack(in); err != nil {
+		t.Fatalf("Failed to unpack message: %s", err.Error())
+	}
+	if r1.Id != m.Id || r1.Question[0] != m.Question[0] {
+		t.Logf("Message not reassembled correctly: %v", r1)
+		t.Fail()
+	}
+}
+
+func TestServingHijack(t *testing.T) {
+	errs := make(chan error, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		conn, err := w.Hijack()
+		if err != nil {
+			errs <- err
+			return
+		}
+		if w.Network() == "udp" {
+			_, err = conn.(*net.UDPConn).WriteTo([]byte("raw udp"), w.RemoteAddr())
+		} else {
+			_, err = conn.Write([]byte("raw tcp"))
+			conn.Close()
+		}
+		errs <- err
+	})
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: h}
+		go srv.ListenAndServe()
+		conn, err := net.Dial(network, serverAddr(srv))
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		buf, _ := m.Pack()
+		if network == "tcp" {
+			a, b := packUint16(uint16(len(buf)))
+			buf = append([]byte{a, b}, buf...)
+		}
+		conn.Write(buf)
+		if err := <-errs; err != nil {
+			t.Fatalf("Failed to write over the hijacked %s connection: %s", network, err.Error())
+		}
+		got, err := io.ReadAll(io.LimitReader(conn, 7))
+		conn.Close()
+		srv.Shutdown()
+		if err != nil || string(got) != "raw "+network {
+			t.Logf("Expected %q from the handler, got %q and %v", "raw "+network, got, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestServingCloseUDP(t *testing.T) {
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		HelloServer(w, r)
+		if err := w.Close(); err != nil {
+			t.Logf("Close of a UDP response failed: %s", err.Error())
+			t.Fail()
+		}
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	// Close ends the response, the socket is left open for the next one.
+	c := &Client{ReadTimeout: time.Second}
+	for i := 0; i < 2; i++ {
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Fatalf("Failed to exchange query %d: %s", i, err.Error())
+		}
+	}
+}
+
+func TestServingPersistentTCP(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	var out []byte
+	ids := []uint16{}
+	for i := 0; i < 2; i++ {
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		ids = append(ids, m.Id)
+		buf, _ := m.Pack()
+		a, b := packUint16(uint16(len(buf)))
+		out = append(out, a, b)
+		out = append(out, buf...)
+	}
+	// Send both queries back-to-back
+	if _, err := conn.Write(out); err != nil {
+		t.Fatalf("Failed to write: %s", err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		buf, err := readTCP(conn)
+		if err != nil {
+			t.Fatalf("Failed to read response %d: %s", i, err.Error())
+		}
+		r := new(Msg)
+		if err := r.Unpack(buf); err != nil || r.Id != ids[i] {
+			t.Logf("Bad response %d: %v", i, r)
+			t.Fail()
+		}
+	}
+}
+
+func TestShutdownIdleTCP(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+
+	// A keepalive client that asked one question and now waits.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+	a, b := packUint16(uint16(len(buf)))
+	if _, err := conn.Write(append([]byte{a, b}, buf...)); err != nil {
+		t.Fatalf("Failed to write: %s", err.Error())
+	}
+	if _, err := readTCP(conn); err != nil {
+		t.Fatalf("Failed to read response: %s", err.Error())
+	}
+
+	start := time.Now()
+	if err := srv.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %s", err.Error())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Shutdown took %v with an idle TCP client", d)
+	}
+	if _, err := readTCP(conn); err == nil {
+		t.Fatal("Connection should be closed after Shutdown")
+	}
+}
+
+func TestServingZeroLengthTCP(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer)}
+	logged := new(bytes.Buffer)
+	srv.ErrorLog = log.New(logged, "", 0)
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+
+	for _, query := range []bool{false, true} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if query {
+			// first a good query, the connection is kept open after it
+			if _, err := tcpQuery(conn); err != nil {
+				t.Fatalf("Query failed: %s", err.Error())
+			}
+		}
+		if _, err := conn.Write([]byte{0, 0}); err != nil {
+			t.Fatalf("Failed to write: %s", err.Error())
+		}
+		if _, err := conn.Read(make([]byte, 2)); err != io.EOF {
+			t.Logf("Expected the connection to be closed after a zero length message, got %v", err)
+			t.Fail()
+		}
+		conn.Close()
+	}
+
+	// the listener is not affected
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tcpQuery(conn); err != nil {
+		t.Logf("Query after zero length messages failed: %s", err.Error())
+		t.Fail()
+	}
+	conn.Close()
+	srv.Shutdown()
+	if n := strings.Count(logged.String(), "zero length message"); n != 2 {
+		t.Logf("Expected 2 zero length messages to be logged, got %d: %s", n, logged.String())
+		t.Fail()
+	}
+}
+
+func TestServingTCPTimeoutsPerQuery(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer)}
+	srv.ReadTimeout = 200 * time.Millisecond
+	srv.WriteTimeout = 200 * time.Millisecond
+	srv.IdleTimeout = 400 * time.Millisecond
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tcpQuery(conn); err != nil {
+		t.Fatalf("First query failed: %s", err.Error())
+	}
+	// past the read and write timeouts since the accept, but within
+	// the idle timeout
+	time.Sleep(300 * time.Millisecond)
+	if _, err := tcpQuery(conn); err != nil {
+		t.Logf("Second query failed: %s", err.Error())
+		t.Fail()
+	}
+}
+
+// tcpQuery sends a query over conn and returns the reply.
+func tcpQuery(conn net.Conn) (*Msg, error) {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+	a, b := packUint16(uint16(len(buf)))
+	if _, err := conn.Write(append([]byte{a, b}, buf...)); err != nil {
+		return nil, err
+	}
+	buf, err := readTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Msg)
+	return r, r.Unpack(buf)
+}
+
+func TestMaxTCPConns(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer), MaxTCPConns: 2}
+	srv.ErrorLog = log.New(new(bytes.Buffer), "", 0)
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conns = append(conns, conn)
+		if i < 2 {
+			// Make sure the server has accepted it before the next dial
+			if _, err := tcpQuery(conn); err != nil {
+				t.Fatalf("Connection %d within the limit failed: %s", i, err.Error())
+			}
+		}
+	}
+	if _, err := tcpQuery(conns[2]); err == nil {
+		t.Log("Connection beyond the limit should be closed")
+		t.Fail()
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := tcpQuery(conns[i]); err != nil {
+			t.Logf("Existing connection %d should keep working: %s", i, err.Error())
+			t.Fail()
+		}
+	}
+
+	// When one is closed there is room for a new one
+	conns[0].Close()
+	time.Sleep(1e8)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tcpQuery(conn); err != nil {
+		t.Logf("New connection after a close failed: %s", err.Error())
+		t.Fail()
+	}
+}
+
+// selfSignedCert returns a self-signed certificate for 127.0.0.1.
+func selfSignedCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool, nil
+}
+
+func TestServingTLS(t *testing.T) {
+	cert, pool, err := selfSignedCert()
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err.Error())
+	}
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp-tls", Handler: HandlerFunc(HelloServer)}
+	if err := srv.ListenAndServe(); err == nil {
+		t.Fatal("ListenAndServe without TLSConfig should fail")
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	// A failing handshake must not stop the server
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Write([]byte("not a TLS handshake"))
+		c.Close()
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+	a, b := packUint16(uint16(len(buf)))
+	if _, err := conn.Write(append([]byte{a, b}, buf...)); err != nil {
+		t.Fatalf("Failed to write: %s", err.Error())
+	}
+	buf, err = readTCP(conn)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err.Error())
+	}
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+		t.Logf("Bad response over TLS: %v", r)
+		t.Fail()
+	}
+}
+
+type contextServer struct {
+	started chan bool
+	err     chan error
+}
+
+func (h *contextServer) ServeDNS(w ResponseWriter, r *Msg) {
+	h.err <- nil
+	HelloServer(w, r)
+}
+
+func (h *contextServer) ServeDNSContext(ctx context.Context, w ResponseWriter, r *Msg) {
+	if _, ok := ctx.Deadline(); !ok {
+		h.err <- &Error{Err: "no deadline"}
+		return
+	}
+	h.started <- true
+	select {
+	case <-ctx.Done():
+		h.err <- ctx.Err()
+	case <-time.After(2 * time.Second):
+		h.err <- &Error{Err: "context not cancelled"}
+	}
+}
+
+func TestServeDNSContext(t *testing.T) {
+	h := &contextServer{make(chan bool, 1), make(chan error, 1)}
+	mux := NewServeMux()
+	mux.Handle("miek.nl.", h)
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: mux, WriteTimeout: time.Minute}
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	go new(Client).Exchange(m, addr)
+	select {
+	case <-h.started:
+	case err := <-h.err:
+		t.Fatalf("Handler failed: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handler not called with a context")
+	}
+	srv.Shutdown()
+	if err := <-h.err; err != context.Canceled {
+		t.Logf("Shutdown should cancel the context, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestServeDNSContextClose(t *testing.T) {
+	errs := make(chan error, 1)
+	started := make(chan bool, 1)
+	h := contextHandler(func(ctx context.Context, w ResponseWriter, r *Msg) {
+		started <- true
+		select {
+		case <-ctx.Done():
+			errs <- ctx.Err()
+		case <-time.After(2 * time.Second):
+			errs <- &Error{Err: "context not cancelled"}
+		}
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	conn, err := net.Dial("tcp", serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	buf, _ := m.Pack()
+	a, b := packUint16(uint16(len(buf)))
+	conn.Write(append([]byte{a, b}, buf...))
+	<-started
+	conn.Close()
+	if err := <-errs; err != context.Canceled {
+		t.Logf("Closing the TCP connection should cancel the context, got %v", err)
+		t.Fail()
+	}
+
+	// The context of a hijacked UDP request ends with the handler.
+	var hijacked context.Context
+	u := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: contextHandler(func(ctx context.Context, w ResponseWriter, r *Msg) {
+		w.Hijack()
+		hijacked = ctx
+		errs <- nil
+	})}
+	go u.ListenAndServe()
+	defer u.Shutdown()
+	c := &Client{ReadTimeout: 200 * time.Millisecond}
+	c.Exchange(m, serverAddr(u))
+	<-errs
+	select {
+	case <-hijacked.Done():
+	case <-time.After(time.Second):
+		t.Log("The context of a hijacked UDP request should be cancelled")
+		t.Fail()
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: HandlerFunc(HelloServer)}
+		if err := srv.Ping(time.Second); err != ErrNotStarted {
+			t.Logf("Ping of an unstarted %s server should return ErrNotStarted, got %v", network, err)
+			t.Fail()
+		}
+		go srv.ListenAndServe()
+		serverAddr(srv)
+		if err := srv.Ping(time.Second); err != nil {
+			t.Logf("Ping of a running %s server failed: %s", network, err.Error())
+			t.Fail()
+		}
+		srv.Shutdown()
+		if err := srv.Ping(200 * time.Millisecond); err == nil {
+			t.Logf("Ping of a shut down %s server should fail", network)
+			t.Fail()
+		}
+	}
+	// a wildcard address is pinged over the loopback address
+	srv := &Server{Addr: ":0", Net: "udp", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	serverAddr(srv)
+	if err := srv.Ping(time.Second); err != nil {
+		t.Logf("Ping of a server on a wildcard address failed: %s", err.Error())
+		t.Fail()
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+
+	const N = 10
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	for i := 0; i < N; i++ {
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Fatalf("Failed to exchange: %s", err.Error())
+		}
+	}
+	// Shutdown waits for the handlers, so all counters are updated
+	srv.Shutdown()
+	st := srv.Stats()
+	if st.Queries != N || st.UDPQueries != N || st.TCPQueries != 0 || st.TCPConns != 0 || st.Responses != N {
+		t.Logf("Bad counters after %d queries: %+v", N, st)
+		t.Fail()
+	}
+}
+
+func TestServerStatsTCP(t *testing.T) {
+	var logs bytes.Buffer
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer)}
+	srv.ErrorLog = log.New(&logs, "", 0)
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+
+	const C, N = 2, 3
+	for i := 0; i < C; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		for j := 0; j < N; j++ {
+			if _, err := tcpQuery(conn); err != nil {
+				t.Fatalf("Failed query %d on connection %d: %s", j, i, err.Error())
+			}
+		}
+		conn.Close()
+	}
+	srv.Shutdown()
+	st := srv.Stats()
+	if st.TCPConns != C || st.TCPQueries != C*N || st.UDPQueries != 0 || st.Responses != C*N {
+		t.Logf("Bad counters after %d queries on %d connections: %+v", C*N, C, st)
+		t.Fail()
+	}
+	// Closing the connection after the last query is not an error
+	if logs.Len() != 0 {
+		t.Logf("Expected nothing to be logged, got %q", logs.String())
+		t.Fail()
+	}
+}
+
+func TestServingMalformed(t *testing.T) {
+	// A header claiming a question that is not there.
+	junk := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, drop := range []bool{false, true} {
+		var logs bytes.Buffer
+		srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer), DropMalformed: drop}
+		srv.ErrorLog = log.New(&logs, "", 0)
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.Write(junk)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 512)
+		n, err := conn.Read(buf)
+		conn.Close()
+		if drop && n != 0 {
+			t.Logf("Expected no reply when dropping, got %d bytes", n)
+			t.Fail()
+		}
+		if !drop {
+			r := new(Msg)
+			if err != nil || r.Unpack(buf[:n]) != nil || r.Id != 0x1234 || r.Rcode != RcodeFormatError {
+				t.Logf("Expected a FORMERR reply, got %v (%v)", r, err)
+				t.Fail()
+			}
+		}
+		srv.Shutdown()
+		if st := srv.Stats(); st.FormatErrors != 1 {
+			t.Logf("Expected one format error, got %d", st.FormatErrors)
+			t.Fail()
+		}
+		if !strings.Contains(logs.String(), "unpack error") {
+			t.Logf("Expected the malformed request to be logged, got %q", logs.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		local := make(chan net.Addr, 1)
+		h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+			local <- w.LocalAddr()
+			HelloServer(w, r)
+		})
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: h}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		c := new(Client)
+		c.Net = network
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Fatalf("Failed to exchange over %s: %s", network, err.Error())
+		}
+		if a := <-local; a == nil || a.String() != addr || a.Network() != network {
+			t.Logf("LocalAddr over %s should be %s, got %v", network, addr, a)
+			t.Fail()
+		}
+		srv.Shutdown()
+	}
+}
+
+func TestResponseNetwork(t *testing.T) {
+	got := make(chan string, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		got <- w.Network()
+		HelloServer(w, r)
+	})
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: h}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		c := new(Client)
+		c.Net = network
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Fatalf("Failed to exchange over %s: %s", network, err.Error())
+		}
+		if n := <-got; n != network {
+			t.Logf("Expected Network to return %s, got %s", network, n)
+			t.Fail()
+		}
+		srv.Shutdown()
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		if r.Question[0].Name == "panic.miek.nl." {
+			panic("handler went wrong")
+		}
+		HelloServer(w, r)
+	})
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: h}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		c := new(Client)
+		c.Net = network
+		m := new(Msg)
+		m.SetQuestion("panic.miek.nl.", TypeTXT)
+		r, err := c.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("Failed to exchange over %s: %s", network, err.Error())
+		}
+		if r.Rcode != RcodeServerFailure {
+			t.Logf("Expected SERVFAIL over %s, got %s", network, Rcode_str[r.Rcode])
+			t.Fail()
+		}
+		m.SetQuestion("miek.nl.", TypeTXT)
+		if r, err = c.Exchange(m, addr); err != nil || r.Rcode != RcodeSuccess {
+			t.Logf("Server stopped serving over %s after a panic: %v", network, err)
+			t.Fail()
+		}
+		srv.Shutdown()
+	}
+
+	called := make(chan interface{}, 1)
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h}
+	srv.PanicHandler = func(w ResponseWriter, r *Msg, p interface{}) {
+		called <- p
+		HandleFailed(w, r)
+	}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	m := new(Msg)
+	m.SetQuestion("panic.miek.nl.", TypeTXT)
+	if _, err := new(Client).Exchange(m, serverAddr(srv)); err != nil {
+		t.Fatalf("Failed to exchange: %s", err.Error())
+	}
+	if p := <-called; p != "handler went wrong" {
+		t.Logf("PanicHandler got %v", p)
+		t.Fail()
+	}
+}
+
+func TestServerErrorLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(HelloServer)}
+	srv.ErrorLog = log.New(buf, "", 0)
+	go srv.ListenAndServe()
+
+	conn, err := net.Dial("tcp", serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	// A zero length prefix is not a valid message.
+	conn.Write([]byte{0, 0})
+	conn.Read(make([]byte, 1))
+	conn.Close()
+	srv.Shutdown()
+
+	if !strings.Contains(buf.String(), "TCP read error") {
+		t.Logf("Expected a TCP read error to be logged, got %q", buf.String())
+		t.Fail()
+	}
+}
+
+// flakyListener fails the first n calls to Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	n int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary accept failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.n > 0 {
+		l.n--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to bind: %s", err.Error())
+	}
+	fl := &flakyListener{Listener: l, n: 3}
+	srv := &Server{Listener: fl, Handler: HandlerFunc(HelloServer)}
+	srv.ErrorLog = log.New(new(bytes.Buffer), "", 0)
+	fin := make(chan error, 1)
+	go func() { fin <- srv.ActivateAndServe() }()
+
+	c := new(Client)
+	c.Net = "tcp"
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	if _, err := c.Exchange(m, l.Addr().String()); err != nil {
+		t.Fatalf("Failed to exchange after temporary accept errors: %s", err.Error())
+	}
+
+	// A permanent error must be returned to the caller.
+	l.Close()
+	select {
+	case err := <-fin:
+		if err == nil {
+			t.Log("ActivateAndServe should return the accept error")
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ActivateAndServe did not return after a permanent accept error")
+	}
+}
+
+// keepAliveListener records the keep-alive settings of the connections
+// it accepts.
+type keepAliveListener struct {
+	net.Listener
+	conns chan *keepAliveConn
+}
+
+type keepAliveConn struct {
+	net.Conn
+	mu     sync.Mutex
+	on     bool
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	kc := &keepAliveConn{Conn: c}
+	l.conns <- kc
+	return kc, nil
+}
+
+func (c *keepAliveConn) SetKeepAlive(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.on = on
+	return nil
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.period = d
+	return nil
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	for _, period := range []time.Duration{0, 30 * time.Second} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to bind: %s", err.Error())
+		}
+		kl := &keepAliveListener{Listener: l, conns: make(chan *keepAliveConn, 1)}
+		srv := &Server{Listener: kl, Handler: HandlerFunc(HelloServer), TCPKeepAlive: period}
+		go srv.ActivateAndServe()
+
+		c := &Client{Net: "tcp"}
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		if _, err := c.Exchange(m, l.Addr().String()); err != nil {
+			t.Fatalf("Failed to exchange: %s", err.Error())
+		}
+		kc := <-kl.conns
+		kc.mu.Lock()
+		on, p := kc.on, kc.period
+		kc.mu.Unlock()
+		if on != (period > 0) || p != period {
+			t.Logf("TCPKeepAlive %v: got keep-alive %v with period %v", period, on, p)
+			t.Fail()
+		}
+		srv.Shutdown()
+	}
+}
+
+func TestServingUDPWorkers(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer), NumWorkers: 2}
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := new(Client)
+			m := new(Msg)
+			m.SetQuestion("miek.nl.", TypeTXT)
+			r, err := c.Exchange(m, addr)
+			if err != nil {
+				t.Logf("Exchange with workers failed: %s", err.Error())
+				t.Fail()
+				return
+			}
+			if txt := r.Extra[0].(*RR_TXT).Txt[0]; txt != "Hello world" {
+				t.Logf("Unexpected result %s", txt)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := srv.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %s", err.Error())
+	}
+}
+
+func TestNotifyStartedFunc(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan bool)
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: HandlerFunc(HelloServer)}
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ListenAndServe()
+		<-started
+
+		srv.lock.Lock()
+		var addr string
+		if srv.listener != nil {
+			addr = srv.listener.Addr().String()
+		} else {
+			addr = srv.packetConn.LocalAddr().String()
+		}
+		srv.lock.Unlock()
+		c := &Client{Net: network}
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Logf("Exchange over %s right after start failed: %s", network, err.Error())
+			t.Fail()
+		}
+		srv.Shutdown()
+	}
+}
+
+func HelloServerLarge(w ResponseWriter, req *Msg) {
+	m := new(Msg)
+	m.SetReply(req)
+	for i := 0; i < 50; i++ {
+		m.Answer = append(m.Answer, &RR_A{Hdr: RR_Header{Name: m.Question[0].Name, Rrtype: TypeA, Class: ClassINET, Ttl: 0}, A: net.IPv4(127, 0, 0, byte(i))})
+	}
+	w.Write(m)
+}
+
+func TestServingMinimalAny(t *testing.T) {
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		m := new(Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		if r.Question[0].Name != "miek.nl." {
+			m.Rcode = RcodeNameError
+			w.Write(m)
+			return
+		}
+		for _, s := range []string{"miek.nl. 3600 IN A 127.0.0.1", "miek.nl. 3600 IN MX 10 mx.miek.nl.", "miek.nl. 3600 IN TXT \"hello\""} {
+			rr, _ := NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.Write(m)
+	})
+	for _, minimal := range []bool{false, true} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h, MinimalAny: minimal}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		c := new(Client)
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeANY)
+		r, err := c.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("Failed to exchange: %s", err.Error())
+		}
+		if !r.Authoritative || len(r.Question) != 1 || r.Question[0].Name != "miek.nl." || r.Question[0].Qtype != TypeANY {
+			t.Logf("Expected an authoritative reply for miek.nl./ANY, got %v", r)
+			t.Fail()
+		}
+		if !minimal && len(r.Answer) != 3 {
+			t.Logf("Expected all 3 records without MinimalAny, got %d", len(r.Answer))
+			t.Fail()
+		}
+		if minimal {
+			if len(r.Answer) != 1 {
+				t.Fatalf("Expected a single record with MinimalAny, got %d", len(r.Answer))
+			}
+			if hinfo, ok := r.Answer[0].(*RR_HINFO); !ok || hinfo.Cpu != "RFC8482" || hinfo.Hdr.Name != "miek.nl." {
+				t.Logf("Expected a HINFO RFC8482 record with MinimalAny, got %v", r.Answer[0])
+				t.Fail()
+			}
+			// Other types and replies without an answer are left alone.
+			m.SetQuestion("miek.nl.", TypeA)
+			if r, err := c.Exchange(m, addr); err != nil || len(r.Answer) != 3 {
+				t.Logf("Expected the full answer for an A query, got %v (%v)", r, err)
+				t.Fail()
+			}
+			m.SetQuestion("nx.miek.nl.", TypeANY)
+			if r, err := c.Exchange(m, addr); err != nil || r.Rcode != RcodeNameError || len(r.Answer) != 0 {
+				t.Logf("Expected NXDOMAIN for nx.miek.nl., got %v (%v)", r, err)
+				t.Fail()
+			}
+		}
+		srv.Shutdown()
+	}
+}
+
+func TestServingTruncate(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServerLarge)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	r, err := c.Exchange(m, serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to exchange: %s", err.Error())
+	}
+	if !r.Truncated || len(r.Answer) == 0 || len(r.Answer) == 50 {
+		t.Logf("Expected a truncated reply with some answers, got TC=%v and %d answers", r.Truncated, len(r.Answer))
+		t.Fail()
+	}
+	r.Compress = true // as the server packed it
+	if l := r.Len(); l > udpMsgSize {
+		t.Logf("Reply of %d bytes is larger than %d", l, udpMsgSize)
+		t.Fail()
+	}
+}
+
+func TestServingTsigReplyUnchanged(t *testing.T) {
+	secret := map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	replies := make(chan *Msg, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		m := new(Msg)
+		m.SetReply(r)
+		m.Compress = true // so Write does not copy m for that
+		m.SetTsig("axfr.", HmacSHA256, 0, 0)
+		w.Write(m)
+		replies <- m
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h, TsigSecret: secret}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	c := &Client{TsigSecret: secret}
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.SetTsig("axfr.", HmacSHA256, 300, time.Now().Unix())
+	if _, err := c.Exchange(m, serverAddr(srv)); err != nil {
+		t.Fatalf("Failed to exchange: %s", err.Error())
+	}
+	if r := <-replies; r.IsTsig() == nil || r.IsTsig().Fudge != 0 || r.IsTsig().TimeSigned != 0 {
+		t.Logf("The handler's reply should not be changed by signing, got %v", r)
+		t.Fail()
+	}
+}
+
+func TestServingTruncateTsig(t *testing.T) {
+	secret := map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		m := new(Msg)
+		m.SetReply(r)
+		for i := 0; i < 50; i++ {
+			m.Answer = append(m.Answer, &RR_A{Hdr: RR_Header{Name: m.Question[0].Name, Rrtype: TypeA, Class: ClassINET, Ttl: 0}, A: net.IPv4(127, 0, 0, byte(i))})
+		}
+		m.SetTsig("axfr.", HmacSHA512, 300, time.Now().Unix())
+		w.Write(m)
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h, TsigSecret: secret}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.SetTsig("axfr.", HmacSHA512, 300, time.Now().Unix())
+	buf, _, err := TsigGenerate(m, secret["axfr."], "", false)
+	if err != nil {
+		t.Fatalf("Failed to sign the request: %s", err.Error())
+	}
+	conn, err := net.Dial("udp", serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(buf)
+	reply := make([]byte, DefaultMsgSize)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatalf("Failed to read the reply: %s", err.Error())
+	}
+	r := new(Msg)
+	if err := r.Unpack(reply[:n]); err != nil || !r.Truncated || r.IsTsig() == nil {
+		t.Fatalf("Expected a truncated signed reply, got %v", err)
+	}
+	if n > udpMsgSize {
+		t.Logf("Signed reply of %d bytes is larger than %d", n, udpMsgSize)
+		t.Fail()
+	}
+}
+
+func TestServingCompression(t *testing.T) {
+	for _, uncompressed := range []bool{false, true} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServerLarge), Uncompressed: uncompressed}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeA)
+		m.SetEdns0(4096, false)
+		buf, _ := m.Pack()
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(buf)
+		reply := make([]byte, DefaultMsgSize)
+		n, err := conn.Read(reply)
+		conn.Close()
+		srv.Shutdown()
+		if err != nil {
+			t.Fatalf("Failed to read the reply: %s", err.Error())
+		}
+		r := new(Msg)
+		if err := r.Unpack(reply[:n]); err != nil || len(r.Answer) != 50 {
+			t.Fatalf("Expected 50 answers, got %v", err)
+		}
+		// the owner name of the first answer points back to the question
+		compressed := reply[12+13] == 0xC0
+		if compressed == uncompressed {
+			t.Logf("Expected compressed %v with Uncompressed %v, got a reply of %d bytes", !uncompressed, uncompressed, n)
+			t.Fail()
+		}
+	}
+}
+
+func TestServingMinUDPSize(t *testing.T) {
+	public := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServerLarge)}
+	go public.ListenAndServe()
+	defer public.Shutdown()
+	internal := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServerLarge), MinUDPSize: 1232}
+	go internal.ListenAndServe()
+	defer internal.Shutdown()
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	for _, srv := range []*Server{public, internal, public} {
+		// Client reads at most 512 bytes without EDNS0, read more here
+		buf, _ := m.Pack()
+		conn, err := net.Dial("udp", serverAddr(srv))
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(buf)
+		reply := make([]byte, DefaultMsgSize)
+		n, err := conn.Read(reply)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Failed to read the reply: %s", err.Error())
+		}
+		r := new(Msg)
+		if err := r.Unpack(reply[:n]); err != nil {
+			t.Fatalf("Failed to unpack the reply: %s", err.Error())
+		}
+		max := udpMsgSize
+		if srv.MinUDPSize > 0 {
+			max = srv.MinUDPSize
+		}
+		if n > max || r.Truncated != (srv == public) {
+			t.Logf("Expected a reply of at most %d bytes, truncated %v, got %d bytes, truncated %v", max, srv == public, n, r.Truncated)
+			t.Fail()
+		}
+	}
+}
+
+func TestServingMaxAnswerRRs(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: network, Handler: HandlerFunc(HelloServerLarge), MaxAnswerRRs: 20}
+		go srv.ListenAndServe()
+
+		c := &Client{Net: network}
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeA)
+		m.SetEdns0(4096, false)
+		r, err := c.Exchange(m, serverAddr(srv))
+		srv.Shutdown()
+		if err != nil {
+			t.Fatalf("Failed to exchange over %s: %s", network, err.Error())
+		}
+		// all 50 answers fit in 4096 bytes
+		if network == "udp" && (!r.Truncated || len(r.Answer) != 0 || r.IsEdns0() == nil) {
+			t.Logf("Expected a truncated reply without answers over UDP, got TC=%v and %d answers", r.Truncated, len(r.Answer))
+			t.Fail()
+		}
+		if network == "tcp" && (r.Truncated || len(r.Answer) != 50) {
+			t.Logf("Expected all 50 answers over TCP, got TC=%v and %d answers", r.Truncated, len(r.Answer))
+			t.Fail()
+		}
+	}
+}
+
+func TestServingEdns0(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServerLarge)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeA)
+	m.SetEdns0(4096, false)
+	r, err := c.Exchange(m, serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to exchange: %s", err.Error())
+	}
+	if r.Truncated || len(r.Answer) != 50 {
+		t.Logf("Expected all 50 answers untruncated, got TC=%v and %d answers", r.Truncated, len(r.Answer))
+		t.Fail()
+	}
+	opt := r.IsEdns0()
+	if opt == nil || opt.UDPSize() != DefaultMsgSize {
+		t.Logf("Expected an OPT record with size %d in the reply, got %v", DefaultMsgSize, opt)
+		t.Fail()
+	}
+}
+
+func TestServingEdns0Do(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer), UDPSize: 1232}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	c := new(Client)
+	for _, do := range []bool{true, false} {
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		m.SetEdns0(4096, do)
+		r, err := c.Exchange(m, serverAddr(srv))
+		if err != nil {
+			t.Fatalf("Failed to exchange: %s", err.Error())
+		}
+		opt := r.IsEdns0()
+		if opt == nil || opt.UDPSize() != 1232 || opt.Do() != do {
+			t.Logf("Expected an OPT record with size 1232 and DO=%v in the reply, got %v", do, opt)
+			t.Fail()
+		}
+	}
+}
+
+func TestServingTsigStream(t *testing.T) {
+	secret := "so6ZGir4GPAqINNh9U5c3A=="
+	handler := func(w ResponseWriter, r *Msg) {
+		tsig := r.IsTsig()
+		for i := 0; i < 3; i++ {
+			m := new(Msg)
+			m.SetReply(r)
+			a, _ := NewRR("miek.nl. 3600 IN A 127.0.0." + strconv.Itoa(i))
+			m.Answer = []RR{a}
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+			w.TsigTimersOnly(i > 0)
+			if err := w.Write(m); err != nil {
+				return
+			}
+		}
+	}
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(handler)}
+	srv.TsigSecret = map[string]string{"axfr.": secret}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	conn, err := net.Dial("tcp", serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	m := new(Msg)
+	m.SetAxfr("miek.nl.")
+	m.SetTsig("axfr.", HmacSHA256, 300, time.Now().Unix())
+	buf, mac, err := TsigGenerate(m, secret, "", false)
+	if err != nil {
+		t.Fatalf("Failed to sign the request: %s", err.Error())
+	}
+	a, b := packUint16(uint16(len(buf)))
+	conn.Write(append([]byte{a, b}, buf...))
+
+	for i := 0; i < 3; i++ {
+		buf, err := readTCP(conn)
+		if err != nil {
+			t.Fatalf("Failed to read message %d: %s", i, err.Error())
+		}
+		r := new(Msg)
+		if err := r.Unpack(buf); err != nil {
+			t.Fatalf("Failed to unpack message %d: %s", i, err.Error())
+		}
+		if r.IsTsig() == nil {
+			t.Fatalf("Message %d is not signed", i)
+		}
+		// each message is signed over the MAC of the one before it
+		if err := TsigVerify(buf, secret, mac, i > 0); err != nil {
+			t.Fatalf("Message %d does not verify: %s", i, err.Error())
+		}
+		mac = r.IsTsig().MAC
+	}
+}
+
+func TestServerTsigStatus(t *testing.T) {
+	status := make(chan error, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		status <- w.TsigStatus()
+		HelloServer(w, r)
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: h}
+	srv.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	tests := []struct {
+		key, secret string
+		skew        int64
+		err         error
+	}{
+		{"axfr.", "so6ZGir4GPAqINNh9U5c3A==", 0, nil},
+		{"other.", "so6ZGir4GPAqINNh9U5c3A==", 0, ErrKeyName},
+		{"axfr.", "c28gc2VjcmV0", 0, ErrSig},
+		{"axfr.", "so6ZGir4GPAqINNh9U5c3A==", 3600, ErrTime},
+	}
+	for _, tc := range tests {
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		m.SetTsig(tc.key, HmacSHA256, 300, time.Now().Unix()+tc.skew)
+		buf, _, err := TsigGenerate(m, tc.secret, "", false)
+		if err != nil {
+			t.Fatalf("Failed to generate TSIG: %s", err.Error())
+		}
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		conn.Write(buf)
+		if err := <-status; err != tc.err {
+			t.Logf("Key %s with secret %s: expected TsigStatus %v, got %v", tc.key, tc.secret, tc.err, err)
+			t.Fail()
+		}
+		conn.Close()
+	}
+}
+
+func TestServingTsigPerRequest(t *testing.T) {
+	secret := "so6ZGir4GPAqINNh9U5c3A=="
+	status := make(chan error, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		status <- w.TsigStatus()
+		m := new(Msg)
+		m.SetReply(r)
+		if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+			m.SetTsig(t.Hdr.Name, t.Algorithm, int64(t.Fudge), time.Now().Unix())
+		}
+		w.Write(m)
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h, TsigSecret: map[string]string{"axfr.": secret}}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	conn, err := net.Dial("tcp", serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	// Independent queries on one connection: each is verified on its own
+	// and each signed reply covers the MAC of its own request only.
+	for i, s := range []string{secret, "c28gc2VjcmV0", "", secret} {
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		buf, _ := m.Pack()
+		mac := ""
+		if s != "" {
+			m.SetTsig("axfr.", HmacSHA256, 300, time.Now().Unix())
+			if buf, mac, err = TsigGenerate(m, s, "", false); err != nil {
+				t.Fatalf("Failed to sign query %d: %s", i, err.Error())
+			}
+		}
+		a, b := packUint16(uint16(len(buf)))
+		conn.Write(append([]byte{a, b}, buf...))
+		if err := <-status; (err == nil) != (s != "c28gc2VjcmV0") {
+			t.Logf("Query %d: unexpected TsigStatus %v", i, err)
+			t.Fail()
+		}
+		buf, err := readTCP(conn)
+		if err != nil {
+			t.Fatalf("Failed to read reply %d: %s", i, err.Error())
+		}
+		r := new(Msg)
+		if err := r.Unpack(buf); err != nil {
+			t.Fatalf("Failed to unpack reply %d: %s", i, err.Error())
+		}
+		if signed := r.IsTsig() != nil; signed != (s == secret) {
+			t.Fatalf("Reply %d: signed is %v", i, signed)
+		}
+		if s == secret {
+			if err := TsigVerify(buf, secret, mac, false); err != nil {
+				t.Logf("Reply %d does not verify against its own request: %s", i, err.Error())
+				t.Fail()
+			}
+		}
+	}
+}
+
+// shortPacketConn is a net.PacketConn that writes at most max bytes.
+type shortPacketConn struct {
+	net.PacketConn
+	max int
+}
+
+func (c *shortPacketConn) WriteTo(b []byte, a net.Addr) (int, error) {
+	if len(b) > c.max {
+		return c.max, nil
+	}
+	return len(b), nil
+}
+
+func TestWriteBufShortUDP(t *testing.T) {
+	w := &response{_UDP: &shortPacketConn{max: 100}, remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53000}}
+	if err := w.WriteBuf(make([]byte, 100)); err != nil {
+		t.Fatalf("Failed to write: %s", err.Error())
+	}
+	w.written = false
+	if err := w.WriteBuf(make([]byte, 101)); err != io.ErrShortWrite {
+		t.Logf("Expected io.ErrShortWrite for a partial datagram, got %v", err)
+		t.Fail()
+	}
+	if w.written {
+		t.Log("A partial datagram should not count as written")
+		t.Fail()
+	}
+}
+
+// lastMsg returns the last message written to w, nil if there is none.
+func lastMsg(w *RecordingResponseWriter) *Msg {
+	if len(w.Msgs) == 0 {
+		return nil
+	}
+	return w.Msgs[len(w.Msgs)-1]
+}
+
+func TestServeMuxConcurrent(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl.", HelloServer)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			zone := strconv.Itoa(i) + ".miek.nl."
+			mux.HandleFunc(zone, AnotherHelloServer)
+			mux.HandleRemove(zone)
+		}
+		close(done)
+	}()
+	m := new(Msg)
+	m.SetQuestion("10.miek.nl.", TypeTXT)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			mux.ServeDNS(new(RecordingResponseWriter), m)
+		}
+	}
+}
+
+func TestServeMuxWildcard(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("*.example.com.", HelloServer)
+	mux.HandleFunc("www.example.com.", AnotherHelloServer)
+	mux.HandleFunc("example.org.", AnotherHelloServer)
+	mux.HandleFunc("*.sub.example.org.", HelloServer)
+
+	tests := []struct {
+		name     string
+		wildcard bool
+	}{
+		{"www.example.com.", false}, // direct match wins
+		{"foo.example.com.", true},
+		{"a.b.example.com.", true},    // multiple levels deep
+		{"a.www.example.com.", false}, // closer match than the wildcard
+		{"x.sub.example.org.", true},
+		{"sub.example.org.", false},   // wildcards only match below
+		{"other.example.org.", false}, // sibling of the wildcard's parent
+	}
+	for _, tc := range tests {
+		h := mux.match(tc.name, TypeA)
+		if h == nil {
+			t.Logf("%s: no handler found", tc.name)
+			t.Fail()
+			continue
+		}
+		w := new(RecordingResponseWriter)
+		m := new(Msg)
+		m.SetQuestion(tc.name, TypeA)
+		h.ServeDNS(w, m)
+		txt := lastMsg(w).Extra[0].(*RR_TXT).Txt[0]
+		if (txt == "Hello world") != tc.wildcard {
+			t.Logf("%s: wildcard match should be %v, got %s", tc.name, tc.wildcard, txt)
+			t.Fail()
+		}
+	}
+	if h := mux.match("example.net.", TypeA); h != nil {
+		t.Log("example.net. should not match")
+		t.Fail()
+	}
+
+	// DS queries still go to the parent
+	mux.HandleFunc("com.", HelloServer)
+	mux.HandleFunc("example.com.", AnotherHelloServer)
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("example.com.", TypeDS)
+	mux.match("example.com.", TypeDS).ServeDNS(w, m)
+	if lastMsg(w).Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+		t.Log("DS query should be handled by the parent")
+		t.Fail()
+	}
+}
+
+func TestServeMuxRoot(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc(".", HelloServer)
+	for _, name := range []string{".", "com.", "example.com.", "www.example.org."} {
+		if e := mux.matchClass(name, ClassINET, TypeA); e == nil || e.pattern != "." {
+			t.Logf("%s should match the root, got %v", name, e)
+			t.Fail()
+		}
+	}
+
+	mux.HandleFunc("example.com.", AnotherHelloServer)
+	mux.HandleFunc("ex.com.", AnotherHelloServer)
+	tests := []struct {
+		name    string
+		qtype   uint16
+		pattern string
+	}{
+		{"example.com.", TypeA, "example.com."},
+		{"www.example.com.", TypeA, "example.com."},
+		{"EXAMPLE.com.", TypeA, "example.com."},
+		{"com.", TypeA, "."},
+		{"example.org.", TypeA, "."},
+		{"xexample.com.", TypeA, "."},
+		{"ample.com.", TypeA, "."},
+		// the DS records of example.com. are in the parent, the root here, not ex.com.
+		{"example.com.", TypeDS, "."},
+		{".", TypeDS, "."},
+	}
+	for _, tc := range tests {
+		if e := mux.matchClass(tc.name, ClassINET, tc.qtype); e == nil || e.pattern != tc.pattern {
+			t.Logf("%s %s should match %s, got %v", tc.name, Rr_str[tc.qtype], tc.pattern, e)
+			t.Fail()
+		}
+	}
+}
+
+func TestServeMuxClass(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleClass("authors.bind.", ClassCHAOS, HandlerFunc(HandleAuthors))
+	mux.HandleFunc("bind.", AnotherHelloServer)
+
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("authors.bind.", TypeTXT)
+	m.Question[0].Qclass = ClassCHAOS
+	mux.ServeDNS(w, m)
+	if len(lastMsg(w).Answer) != len(Authors) {
+		t.Logf("CHAOS query should be answered by HandleAuthors, got %v", lastMsg(w))
+		t.Fail()
+	}
+
+	m.Question[0].Qclass = ClassINET
+	mux.ServeDNS(w, m)
+	if len(lastMsg(w).Extra) != 1 || lastMsg(w).Extra[0].(*RR_TXT).Txt[0] != "Hello example" {
+		t.Logf("IN query should fall back to the class agnostic handler, got %v", lastMsg(w))
+		t.Fail()
+	}
+
+	mux.HandleRemoveClass("authors.bind.", ClassCHAOS)
+	m.Question[0].Qclass = ClassCHAOS
+	mux.ServeDNS(w, m)
+	if len(lastMsg(w).Extra) != 1 || lastMsg(w).Extra[0].(*RR_TXT).Txt[0] != "Hello example" {
+		t.Logf("CHAOS query should fall back after removal, got %v", lastMsg(w))
+		t.Fail()
+	}
+}
+
+func TestServeMuxOpcode(t *testing.T) {
+	var got string
+	handler := func(name string) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Msg) { got = name })
+	}
+	mux := NewServeMux()
+	mux.Handle("miek.nl.", handler("query"))
+	mux.HandleOpcode("miek.nl.", OpcodeUpdate, handler("update"))
+	mux.HandleOpcode("miek.nl.", OpcodeNotify, handler("notify"))
+
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeSOA)
+	mux.ServeDNS(w, m)
+	if got != "query" {
+		t.Logf("QUERY should go to the query handler, got %s", got)
+		t.Fail()
+	}
+	m = new(Msg)
+	m.SetUpdate("miek.nl.")
+	mux.ServeDNS(w, m)
+	if got != "update" {
+		t.Logf("UPDATE should go to the update handler, got %s", got)
+		t.Fail()
+	}
+	m = new(Msg)
+	m.SetNotify("miek.nl.")
+	mux.ServeDNS(w, m)
+	if got != "notify" {
+		t.Logf("NOTIFY should go to the notify handler, got %s", got)
+		t.Fail()
+	}
+
+	mux.HandleRemoveOpcode("miek.nl.", OpcodeNotify)
+	mux.ServeDNS(w, m)
+	if got != "query" {
+		t.Logf("NOTIFY should fall back to the query handler after removal, got %s", got)
+		t.Fail()
+	}
+}
+
+func TestServeMuxNotImplemented(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc(".", HelloServer)
+	for _, op := range []int{15, OpcodeStatus, 3} {
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeSOA)
+		m.Opcode = op
+		w := new(RecordingResponseWriter)
+		mux.ServeDNS(w, m)
+		if lastMsg(w) == nil || lastMsg(w).Rcode != RcodeNotImplemented || lastMsg(w).Opcode != op {
+			t.Logf("Expected NOTIMP with opcode %d, got %v", op, lastMsg(w))
+			t.Fail()
+		}
+	}
+
+	// Unless there is a handler for the opcode.
+	mux.HandleOpcode(".", OpcodeStatus, HandlerFunc(HelloServer))
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeSOA)
+	m.Opcode = OpcodeStatus
+	w := new(RecordingResponseWriter)
+	mux.ServeDNS(w, m)
+	if lastMsg(w) == nil || lastMsg(w).Rcode != RcodeSuccess {
+		t.Logf("Expected the STATUS handler to answer, got %v", lastMsg(w))
+		t.Fail()
+	}
+}
+
+func TestChaosHandlers(t *testing.T) {
+	tests := []struct {
+		h      HandlerFunc
+		name   string
+		class  uint16
+		qtype  uint16
+		answer int
+	}{
+		{HandleAuthors, "authors.bind.", ClassCHAOS, TypeTXT, len(Authors)},
+		{HandleAuthors, "authors.server.", ClassCHAOS, TypeTXT, len(Authors)},
+		{HandleAuthors, "authors.bind.", ClassINET, TypeTXT, 0},
+		{HandleAuthors, "authors.bind.", ClassCHAOS, TypeA, 0},
+		{HandleVersion, "version.bind.", ClassCHAOS, TypeTXT, 1},
+		{HandleVersion, "version.bind.", ClassINET, TypeTXT, 0},
+		{HandleVersion, "version.server.", ClassCHAOS, TypeA, 0},
+	}
+	for _, tc := range tests {
+		w := new(RecordingResponseWriter)
+		m := new(Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		m.Question[0].Qclass = tc.class
+		tc.h(w, m)
+		if len(lastMsg(w).Answer) != tc.answer {
+			t.Logf("%s %s %s: expected %d answers, got %v", tc.name, Class_str[tc.class], Rr_str[tc.qtype], tc.answer, lastMsg(w))
+			t.Fail()
+			continue
+		}
+		if tc.answer == 0 && lastMsg(w).Rcode != RcodeServerFailure {
+			t.Logf("%s %s %s: expected SERVFAIL, got %s", tc.name, Class_str[tc.class], Rr_str[tc.qtype], Rcode_str[lastMsg(w).Rcode])
+			t.Fail()
+		}
+		for _, rr := range lastMsg(w).Answer {
+			if rr.Header().Class != ClassCHAOS || rr.Header().Rrtype != TypeTXT {
+				t.Logf("Answer should be CHAOS TXT, got %s", rr.String())
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestChaosTXTHandler(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("id.server.", ChaosTXTHandler("id.server", []string{"ns1", "anycast"}))
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("id.server.", TypeTXT)
+	m.Question[0].Qclass = ClassCHAOS
+	mux.ServeDNS(w, m)
+	if len(lastMsg(w).Answer) != 2 || lastMsg(w).Answer[1].(*RR_TXT).Txt[0] != "anycast" {
+		t.Logf("Expected two TXT records, got %v", lastMsg(w))
+		t.Fail()
+	}
+	m.SetQuestion("www.id.server.", TypeTXT)
+	m.Question[0].Qclass = ClassCHAOS
+	mux.ServeDNS(w, m)
+	if lastMsg(w).Rcode != RcodeServerFailure {
+		t.Logf("Other names should get SERVFAIL, got %v", lastMsg(w))
+		t.Fail()
+	}
+}
+
+func TestChaosTTL(t *testing.T) {
+	defer func(ttl uint32) { ChaosTTL = ttl }(ChaosTTL)
+	m := new(Msg)
+	m.SetQuestion("version.bind.", TypeTXT)
+	m.Question[0].Qclass = ClassCHAOS
+	for _, ttl := range []uint32{0, 30} {
+		ChaosTTL = ttl
+		w := new(RecordingResponseWriter)
+		HandleVersion(w, m)
+		if len(lastMsg(w).Answer) != 1 {
+			t.Fatalf("Expected one answer, got %v", lastMsg(w))
+		}
+		if h := lastMsg(w).Answer[0].Header(); h.Ttl != ttl || h.Class != ClassCHAOS {
+			t.Logf("Expected a CHAOS answer with TTL %d, got %v", ttl, lastMsg(w).Answer[0])
+			t.Fail()
+		}
+	}
+}
+
+func TestServeMuxHandlers(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl", HelloServer)
+	mux.HandleFunc("example.com.", HelloServer)
+	mux.HandleFunc("example.org.", HelloServer)
+	mux.HandleRemove("example.com.")
+
+	h := mux.Handlers()
+	if len(h) != 2 || h[0] != "example.org." || h[1] != "miek.nl." {
+		t.Logf("Expected [example.org. miek.nl.], got %v", h)
+		t.Fail()
+	}
+}
+
+func TestServeMuxWalk(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl", HelloServer)
+	mux.HandleFunc("example.org.", HelloServer)
+	mux.HandleClass("version.bind.", ClassCHAOS, HandlerFunc(HandleVersion))
+	mux.HandleOpcode("example.com.", OpcodeNotify, HandlerFunc(HelloServer))
+
+	seen := make(map[string]int)
+	mux.Walk(func(pattern string, h Handler) {
+		if h == nil {
+			t.Logf("No handler for %s", pattern)
+			t.Fail()
+		}
+		seen[pattern]++
+	})
+	if len(seen) != 4 {
+		t.Logf("Expected 4 patterns, got %v", seen)
+		t.Fail()
+	}
+	for _, p := range []string{"miek.nl.", "example.org.", "version.bind.", "example.com."} {
+		if seen[p] != 1 {
+			t.Logf("Expected %s to be visited once, got %d", p, seen[p])
+			t.Fail()
+		}
+	}
+}
+
+func TestServeMuxCase(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("Example.COM.", HelloServer)
+	mux.HandleFunc("\xc3\x84.miek.nl.", HelloServer) // Ä, only ASCII is case insensitive
+	for _, name := range []string{"example.com.", "EXAMPLE.com.", "www.eXample.Com."} {
+		m := new(Msg)
+		m.SetQuestion(name, TypeTXT)
+		w := new(RecordingResponseWriter)
+		mux.ServeDNS(w, m)
+		if lastMsg(w) == nil || lastMsg(w).Rcode != RcodeSuccess {
+			t.Logf("Expected %s to match Example.COM., got %v", name, lastMsg(w))
+			t.Fail()
+		}
+	}
+	if mux.match("\xc3\xa4.miek.nl.", TypeA) != nil {
+		t.Log("Expected \xc3\xa4.miek.nl. not to match \xc3\x84.miek.nl.")
+		t.Fail()
+	}
+	mux.HandleRemove("example.com.")
+	if mux.match("example.com.", TypeA) != nil {
+		t.Log("Expected example.com. to be removed")
+		t.Fail()
+	}
+}
+
+func TestServingQuestionCase(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("example.com.", HelloServer)
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: mux}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	// A resolver using 0x20 randomizes the case, the reply must echo it.
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("ExAmPlE.CoM.", TypeTXT)
+	r, err := c.Exchange(m, serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to exchange: %s", err.Error())
+	}
+	if r.Rcode != RcodeSuccess || len(r.Question) != 1 || r.Question[0].Name != "ExAmPlE.CoM." {
+		t.Logf("Expected a reply for ExAmPlE.CoM., got rcode %d and question %v", r.Rcode, r.Question)
+		t.Fail()
+	}
+}
+
+func TestServeMuxDefaultHandler(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl.", HelloServer)
+
+	w := new(RecordingResponseWriter)
+	m := new(Msg)
+	m.SetQuestion("example.com.", TypeTXT)
+	mux.ServeDNS(w, m)
+	if lastMsg(w).Rcode != RcodeServerFailure {
+		t.Logf("Unmatched zone should get SERVFAIL without a default handler, got %s", Rcode_str[lastMsg(w).Rcode])
+		t.Fail()
+	}
+
+	mux.SetDefaultHandler(HandlerFunc(func(w ResponseWriter, r *Msg) {
+		m := new(Msg)
+		m.SetRcode(r, RcodeRefused)
+		w.Write(m)
+	}))
+	mux.ServeDNS(w, m)
+	if lastMsg(w).Rcode != RcodeRefused {
+		t.Logf("Unmatched zone should be handled by the default handler, got %s", Rcode_str[lastMsg(w).Rcode])
+		t.Fail()
+	}
+	m.SetQuestion("www.miek.nl.", TypeTXT)
+	mux.ServeDNS(w, m)
+	if lastMsg(w).Rcode != RcodeSuccess {
+		t.Logf("Matched zone should not use the default handler, got %s", Rcode_str[lastMsg(w).Rcode])
+		t.Fail()
+	}
+}
+
+func TestNewResponseWriter(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	w := NewResponseWriter(server, nil)
+	if w.RemoteAddr() != server.RemoteAddr() {
+		t.Logf("Expected remote address %s, got %s", server.RemoteAddr(), w.RemoteAddr())
+		t.Fail()
+	}
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	go func() {
+		HelloServer(w, m)
+		w.Close()
+	}()
+
+	buf, err := readTCP(client)
+	if err != nil {
+		t.Fatalf("Failed to read the reply: %s", err.Error())
+	}
+	r := new(Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatalf("Failed to unpack the reply: %s", err.Error())
+	}
+	if r.Id != m.Id || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+		t.Logf("Unexpected reply %s", r.String())
+		t.Fail()
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Logf("Expected the connection to be closed, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestNewPacketResponseWriter(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer client.Close()
+	w := NewPacketResponseWriter(server, client.LocalAddr())
+	defer w.Close()
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	HelloServer(w, m)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, DefaultMsgSize)
+	n, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to read the reply: %s", err.Error())
+	}
+	if from.String() != server.LocalAddr().String() {
+		t.Logf("Reply from %s, expected %s", from, server.LocalAddr())
+		t.Fail()
+	}
+	r := new(Msg)
+	if err := r.Unpack(buf[:n]); err != nil || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+		t.Logf("Unexpected reply: %v", err)
+		t.Fail()
+	}
+}
+
+// throttledConn accepts at most n bytes per Write.
+type throttledConn struct {
+	net.Conn
+	n     int
+	buf   bytes.Buffer
+	calls int
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	c.calls++
+	if len(b) > c.n {
+		b = b[:c.n]
+	}
+	return c.buf.Write(b)
+}
+
+func TestWriteBufShortWrites(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		c := &throttledConn{n: n}
+		w := NewResponseWriter(c, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+		m := new(Msg)
+		m.SetQuestion("miek.nl.", TypeTXT)
+		HelloServer(w, m)
+
+		buf, err := readTCP(&c.buf)
+		if err != nil {
+			t.Fatalf("Failed to read the framed reply written %d bytes at a time: %s", n, err.Error())
+		}
+		if c.buf.Len() != 0 {
+			t.Logf("%d bytes left after the reply", c.buf.Len())
+			t.Fail()
+		}
+		r := new(Msg)
+		if err := r.Unpack(buf); err != nil || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+			t.Logf("Unexpected reply written %d bytes at a time: %v", n, err)
+			t.Fail()
+		}
+		if c.calls < (len(buf)+2)/n {
+			t.Logf("Only %d writes for %d bytes", c.calls, len(buf)+2)
+			t.Fail()
+		}
+	}
+}
+
+func TestServingLargeTCP(t *testing.T) {
+	errs := make(chan error, 1)
+	handler := func(w ResponseWriter, req *Msg) {
+		m := new(Msg)
+		m.SetReply(req)
+		// 2848 uncompressed A records, plus header and question, is 65529 bytes
+		for i := 0; i < 2848; i++ {
+			m.Answer = append(m.Answer, &RR_A{Hdr: RR_Header{Name: "miek.nl.", Rrtype: TypeA, Class: ClassINET, Ttl: 0}, A: net.IPv4(127, 0, byte(i>>8), byte(i))})
+		}
+		errs <- w.Write(m)
+	}
+	for _, max := range []int{0, 65535, 100000, 1024} {
+		srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: HandlerFunc(handler), MaxMsgSize: max, Uncompressed: true}
+		go srv.ListenAndServe()
+		addr := serverAddr(srv)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err.Error())
+		}
+		timeout := 2 * time.Second
+		if max == 1024 {
+			// nothing is sent back, don't wait too long
+			timeout = 200 * time.Millisecond
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		r, err := tcpQuery(conn)
+		werr := <-errs
+		if max == 1024 {
+			if werr == nil || err == nil {
+				t.Logf("Expected the write of a 65529 byte reply to fail with MaxMsgSize %d", max)
+				t.Fail()
+			}
+		} else if werr != nil || err != nil || len(r.Answer) != 2848 {
+			t.Logf("Failed to get a 65529 byte reply with MaxMsgSize %d: %v, %v", max, werr, err)
+			t.Fail()
+		}
+		conn.Close()
+		srv.Shutdown()
+	}
+}
+
+func TestServeMuxQuestionCount(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl.", HelloServer)
+	q := Question{"miek.nl.", TypeTXT, ClassINET}
+	tests := []struct {
+		question []Question
+		rcode    int
+	}{
+		{nil, RcodeFormatError},
+		{[]Question{q}, RcodeSuccess},
+		{[]Question{q, q}, RcodeNotImplemented},
+	}
+	for _, tc := range tests {
+		m := new(Msg)
+		m.Id = Id()
+		m.Question = tc.question
+		w := new(RecordingResponseWriter)
+		mux.ServeDNS(w, m)
+		if lastMsg(w) == nil || lastMsg(w).Rcode != tc.rcode {
+			t.Logf("Expected rcode %d for %d questions, got %v", tc.rcode, len(tc.question), lastMsg(w))
+			t.Fail()
+		}
+	}
+
+	mux.SetQuestionRcodes(RcodeRefused, RcodeFormatError)
+	m := new(Msg)
+	w := new(RecordingResponseWriter)
+	mux.ServeDNS(w, m)
+	if lastMsg(w).Rcode != RcodeRefused {
+		t.Logf("Expected REFUSED for no question, got %d", lastMsg(w).Rcode)
+		t.Fail()
+	}
+	m.Question = []Question{q, q}
+	mux.ServeDNS(w, m)
+	if lastMsg(w).Rcode != RcodeFormatError {
+		t.Logf("Expected FORMERR for two questions, got %d", lastMsg(w).Rcode)
+		t.Fail()
+	}
+}
+
+func TestServeMuxNoRecursion(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("miek.nl.", func(w ResponseWriter, r *Msg) {
+		m := new(Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		w.Write(m)
+	})
+	miss := new(Msg)
+	miss.SetQuestion("example.org.", TypeA)
+	w := new(RecordingResponseWriter)
+	mux.ServeDNS(w, miss)
+	if lastMsg(w).Rcode != RcodeServerFailure {
+		t.Logf("Expected SERVFAIL for a miss by default, got %d", lastMsg(w).Rcode)
+		t.Fail()
+	}
+
+	mux.SetNoRecursion(true)
+	mux.ServeDNS(w, miss)
+	if lastMsg(w).Rcode != RcodeRefused || lastMsg(w).RecursionAvailable {
+		t.Logf("Expected REFUSED without RA for a recursive miss, got rcode %d and RA=%v", lastMsg(w).Rcode, lastMsg(w).RecursionAvailable)
+		t.Fail()
+	}
+	miss.RecursionDesired = false
+	mux.ServeDNS(w, miss)
+	if lastMsg(w).Rcode != RcodeServerFailure {
+		t.Logf("Expected SERVFAIL for a non recursive miss, got %d", lastMsg(w).Rcode)
+		t.Fail()
+	}
+	hit := new(Msg)
+	hit.SetQuestion("miek.nl.", TypeA)
+	mux.ServeDNS(w, hit)
+	if lastMsg(w).Rcode != RcodeSuccess || lastMsg(w).RecursionAvailable {
+		t.Logf("Expected the handler's reply without RA, got rcode %d and RA=%v", lastMsg(w).Rcode, lastMsg(w).RecursionAvailable)
+		t.Fail()
+	}
+}
+
+func TestServeMuxNoRecursionCopies(t *testing.T) {
+	secret := map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	reply := new(Msg)
+	reply.SetQuestion("miek.nl.", TypeA)
+	reply.Response = true
+	reply.RecursionAvailable = true
+	buf, _ := reply.Pack()
+	signed := *reply
+	signed.SetTsig("axfr.", HmacMD5, 300, time.Now().Unix())
+	signedBuf, _, err := TsigGenerate(&signed, secret["axfr."], "", false)
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err.Error())
+	}
+	mux := NewServeMux()
+	mux.SetNoRecursion(true)
+	mux.HandleFunc("miek.nl.", func(w ResponseWriter, r *Msg) {
+		w.Write(reply)
+		w.WriteBuf(buf)
+		w.WriteBuf(signedBuf)
+	})
+	w := new(RecordingResponseWriter)
+	req := new(Msg)
+	req.SetQuestion("miek.nl.", TypeA)
+	mux.ServeDNS(w, req)
+
+	if !reply.RecursionAvailable || buf[3]&_RA == 0 {
+		t.Log("The handler's reply should not be changed")
+		t.Fail()
+	}
+	if len(w.Msgs) != 1 || w.Msgs[0].RecursionAvailable {
+		t.Logf("Expected the reply without RA, got %v", w.Msgs)
+		t.Fail()
+	}
+	if len(w.Bufs) != 2 || w.Bufs[0][3]&_RA != 0 {
+		t.Log("Expected the buffer without RA")
+		t.Fail()
+	}
+	if len(w.Bufs) == 2 && !bytes.Equal(w.Bufs[1], signedBuf) {
+		t.Log("A signed buffer should be passed through unchanged")
+		t.Fail()
+	}
+}
+
+// contextHandler calls f from ServeDNSContext.
+type contextHandler func(ctx context.Context, w ResponseWriter, r *Msg)
+
+func (h contextHandler) ServeDNS(w ResponseWriter, r *Msg) { h(context.Background(), w, r) }
+func (h contextHandler) ServeDNSContext(ctx context.Context, w ResponseWriter, r *Msg) {
+	h(ctx, w, r)
+}
+
+func TestMatchedPattern(t *testing.T) {
+	var pattern string
+	h := contextHandler(func(ctx context.Context, w ResponseWriter, r *Msg) {
+		pattern = MatchedPattern(ctx)
+		HelloServer(w, r)
+	})
+	mux := NewServeMux()
+	mux.Handle("example.com", h)
+	mux.Handle("*.example.org.", h)
+	mux.SetDefaultHandler(h)
+	tests := map[string]string{
+		"x.example.com.":   "example.com.",
+		"example.com.":     "example.com.",
+		"a.b.example.org.": "*.example.org.",
+		"example.net.":     "",
+	}
+	for name, want := range tests {
+		pattern = "none"
+		m := new(Msg)
+		m.SetQuestion(name, TypeA)
+		mux.ServeDNS(new(RecordingResponseWriter), m)
+		if pattern != want {
+			t.Logf("Expected pattern %q for %s, got %q", want, name, pattern)
+			t.Fail()
+		}
+	}
+}
+
+func TestServingBadVers(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	m.SetEdns0(4096, false)
+	m.SetEdns0Version(1)
+	m.IsEdns0().Option = []EDNS0{&EDNS0_NSID{Code: EDNS0NSID}}
+	r, err := new(Client).Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Exchange failed: %s", err.Error())
+	}
+	if r.Rcode != RcodeBadVers || len(r.Answer)+len(r.Extra) != 1 {
+		t.Logf("Expected BADVERS and only an OPT RR, got %s", r.String())
+		t.Fail()
+	}
+	if opt := r.IsEdns0(); opt == nil || opt.Version() != 0 || len(opt.Option) != 0 {
+		t.Logf("Expected an empty version 0 OPT RR, got %v", opt)
+		t.Fail()
+	}
+
+	m.SetEdns0Version(0)
+	if r, err := new(Client).Exchange(m, addr); err != nil || r.Rcode != RcodeSuccess {
+		t.Logf("Expected EDNS version 0 to be answered: %v", err)
+		t.Fail()
+	}
+}
@@ -1,7 +1,7 @@
 // TRANSACTION SIGNATURE (TSIG)
 // 
 // An TSIG or transaction signature adds a HMAC TSIG record to each message sent. 
-// The supported algorithms include: HmacMD5, HmacSHA1 and HmacSHA256.
+// The supported algorithms include: HmacMD5, HmacSHA1, HmacSHA256 and HmacSHA512.
 //
 // Basic use pattern when querying with a TSIG name "axfr." (note that these key names
 // must be fully qualified) and the base64 secret "so6ZGir4GPAqINNh9U5c3A==":
@@ -57,7 +57,9 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
 	"hash"
 	"io"
 	"strconv"
@@ -70,8 +72,13 @@ const (
 	HmacMD5    = "hmac-md5.sig-alg.reg.int."
 	HmacSHA1   = "hmac-sha1."
 	HmacSHA256 = "hmac-sha256."
+	HmacSHA512 = "hmac-sha512."
 )
 
+// TsigDefaultFudge is the fudge used when none is given: the number of
+// seconds the time signed may differ from the current time.
+const TsigDefaultFudge = 300
+
 type RR_TSIG struct {
 	Hdr        RR_Header
 	Algorithm  string `dns:"domain-name"`
@@ -172,16 +179,9 @@ func TsigGenerate(m *Msg, secret, requestMAC string, timersOnly bool) ([]byte, s
 	buf := tsigBuffer(mbuf, rr, requestMAC, timersOnly)
 
 	t := new(RR_TSIG)
-	var h hash.Hash
-	switch rr.Algorithm {
-	case HmacMD5:
-		h = hmac.New(md5.New, []byte(rawsecret))
-	case HmacSHA1:
-		h = hmac.New(sha1.New, []byte(rawsecret))
-	case HmacSHA256:
-		h = hmac.New(sha256.New, []byte(rawsecret))
-	default:
-		return nil, "", ErrKeyAlg
+	h, err := tsigHash(rr.Algorithm, rawsecret)
+	if err != nil {
+		return nil, "", err
 	}
 	io.WriteString(h, string(buf))
 	t.MAC = hex.EncodeToString(h.Sum(nil))
@@ -192,6 +192,9 @@ func TsigGenerate(m *Msg, secret, requestMAC string, timersOnly bool) ([]byte, s
 	t.TimeSigned = rr.TimeSigned
 	t.Algorithm = rr.Algorithm
 	t.OrigId = m.Id
+	t.Error = rr.Error // these three are in the MAC as well
+	t.OtherLen = rr.OtherLen
+	t.OtherData = rr.OtherData
 
 	tbuf := make([]byte, t.Len())
 	if off, err := PackRR(t, tbuf, 0, nil, false); err == nil {
@@ -208,6 +211,14 @@ func TsigGenerate(m *Msg, secret, requestMAC string, timersOnly bool) ([]byte, s
 // If the signature does not validate err contains the
 // error, otherwise it is nil.
 func TsigVerify(msg []byte, secret, requestMAC string, timersOnly bool) error {
+	return TsigVerifyFudge(msg, secret, requestMAC, timersOnly, 0)
+}
+
+// TsigVerifyFudge works like TsigVerify, but the time signed must be
+// within fudge seconds of the current time, instead of within the fudge
+// in the TSIG record. If fudge is 0 the record's fudge is used. ErrTime
+// is returned when the time is outside the window.
+func TsigVerifyFudge(msg []byte, secret, requestMAC string, timersOnly bool, fudge uint16) error {
 	rawsecret, err := packBase64([]byte(secret))
 	if err != nil {
 		return err
@@ -220,21 +231,21 @@ func TsigVerify(msg []byte, secret, requestMAC string, timersOnly bool) error {
 
 	buf := tsigBuffer(stripped, tsig, requestMAC, timersOnly)
 
-	ti := uint64(time.Now().Unix()) - tsig.TimeSigned
-	if uint64(tsig.Fudge) < ti {
+	if fudge == 0 {
+		fudge = tsig.Fudge
+	}
+	now := uint64(time.Now().Unix())
+	ti := now - tsig.TimeSigned
+	if now < tsig.TimeSigned {
+		ti = tsig.TimeSigned - now
+	}
+	if uint64(fudge) < ti {
 		return ErrTime
 	}
 
-	var h hash.Hash
-	switch tsig.Algorithm {
-	case HmacMD5:
-		h = hmac.New(md5.New, []byte(rawsecret))
-	case HmacSHA1:
-		h = hmac.New(sha1.New, []byte(rawsecret))
-	case HmacSHA256:
-		h = hmac.New(sha256.New, []byte(rawsecret))
-	default:
-		return ErrKeyAlg
+	h, err := tsigHash(tsig.Algorithm, rawsecret)
+	if err != nil {
+		return err
 	}
 	io.WriteString(h, string(buf))
 	if strings.ToUpper(hex.EncodeToString(h.Sum(nil))) != strings.ToUpper(tsig.MAC) {
@@ -243,6 +254,76 @@ func TsigVerify(msg []byte, secret, requestMAC string, timersOnly bool) error {
 	return nil
 }
 
+// setTsig adds a TSIG record for the key name to m, an empty algorithm
+// means HmacSHA256 and a zero fudge TsigDefaultFudge.
+func setTsig(m *Msg, name, algorithm string, fudge uint16) {
+	if algorithm == "" {
+		algorithm = HmacSHA256
+	}
+	if fudge == 0 {
+		fudge = TsigDefaultFudge
+	}
+	m.SetTsig(Fqdn(name), algorithm, int64(fudge), time.Now().Unix())
+}
+
+// tsigHash returns the HMAC for the algorithm name, keyed with the
+// (decoded) secret. Algorithm names are compared case insensitive.
+func tsigHash(algorithm string, secret []byte) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case HmacMD5:
+		return hmac.New(md5.New, secret), nil
+	case HmacSHA1:
+		return hmac.New(sha1.New, secret), nil
+	case HmacSHA256:
+		return hmac.New(sha256.New, secret), nil
+	case HmacSHA512:
+		return hmac.New(sha512.New, secret), nil
+	}
+	return nil, ErrKeyAlg
+}
+
+// setReplyTsig adds a TSIG record to m, the reply to r, when r is signed,
+// as RFC 8945 section 5.3 has it. When r verified, see w.TsigStatus, the
+// reply is signed with the same key. When it did not, the record carries
+// the error: BADSIG or BADKEY without a MAC, or BADTIME, signed, with the
+// time of the server as other data.
+func setReplyTsig(w ResponseWriter, m, r *Msg) {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return
+	}
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, int64(tsig.Fudge), time.Now().Unix())
+	t := m.Extra[len(m.Extra)-1].(*RR_TSIG)
+	switch err := w.TsigStatus(); err {
+	case nil:
+	case ErrTime:
+		t.Error = RcodeBadTime
+		t.TimeSigned = tsig.TimeSigned
+		t.OtherLen = 6
+		t.OtherData = fmt.Sprintf("%012x", time.Now().Unix())
+	case ErrSig:
+		t.Error = RcodeBadSig
+	default:
+		t.Error = RcodeBadKey
+	}
+}
+
+// tsigMACSize returns the size in bytes of the MAC of algorithm, 0 if the
+// algorithm is not known.
+func tsigMACSize(algorithm string) int {
+	switch strings.ToLower(algorithm) {
+	case HmacMD5:
+		return md5.Size
+	case HmacSHA1:
+		return sha1.Size
+	case HmacSHA256:
+		return sha256.Size
+	case HmacSHA512:
+		return sha512.Size
+	}
+	return 0
+}
+
 // Create a wiredata buffer for the MAC calculation.
 func tsigBuffer(msgbuf []byte, rr *RR_TSIG, requestMAC string, timersOnly bool) []byte {
 	var buf []byte
@@ -250,7 +331,7 @@ func tsigBuffer(msgbuf []byte, rr *RR_TSIG, requestMAC string, timersOnly bool)
 		rr.TimeSigned = uint64(time.Now().Unix())
 	}
 	if rr.Fudge == 0 {
-		rr.Fudge = 300 // Standard (RFC) default.
+		rr.Fudge = TsigDefaultFudge // Standard (RFC) default.
 	}
 
 	if requestMAC != "" {
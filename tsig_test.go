@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"testing"
+	"time"
+)
+
+func newTsigMsg(algorithm string, timesigned int64) *Msg {
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeMX)
+	m.Id = 42
+	m.SetTsig("axfr.", algorithm, 300, timesigned)
+	return m
+}
+
+func TestTsigGenerate(t *testing.T) {
+	// MACs calculated independently over the RFC 2845 digest components
+	vectors := map[string]string{
+		HmacSHA256: "998abf18ea40e6ae1ae1d7b19b26cf68b1dd0baf722307810d08a68672c4726a",
+		HmacSHA512: "c3c1314e84d12264e5c6714a2bd403336621def768915993dfe54857c2cf3fd9ce361faf6d2bd174589016e1a87f43bb2597ca8ddbb5ec68d9fa9dad8ca5ad40",
+	}
+	for alg, expected := range vectors {
+		m := newTsigMsg(alg, 1325376000) // 2012-01-01 00:00:00 UTC
+		_, mac, err := TsigGenerate(m, "so6ZGir4GPAqINNh9U5c3A==", "", false)
+		if err != nil {
+			t.Fatalf("Failed to generate TSIG with %s: %s", alg, err.Error())
+		}
+		if mac != expected {
+			t.Logf("Wrong MAC for %s: %s, expected %s", alg, mac, expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestTsigRoundTrip(t *testing.T) {
+	secret := "so6ZGir4GPAqINNh9U5c3A=="
+	for _, alg := range []string{HmacMD5, HmacSHA1, HmacSHA256, HmacSHA512, "HMAC-SHA256."} {
+		buf, _, err := TsigGenerate(newTsigMsg(alg, time.Now().Unix()), secret, "", false)
+		if err != nil {
+			t.Fatalf("Failed to generate TSIG with %s: %s", alg, err.Error())
+		}
+		if err := TsigVerify(buf, secret, "", false); err != nil {
+			t.Logf("Failed to verify TSIG with %s: %s", alg, err.Error())
+			t.Fail()
+		}
+		buf, _, _ = TsigGenerate(newTsigMsg(alg, time.Now().Unix()), secret, "", false)
+		if err := TsigVerify(buf, "c28gc2VjcmV0", "", false); err != ErrSig {
+			t.Logf("Verify with the wrong secret for %s should fail with ErrSig, got %v", alg, err)
+			t.Fail()
+		}
+	}
+	if _, _, err := TsigGenerate(newTsigMsg("hmac-foo.", time.Now().Unix()), secret, "", false); err != ErrKeyAlg {
+		t.Logf("Unknown algorithm should give ErrKeyAlg, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestTsigFudge(t *testing.T) {
+	secret := "so6ZGir4GPAqINNh9U5c3A=="
+	for _, skew := range []int64{-200, 200} {
+		buf, _, _ := TsigGenerate(newTsigMsg(HmacSHA256, time.Now().Unix()+skew), secret, "", false)
+		if err := TsigVerifyFudge(buf, secret, "", false, 300); err != nil {
+			t.Logf("Skew of %d should be within a fudge of 300: %s", skew, err.Error())
+			t.Fail()
+		}
+		buf, _, _ = TsigGenerate(newTsigMsg(HmacSHA256, time.Now().Unix()+skew), secret, "", false)
+		if err := TsigVerifyFudge(buf, secret, "", false, 100); err != ErrTime {
+			t.Logf("Skew of %d should be outside a fudge of 100, got %v", skew, err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package dns
+
+// UDP sessions, remember the destination address of a query so the
+// reply is sent from that same address.
+
+import (
+	"net"
+)
+
+// sessionUDP holds the remote address of a UDP query and the control
+// message that tells on which local address it was received.
+type sessionUDP struct {
+	raddr   *net.UDPAddr // with the zone of a link-local address, replies keep the scope
+	context []byte
+}
+
+// RemoteAddr returns the remote network address.
+func (s *sessionUDP) RemoteAddr() net.Addr { return s.raddr }
+
+// readFromSessionUDP acts just like net.UDPConn.ReadFrom, but returns a
+// *sessionUDP instead of a net.Addr.
+func readFromSessionUDP(conn *net.UDPConn, b []byte) (int, *sessionUDP, error) {
+	oob := make([]byte, oobSize)
+	n, oobn, _, raddr, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, &sessionUDP{raddr, oob[:oobn]}, nil
+}
+
+// writeToSessionUDP acts just like net.UDPConn.WriteTo, but uses a
+// *sessionUDP instead of a net.Addr. When the destination of the query is
+// known it is used as the source of the reply, otherwise the kernel picks one.
+func writeToSessionUDP(conn *net.UDPConn, b []byte, session *sessionUDP) (int, error) {
+	n, _, err := conn.WriteMsgUDP(b, correctSource(session.context), session.raddr)
+	return n, err
+}
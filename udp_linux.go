@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// oobSize is large enough to hold an IPv4 or IPv6 packet info control message.
+var oobSize = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// setUDPSocketOptions asks the kernel to tell us the destination address,
+// via IP_PKTINFO, of the packets received on conn. Errors are ignored, in that
+// case the destination is unknown and the kernel selects the reply's source.
+func setUDPSocketOptions(conn *net.UDPConn) {
+	sc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	sc.Control(func(fd uintptr) {
+		// One of these fails, depending on the address family of the socket
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	})
+}
+
+// parseDstFromOOB returns the destination address of a packet
+// from its control message, or nil if it is not found. For an IPv6
+// link-local address the zone is the interface the packet arrived on.
+func parseDstFromOOB(oob []byte) (net.IP, string) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, ""
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			in := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return net.IPv4(in.Addr[0], in.Addr[1], in.Addr[2], in.Addr[3]), ""
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			in := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, in.Addr[:])
+			zone := ""
+			if ip.IsLinkLocalUnicast() {
+				if ifi, err := net.InterfaceByIndex(int(in.Ifindex)); err == nil {
+					zone = ifi.Name
+				}
+			}
+			return ip, zone
+		}
+	}
+	return nil, ""
+}
+
+// correctSource takes the control message of a received packet and returns
+// one that sets the destination of that packet as the source of the reply.
+func correctSource(oob []byte) []byte {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			in := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			b := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+			h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+			h.Level = syscall.IPPROTO_IP
+			h.Type = syscall.IP_PKTINFO
+			h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+			out := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&b[syscall.CmsgLen(0)]))
+			out.Spec_dst = in.Addr
+			return b
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			in := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			b := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+			h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+			h.Level = syscall.IPPROTO_IPV6
+			h.Type = syscall.IPV6_PKTINFO
+			h.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+			out := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&b[syscall.CmsgLen(0)]))
+			out.Addr = in.Addr
+			out.Ifindex = in.Ifindex
+			return b
+		}
+	}
+	return nil
+}
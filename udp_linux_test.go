@@ -0,0 +1,186 @@
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestUDPReplySource(t *testing.T) {
+	srv := &Server{Addr: "0.0.0.0:0", Net: "udp4", Handler: HandlerFunc(HelloServer)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+	port := addr[strings.LastIndex(addr, ":"):]
+
+	// 127.0.0.2 is local, but not the address the kernel picks as the
+	// source for packets to it. The client is connected, so it only
+	// accepts the reply when it comes from 127.0.0.2.
+	conn, err := net.Dial("udp", "127.0.0.2"+port)
+	if err != nil {
+		t.Skip("127.0.0.2 is not usable")
+	}
+	conn.Close()
+
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	for _, dst := range []string{"127.0.0.1", "127.0.0.2"} {
+		r, err := c.Exchange(m, dst+port)
+		if err != nil || r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+			t.Logf("Failed to get a reply from %s: %v", dst, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestNumListeners(t *testing.T) {
+	var (
+		lock sync.Mutex
+		seen = make(map[net.PacketConn]int)
+	)
+	handler := func(w ResponseWriter, req *Msg) {
+		lock.Lock()
+		seen[w.(*response)._UDP]++
+		lock.Unlock()
+		HelloServer(w, req)
+	}
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(handler), NumListeners: 4}
+	go srv.ListenAndServe()
+	addr := serverAddr(srv)
+	srv.lock.Lock()
+	n := len(srv.packetConns) + 1
+	srv.lock.Unlock()
+	if n != 4 {
+		t.Fatalf("Expected 4 sockets, got %d", n)
+	}
+
+	// The kernel picks the socket from the client's address, so use
+	// a new client socket, and port, for each query.
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	for i := 0; i < 64; i++ {
+		if _, err := c.Exchange(m, addr); err != nil {
+			t.Fatalf("Exchange failed: %s", err.Error())
+		}
+	}
+	lock.Lock()
+	if len(seen) != 4 {
+		t.Logf("Expected all 4 sockets to receive queries, got %v", seen)
+		t.Fail()
+	}
+	lock.Unlock()
+	if err := srv.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %s", err.Error())
+	}
+	srv.lock.Lock()
+	if srv.packetConns != nil {
+		t.Log("Sockets still set after Shutdown")
+		t.Fail()
+	}
+	srv.lock.Unlock()
+}
+
+// linkLocal returns an IPv6 link-local address of an interface that is up.
+func linkLocal() *net.UDPAddr {
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() == nil && ipn.IP.IsLinkLocalUnicast() {
+				return &net.UDPAddr{IP: ipn.IP, Zone: ifi.Name}
+			}
+		}
+	}
+	return nil
+}
+
+func TestUDPLinkLocalZone(t *testing.T) {
+	ll := linkLocal()
+	if ll == nil {
+		t.Skip("no IPv6 link-local address")
+	}
+	var (
+		lock          sync.Mutex
+		remote, local net.Addr
+	)
+	handler := func(w ResponseWriter, req *Msg) {
+		lock.Lock()
+		remote, local = w.RemoteAddr(), w.LocalAddr()
+		lock.Unlock()
+		HelloServer(w, req)
+	}
+	srv := &Server{Addr: "[::]:0", Net: "udp6", Handler: HandlerFunc(handler)}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+	ll.Port, _ = strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:])
+
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	r, err := c.Exchange(m, ll.String())
+	if err != nil {
+		t.Skipf("Link-local address %s is not usable: %s", ll, err.Error())
+	}
+	if r.Extra[0].(*RR_TXT).Txt[0] != "Hello world" {
+		t.Log("Unexpected reply")
+		t.Fail()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if ra, ok := remote.(*net.UDPAddr); !ok || ra.Zone != ll.Zone {
+		t.Logf("Expected remote address with zone %s, got %v", ll.Zone, remote)
+		t.Fail()
+	}
+	if la, ok := local.(*net.UDPAddr); !ok || !la.IP.Equal(ll.IP) || la.Zone != ll.Zone {
+		t.Logf("Expected local address %s, got %v", ll, local)
+		t.Fail()
+	}
+}
+
+func TestUDPSocketBuffers(t *testing.T) {
+	// Small sizes, well below the defaults, so the kernel does not cap them.
+	srv := &Server{Addr: "127.0.0.1:0", Net: "udp", Handler: HandlerFunc(HelloServer), UDPRecvBuf: 8192, UDPSendBuf: 16384}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	// The buffers are set before the first request is read.
+	c := new(Client)
+	m := new(Msg)
+	m.SetQuestion("miek.nl.", TypeTXT)
+	if _, err := c.Exchange(m, addr); err != nil {
+		t.Fatalf("Failed to exchange: %s", err.Error())
+	}
+	srv.lock.Lock()
+	sc, err := srv.packetConn.(*net.UDPConn).SyscallConn()
+	srv.lock.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to get the raw connection: %s", err.Error())
+	}
+	for opt, want := range map[int]int{syscall.SO_RCVBUF: srv.UDPRecvBuf, syscall.SO_SNDBUF: srv.UDPSendBuf} {
+		var got int
+		sc.Control(func(fd uintptr) {
+			got, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+		})
+		if err != nil {
+			t.Fatalf("Failed to read socket option %d: %s", opt, err.Error())
+		}
+		// Linux doubles the size for its own bookkeeping.
+		if got != want && got != 2*want {
+			t.Logf("Expected socket option %d to be %d, got %d", opt, want, got)
+			t.Fail()
+		}
+	}
+}
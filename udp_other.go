@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package dns
+
+import (
+	"net"
+)
+
+// On other platforms the destination of a packet is not retrieved and the
+// kernel selects the source of the reply.
+
+var oobSize = 0
+
+func setUDPSocketOptions(conn *net.UDPConn) {}
+
+func parseDstFromOOB(oob []byte) (net.IP, string) { return nil, "" }
+
+func correctSource(oob []byte) []byte { return nil }
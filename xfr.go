@@ -1,5 +1,12 @@
 package dns
 
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
 // XfrToken is used when doing [IA]xfr with a remote server.
 type XfrToken struct {
 	RR    []RR  // the set of RRs in the answer section of the AXFR reply message 
@@ -141,6 +148,141 @@ func checkXfrSOA(in *Msg, first bool) bool {
 	return false
 }
 
+// A Transfer defines the parameters for pulling a zone from a primary
+// with In. A nil Transfer uses the defaults.
+type Transfer struct {
+	DialTimeout   time.Duration     // the timeout for connecting, defaults to 2 * 1e9
+	ReadTimeout   time.Duration     // the net.Conn.SetReadTimeout value for each message, defaults to 2 * 1e9
+	WriteTimeout  time.Duration     // the net.Conn.SetWriteTimeout value for the request, defaults to 2 * 1e9
+	TsigSecret    map[string]string // secret(s) for Tsig map[<zonename>]<base64 secret>
+	TsigName      string            // if set, a request without a TSIG record is signed with this key, see In
+	TsigAlgorithm string            // the algorithm of the TsigName key, defaults to HmacSHA256
+	TsigFudge     uint16            // allowed clock skew in seconds for the TsigName signature, defaults to 300
+	LocalAddr     net.Addr          // the local address to connect from, see Client.LocalAddr
+}
+
+// An Envelope holds the records of one message of a zone transfer, or the
+// error that ended the transfer.
+type Envelope struct {
+	RR    []RR  // the records in the answer section of the message
+	Error error // if something went wrong, this contains the error
+}
+
+// In performs the AXFR request q with the server at addr over TCP. It
+// returns a channel on which the records of each reply are sent, the
+// channel is closed after the closing SOA record or after an error. The
+// first record must be the zone's SOA record, and the transfer ends with
+// the same SOA record. If q has a TSIG record, it is signed, and each
+// reply must be signed as well, see TsigGenerate. Each reply is verified
+// over the MAC of the one before it. When q has no TSIG record and
+// TsigName is set, a signed copy of q, using TsigAlgorithm, is sent instead.
+//
+// Basic use pattern:
+//
+//	m := new(dns.Msg)
+//	m.SetAxfr("miek.nl.")
+//	c, err := new(dns.Transfer).In(m, "127.0.0.1:53")
+//	for e := range c {
+//		// ... deal with e.RR or e.Error
+//	}
+func (t *Transfer) In(q *Msg, addr string) (chan *Envelope, error) {
+	if len(q.Question) != 1 || q.Question[0].Qtype != TypeAXFR {
+		return nil, &Error{Err: "not a zone transfer request"}
+	}
+	if t == nil {
+		t = new(Transfer)
+	}
+	if t.TsigName != "" && q.IsTsig() == nil {
+		s := *q
+		s.Extra = append([]RR(nil), q.Extra...)
+		setTsig(&s, t.TsigName, t.TsigAlgorithm, t.TsigFudge)
+		q = &s
+	}
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = 2 * 1e9
+	}
+	d := net.Dialer{Timeout: timeout, LocalAddr: localAddr("tcp", t.LocalAddr)}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	w := new(reply)
+	w.client = &Client{Net: "tcp", ReadTimeout: t.ReadTimeout, WriteTimeout: t.WriteTimeout, TsigSecret: t.TsigSecret}
+	w.addr = addr
+	w.req = q
+	w.conn = conn
+	if err := w.send(q); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := make(chan *Envelope)
+	go w.axfrIn(q, c)
+	return c, nil
+}
+
+// axfrIn receives the replies to the AXFR request q and sends their
+// records on c.
+func (w *reply) axfrIn(q *Msg, c chan *Envelope) {
+	defer w.conn.Close()
+	defer close(c)
+	var soa *RR_SOA
+	signed := q.IsTsig() != nil
+	for i, n := 0, 0; ; i++ {
+		// A timeout, also half way a message, ends the transfer.
+		setTimeouts(w)
+		p, err := readTCP(w.conn)
+		if err != nil {
+			c <- &Envelope{nil, err}
+			return
+		}
+		in := new(Msg)
+		if err := in.Unpack(p); err != nil {
+			c <- &Envelope{nil, err}
+			return
+		}
+		if in.Id != q.Id {
+			c <- &Envelope{in.Answer, ErrId}
+			return
+		}
+		if in.Rcode != RcodeSuccess {
+			c <- &Envelope{in.Answer, &Error{Err: "zone transfer failed: " + Rcode_str[in.Rcode], Name: q.Question[0].Name}}
+			return
+		}
+		if i == 0 {
+			if !checkXfrSOA(in, true) {
+				c <- &Envelope{in.Answer, ErrSoa}
+				return
+			}
+			soa = in.Answer[0].(*RR_SOA)
+		}
+		n += len(in.Answer)
+		// the opening SOA may be alone in the first message
+		last := n > 1 && checkXfrSOA(in, false)
+		if last && in.Answer[len(in.Answer)-1].(*RR_SOA).Serial != soa.Serial {
+			c <- &Envelope{in.Answer, ErrSoa}
+			return
+		}
+		if signed {
+			t := in.IsTsig()
+			if t == nil {
+				c <- &Envelope{in.Answer, ErrNoSig}
+				return
+			}
+			if err := TsigVerify(p, w.client.TsigSecret[t.Hdr.Name], w.tsigRequestMAC, i > 0); err != nil {
+				c <- &Envelope{in.Answer, err}
+				return
+			}
+			// the next reply is signed on top of this one
+			w.tsigRequestMAC = t.MAC
+		}
+		c <- &Envelope{in.Answer, nil}
+		if last {
+			return
+		}
+	}
+}
+
 // XfrSend performs an outgoing [AI]xfr depending on the request message. The
 // caller is responsible for sending the correct sequence of RR sets through
 // the channel c. For reasons of symmetry XfrToken is re-used.
@@ -191,3 +333,222 @@ func axfrSend(w ResponseWriter, req *Msg, c chan *XfrToken, e *error) {
 		rep.Answer = nil
 	}
 }
+
+// xfrMsgSize is the size at which Transfer starts a new message. It leaves
+// room for a TSIG record and the two byte length of a TCP message.
+const xfrMsgSize = MaxMsgSize - 1024
+
+// Transfer answers the AXFR (or ANY) request r for the apex of z by
+// writing the entire zone to w, starting and ending with the zone's
+// SOA record. The records are spread over as many messages as needed.
+// Transfers are only done over TCP, a request received over UDP gets
+// a reply with the TC bit set. If r has a valid TSIG each message is
+// signed, the messages after the first one only sign the timers and are
+// chained to the MAC of the previous message.
+//
+// Basic use pattern, for a handler registered for the zone z:
+//
+//	func handle(w dns.ResponseWriter, r *dns.Msg) {
+//		if r.Question[0].Qtype == dns.TypeAXFR {
+//			z.Transfer(w, r)
+//			return
+//		}
+//		// ...
+//	}
+func (z *Zone) Transfer(w ResponseWriter, r *Msg) error {
+	if len(r.Question) != 1 || (r.Question[0].Qtype != TypeAXFR && r.Question[0].Qtype != TypeANY) {
+		return &Error{Err: "not a zone transfer request"}
+	}
+	if err := z.checkTransfer(w, r); err != nil {
+		return err
+	}
+	envelopes, err := z.envelopes()
+	if err != nil {
+		m := new(Msg)
+		m.SetRcode(r, RcodeServerFailure)
+		setReplyTsig(w, m, r)
+		w.Write(m)
+		return err
+	}
+	return writeEnvelopes(w, r, envelopes)
+}
+
+// TransferIncremental answers the IXFR request r for the apex of z. The
+// serial of the client, fromSerial, is found in the SOA record in the
+// authority section of r. The changes since fromSerial, as recorded by
+// Change, are sent as described in RFC 1995. When the client is up to
+// date only the SOA record is sent. When the changes are not known, because
+// they are older than the journal, the whole zone is sent as with Transfer.
+// Like Transfer this only works over TCP.
+func (z *Zone) TransferIncremental(w ResponseWriter, r *Msg, fromSerial uint32) error {
+	if len(r.Question) != 1 || r.Question[0].Qtype != TypeIXFR {
+		return &Error{Err: "not an incremental zone transfer request"}
+	}
+	if err := z.checkTransfer(w, r); err != nil {
+		return err
+	}
+	envelopes, err := z.ixfrEnvelopes(fromSerial)
+	if err == nil && envelopes == nil {
+		envelopes, err = z.envelopes()
+	}
+	if err != nil {
+		m := new(Msg)
+		m.SetRcode(r, RcodeServerFailure)
+		setReplyTsig(w, m, r)
+		w.Write(m)
+		return err
+	}
+	return writeEnvelopes(w, r, envelopes)
+}
+
+// checkTransfer checks if the transfer request r may be answered. If not
+// an error reply is written and the reason is returned. When r is signed
+// the error reply has a TSIG record, see setReplyTsig.
+func (z *Zone) checkTransfer(w ResponseWriter, r *Msg) error {
+	write := func(m *Msg) {
+		setReplyTsig(w, m, r)
+		w.Write(m)
+	}
+	if !strings.EqualFold(Fqdn(r.Question[0].Name), z.Origin) {
+		m := new(Msg)
+		m.SetRcode(r, RcodeNotAuth)
+		write(m)
+		return &Error{Err: "not authoritative for zone", Name: r.Question[0].Name}
+	}
+	switch w.Network() {
+	case "tcp":
+	case "udp":
+		m := new(Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		write(m)
+		return &Error{Err: "zone transfer over UDP"}
+	default:
+		// A transfer takes more than one reply, DNS over HTTPS has one.
+		m := new(Msg)
+		m.SetRcode(r, RcodeRefused)
+		write(m)
+		return &Error{Err: "zone transfer over " + w.Network()}
+	}
+	tsig := r.IsTsig()
+	if tsig != nil && w.TsigStatus() != nil {
+		m := new(Msg)
+		m.SetRcode(r, RcodeNotAuth)
+		write(m)
+		return w.TsigStatus()
+	}
+	return nil
+}
+
+// writeEnvelopes writes each set of records in its own reply to r.
+func writeEnvelopes(w ResponseWriter, r *Msg, envelopes [][]RR) error {
+	tsig := r.IsTsig()
+	for i, rrs := range envelopes {
+		m := new(Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = rrs
+		if tsig != nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, int64(tsig.Fudge), time.Now().Unix())
+			w.TsigTimersOnly(i > 0)
+		}
+		if err := w.Write(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envelopes collects records into sets that each fit in a single message.
+type envelopes struct {
+	sets [][]RR
+	cur  []RR
+	size int
+}
+
+func (e *envelopes) add(r RR) {
+	if l := r.Len(); e.size+l > xfrMsgSize && len(e.cur) > 0 {
+		e.sets = append(e.sets, e.cur)
+		e.cur, e.size = nil, 0
+	}
+	e.cur = append(e.cur, r)
+	e.size += r.Len()
+}
+
+func (e *envelopes) done() [][]RR { return append(e.sets, e.cur) }
+
+// envelopes returns the records of the zone, framed by the SOA record,
+// split into sets that each fit in a single message.
+func (z *Zone) envelopes() ([][]RR, error) {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	soa := z.apexSOA()
+	if soa == nil {
+		return nil, ErrSoa
+	}
+	e := new(envelopes)
+	e.add(soa)
+	z.Radix.Do(func(i interface{}) {
+		zd := i.(*ZoneData)
+		zd.mutex.RLock()
+		defer zd.mutex.RUnlock()
+		types := make([]uint16, 0, len(zd.RR))
+		for t := range zd.RR {
+			if t != TypeSOA {
+				types = append(types, t)
+			}
+		}
+		sort.Sort(uint16Slice(types))
+		for _, t := range types {
+			for _, r := range zd.RR[t] {
+				e.add(r)
+			}
+		}
+		for _, sigs := range zd.Signatures {
+			for _, r := range sigs {
+				e.add(r)
+			}
+		}
+	})
+	e.add(soa)
+	return e.done(), nil
+}
+
+// ixfrEnvelopes returns the changes since serial, split into sets that
+// each fit in a single message. If the changes are not in the journal
+// nil is returned.
+func (z *Zone) ixfrEnvelopes(serial uint32) ([][]RR, error) {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	soa := z.apexSOA()
+	if soa == nil {
+		return nil, ErrSoa
+	}
+	if serial == soa.Serial {
+		return [][]RR{{soa}}, nil
+	}
+	start := -1
+	for i, d := range z.journal {
+		if d.from.Serial == serial {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		return nil, nil
+	}
+	e := new(envelopes)
+	e.add(soa)
+	for _, d := range z.journal[start:] {
+		e.add(d.from)
+		for _, r := range d.del {
+			e.add(r)
+		}
+		e.add(d.to)
+		for _, r := range d.add {
+			e.add(r)
+		}
+	}
+	e.add(soa)
+	return e.done(), nil
+}
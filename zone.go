@@ -4,6 +4,7 @@ package dns
 
 import (
 	"github.com/miekg/radix"
+	"io"
 	"math/rand"
 	"runtime"
 	"sort"
@@ -13,16 +14,34 @@ import (
 )
 
 // Zone represents a DNS zone. It's safe for concurrent use by 
-// multilpe goroutines.
+// multilpe goroutines: Insert, Remove and Change lock the zone for writing,
+// Find, Walk and SOA for reading, so callers do not need a mutex of their own
+// to share a zone between the server's goroutines. The ZoneData returned
+// by Find and its variants is the zone's own, its maps are guarded by a
+// lock that can not be taken outside this package: treat them as read
+// only and only read them while the zone is not changed. Use Lookup or
+// LookupSigned to read records while the zone may change.
 type Zone struct {
 	Origin       string // Origin of the zone
 	Wildcard     int    // Whenever we see a wildcard name, this is incremented
 	*radix.Radix        // Zone data
 	mutex        *sync.RWMutex
 	expired      bool // Slave zone is expired
+	// IXFRJournalSize is the number of changes kept for incremental
+	// transfers, see Change. If zero no changes are kept.
+	IXFRJournalSize int
+	journal         []*zoneDiff // the most recent changes, oldest first
+	nsec3           []*RR_NSEC3 // the NSEC3 chain sorted on hash, see GenerateNSEC3
+	update          sync.Mutex  // serializes Update
 	// Do we need a timemodified?
 }
 
+// zoneDiff is a single change to a zone, as made by Change.
+type zoneDiff struct {
+	from, to *RR_SOA // the SOA before and after the change
+	del, add []RR
+}
+
 type uint16Slice []uint16
 
 func (p uint16Slice) Len() int           { return len(p) }
@@ -86,6 +105,53 @@ func NewZone(origin string) *Zone {
 	return z
 }
 
+// Clone returns a deep copy of the zone: changes to the copy do not show
+// in z and the other way around. The records are copied with their Copy
+// method. To reload a zone without readers seeing it half updated, build
+// or change a new version and swap a pointer that all readers load, for
+// instance with an atomic.Value:
+//
+//	var current atomic.Value // holds a *dns.Zone
+//	next := current.Load().(*dns.Zone).Clone()
+//	// ... change next
+//	current.Store(next)
+func (z *Zone) Clone() *Zone {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	c := NewZone(z.Origin)
+	c.Wildcard = z.Wildcard
+	c.expired = z.expired
+	c.IXFRJournalSize = z.IXFRJournalSize
+	c.journal = append([]*zoneDiff(nil), z.journal...)
+	for _, n := range z.nsec3 {
+		c.nsec3 = append(c.nsec3, n.Copy().(*RR_NSEC3))
+	}
+	z.Radix.Do(func(i interface{}) {
+		zd := i.(*ZoneData)
+		c.Radix.Insert(toRadixName(zd.Name), zd.clone())
+	})
+	return c
+}
+
+// clone returns a copy of zd with copies of its records.
+func (zd *ZoneData) clone() *ZoneData {
+	zd.mutex.RLock()
+	defer zd.mutex.RUnlock()
+	c := NewZoneData(zd.Name)
+	c.NonAuth = zd.NonAuth
+	for t, rrs := range zd.RR {
+		for _, r := range rrs {
+			c.RR[t] = append(c.RR[t], r.Copy())
+		}
+	}
+	for t, sigs := range zd.Signatures {
+		for _, s := range sigs {
+			c.Signatures[t] = append(c.Signatures[t], s.Copy().(*RR_RRSIG))
+		}
+	}
+	return c
+}
+
 // ZoneData holds all the RRs having their owner name equal to Name.
 type ZoneData struct {
 	Name       string                 // Domain name for this node
@@ -95,6 +161,39 @@ type ZoneData struct {
 	mutex      *sync.RWMutex
 }
 
+// ReadZone reads a RFC 1035 style zone file from r and returns the
+// zone with origin origin holding all its records. The records are
+// parsed as with ParseZone. Records without a TTL that come before
+// any $TTL directive get defaultTTL, or 3600 if it is zero. The first
+// parse error is returned, it contains the line number. Records that
+// are not below origin also give an error.
+func ReadZone(r io.Reader, origin string, defaultTTL uint32) (*Zone, error) {
+	z := NewZone(origin)
+	if z == nil {
+		return nil, &Error{Err: "bad origin name", Name: origin}
+	}
+	if defaultTTL == 0 {
+		defaultTTL = defaultTtl
+	}
+	t := parseZoneHelper(r, z.Origin, "", defaultTTL, 10000)
+	// drain the channel so the parser finishes, when we stop early
+	defer func() {
+		go func() {
+			for _ = range t {
+			}
+		}()
+	}()
+	for x := range t {
+		if x.Error != nil {
+			return nil, x.Error
+		}
+		if err := z.Insert(x.RR); err != nil {
+			return nil, err
+		}
+	}
+	return z, nil
+}
+
 // NewZoneData creates a new zone data element.
 func NewZoneData(s string) *ZoneData {
 	zd := new(ZoneData)
@@ -107,35 +206,18 @@ func NewZoneData(s string) *ZoneData {
 
 // toRadixName reverses a domain name so that when we store it in the radix tree
 // we preserve the nsec ordering of the zone (this idea was stolen from NSD).
-// Each label is also lowercased. The name given must be fully qualified.
+// Each label is also lowercased, for ASCII only, so matching is case
+// insensitive. The labels, escapes included, are otherwise kept as they are,
+// see SplitLabels, so reversing them again gives the name back.
 func toRadixName(d string) string {
 	if d == "" || d == "." {
 		return "."
 	}
 	s := ""
-	ld := len(d)
-	if d[ld-1] != '.' {
-		d = d + "."
-		ld++
-	}
-	var lastdot int
-	var lastbyte byte
-	var lastlastbyte byte
-	for i := 0; i < len(d); i++ {
-		if d[i] == '.' {
-			switch {
-			case lastbyte != '\\':
-				fallthrough
-			case lastbyte == '\\' && lastlastbyte == '\\':
-				s = d[lastdot:i] + "." + s
-				lastdot = i + 1
-				continue
-			}
-		}
-		lastlastbyte = lastbyte
-		lastbyte = d[i]
+	for _, l := range SplitLabels(d) {
+		s = "." + l + s
 	}
-	return "." + strings.ToLower(s[:len(s)-1])
+	return lowerASCII(s)
 }
 
 // String returns a string representation of a ZoneData. There is no
@@ -196,105 +278,449 @@ func (z *Zone) Lock() { z.mutex.Lock() }
 // Unlock unlocks the zone z for writing.
 func (z *Zone) Unlock() { z.mutex.Unlock() }
 
-// Insert inserts an RR into the zone. There is no check for duplicate data, although
-// Remove will remove all duplicates.
+// Insert inserts an RR into the zone. The RR is added to the RRset of its
+// name and type, unless that already holds the same record; the TTL is not
+// compared.
 func (z *Zone) Insert(r RR) error {
+	z.Lock()
+	defer z.Unlock()
+	return z.insertRR(r)
+}
+
+// insertRR inserts r into the zone, see Insert. The caller must hold the
+// zone's write lock.
+func (z *Zone) insertRR(r RR) error {
 	if !IsSubDomain(z.Origin, r.Header().Name) {
 		return &Error{Err: "out of zone data", Name: r.Header().Name}
 	}
 
-	// TODO(mg): quick check for doubles?
 	key := toRadixName(r.Header().Name)
-	z.Lock()
 	zd, exact := z.Radix.Find(key)
 	if !exact {
 		// Not an exact match, so insert new value
-		defer z.Unlock()
 		// Check if it's a wildcard name
 		if len(r.Header().Name) > 1 && r.Header().Name[0] == '*' && r.Header().Name[1] == '.' {
 			z.Wildcard++
 		}
 		zd := NewZoneData(r.Header().Name)
-		switch t := r.Header().Rrtype; t {
-		case TypeRRSIG:
-			sigtype := r.(*RR_RRSIG).TypeCovered
-			zd.Signatures[sigtype] = append(zd.Signatures[sigtype], r.(*RR_RRSIG))
-		case TypeNS:
-			// NS records with other names than z.Origin are non-auth
-			if r.Header().Name != z.Origin {
-				zd.NonAuth = true
-			}
-			fallthrough
-		default:
-			zd.RR[t] = append(zd.RR[t], r)
-		}
+		zd.insert(r, z.Origin)
 		z.Radix.Insert(key, zd)
 		return nil
 	}
-	z.Unlock()
-	zd.Value.(*ZoneData).mutex.Lock()
-	defer zd.Value.(*ZoneData).mutex.Unlock()
-	// Name already there
+	// Readers lock the node after finding it, not the zone.
+	d := zd.Value.(*ZoneData)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.insert(r, z.Origin)
+	return nil
+}
+
+// insert adds r to the RRsets of zd, if it is not there yet. The caller
+// must hold the lock of zd.
+func (zd *ZoneData) insert(r RR, origin string) {
 	switch t := r.Header().Rrtype; t {
 	case TypeRRSIG:
-		sigtype := r.(*RR_RRSIG).TypeCovered
-		zd.Value.(*ZoneData).Signatures[sigtype] = append(zd.Value.(*ZoneData).Signatures[sigtype], r.(*RR_RRSIG))
+		sig := r.(*RR_RRSIG)
+		for _, s := range zd.Signatures[sig.TypeCovered] {
+			if sameRR(s, sig) {
+				return
+			}
+		}
+		zd.Signatures[sig.TypeCovered] = append(zd.Signatures[sig.TypeCovered], sig)
 	case TypeNS:
-		if r.Header().Name != z.Origin {
-			zd.Value.(*ZoneData).NonAuth = true
+		// NS records with other names than the origin are non-auth
+		if r.Header().Name != origin {
+			zd.NonAuth = true
 		}
 		fallthrough
 	default:
-		zd.Value.(*ZoneData).RR[t] = append(zd.Value.(*ZoneData).RR[t], r)
+		if !containsRR(zd.RR[t], r) {
+			zd.RR[t] = append(zd.RR[t], r)
+		}
 	}
-	return nil
 }
 
-// Remove removes the RR r from the zone. If the RR can not be found,
+// Remove removes the RR r from the zone, a record with the same contents
+// is removed, the TTL is not compared. When no records are left at the
+// name, the name is removed from the zone. If the RR can not be found,
 // this is a no-op.
 func (z *Zone) Remove(r RR) error {
-	key := toRadixName(r.Header().Name)
 	z.Lock()
+	defer z.Unlock()
+	return z.removeRR(r)
+}
+
+// removeRR removes r from the zone, see Remove. The caller must hold the
+// zone's write lock.
+func (z *Zone) removeRR(r RR) error {
+	key := toRadixName(r.Header().Name)
 	zd, exact := z.Radix.Find(key)
 	if !exact {
-		defer z.Unlock()
 		return nil
 	}
-	z.Unlock()
-	zd.Value.(*ZoneData).mutex.Lock()
-	defer zd.Value.(*ZoneData).mutex.Unlock()
-	remove := false
+	d := zd.Value.(*ZoneData)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	switch t := r.Header().Rrtype; t {
 	case TypeRRSIG:
 		sigtype := r.(*RR_RRSIG).TypeCovered
-		for i, zr := range zd.Value.(*ZoneData).RR[sigtype] {
-			if r == zr {
-				zd.Value.(*ZoneData).RR[sigtype] = append(zd.Value.(*ZoneData).RR[sigtype][:i], zd.Value.(*ZoneData).RR[sigtype][i+1:]...)
-				remove = true
+		// New slices, the old ones may still be read by a lookup.
+		var sigs []*RR_RRSIG
+		for _, s := range d.Signatures[sigtype] {
+			if !sameRR(r, s) {
+				sigs = append(sigs, s)
 			}
 		}
+		d.Signatures[sigtype] = sigs
+		if len(sigs) == 0 {
+			delete(d.Signatures, sigtype)
+		}
 	default:
-		for i, zr := range zd.Value.(*ZoneData).RR[t] {
-			if r == zr {
-				zd.Value.(*ZoneData).RR[t] = append(zd.Value.(*ZoneData).RR[t][:i], zd.Value.(*ZoneData).RR[t][i+1:]...)
-				remove = true
+		var rrs []RR
+		for _, zr := range d.RR[t] {
+			if !sameRR(r, zr) {
+				rrs = append(rrs, zr)
 			}
 		}
+		d.RR[t] = rrs
+		if len(rrs) == 0 {
+			delete(d.RR, t)
+		}
 	}
-	if remove && len(r.Header().Name) > 1 && r.Header().Name[0] == '*' && r.Header().Name[1] == '.' {
-		z.Wildcard--
-		if z.Wildcard < 0 {
-			z.Wildcard = 0
+	if len(d.RR) == 0 && len(d.Signatures) == 0 {
+		z.Radix.Remove(key)
+		if len(d.Name) > 1 && d.Name[0] == '*' && d.Name[1] == '.' && z.Wildcard > 0 {
+			z.Wildcard--
 		}
 	}
-	// TODO(mg): what to do if the whole structure is empty? Set it to nil?
 	return nil
 }
 
+// Change removes the records in del from the zone, adds the records in add
+// and replaces the zone's SOA record with soa, which should have a new
+// serial. The change is recorded in the journal for incremental
+// transfers, see IXFRJournalSize and TransferIncremental. The records in
+// del only need to have the same contents as the ones in the zone, their
+// TTL is ignored. The zone is locked for the whole change, so readers see
+// either the old or the new zone, and when a record is out of zone none of
+// the change is applied.
+func (z *Zone) Change(soa *RR_SOA, del, add []RR) error {
+	z.Lock()
+	defer z.Unlock()
+	old := z.apexSOA()
+	if old == nil {
+		return ErrSoa
+	}
+	// Check everything before touching the zone, so a failed change
+	// leaves it alone.
+	if !IsSubDomain(z.Origin, soa.Hdr.Name) {
+		return &Error{Err: "out of zone data", Name: soa.Hdr.Name}
+	}
+	for _, r := range add {
+		if !IsSubDomain(z.Origin, r.Header().Name) {
+			return &Error{Err: "out of zone data", Name: r.Header().Name}
+		}
+	}
+	var deleted []RR
+	for _, r := range del {
+		n, exact := z.Radix.Find(toRadixName(r.Header().Name))
+		if !exact {
+			continue
+		}
+		zd := n.Value.(*ZoneData)
+		zd.mutex.RLock()
+		var found RR
+		for _, zr := range zd.RR[r.Header().Rrtype] {
+			if sameRR(r, zr) {
+				found = zr
+				break
+			}
+		}
+		zd.mutex.RUnlock()
+		if found != nil {
+			z.removeRR(found)
+			deleted = append(deleted, found)
+		}
+	}
+	for _, r := range add {
+		z.insertRR(r)
+	}
+	z.removeRR(old)
+	z.insertRR(soa)
+
+	if z.IXFRJournalSize > 0 {
+		z.journal = append(z.journal, &zoneDiff{old, soa, deleted, add})
+		if l := len(z.journal); l > z.IXFRJournalSize {
+			z.journal = z.journal[l-z.IXFRJournalSize:]
+		}
+	}
+	return nil
+}
+
+// Update applies the dynamic update r, RFC 2136, to the zone and returns
+// the rcode for the reply. First all prerequisites are checked, when
+// one fails the zone is left alone and NXDOMAIN, YXDOMAIN, NXRRSET or
+// YXRRSET is returned. Then the update section is applied as a whole, with
+// Change. The SOA serial is incremented when the zone changed, unless
+// the update adds a SOA with a higher serial itself. Deleting the SOA,
+// or the last NS record at the apex, is ignored. Update does not check
+// who may update the zone, that is left to the caller, for instance
+// with TSIG.
+func (z *Zone) Update(r *Msg) (rcode int) {
+	if r.Opcode != OpcodeUpdate || len(r.Question) != 1 || r.Question[0].Qtype != TypeSOA {
+		return RcodeFormatError
+	}
+	if !strings.EqualFold(Fqdn(r.Question[0].Name), z.Origin) {
+		return RcodeNotAuth
+	}
+	zclass := r.Question[0].Qclass
+	z.update.Lock()
+	defer z.update.Unlock()
+	soa := z.SOA()
+	if soa == nil {
+		return RcodeServerFailure
+	}
+
+	// Prerequisites, RFC 2136 section 3.2
+	values := make(map[string]map[uint16][]RR) // value dependent RRsets
+	for _, rr := range r.Answer {
+		h := rr.Header()
+		if h.Ttl != 0 {
+			return RcodeFormatError
+		}
+		if !IsSubDomain(z.Origin, h.Name) {
+			return RcodeNotZone
+		}
+		data := z.snapshot(h.Name)
+		switch h.Class {
+		case ClassANY:
+			if h.Rrtype == TypeANY {
+				if len(data) == 0 {
+					return RcodeNameError
+				}
+			} else if len(data[h.Rrtype]) == 0 {
+				return RcodeNXRrset
+			}
+		case ClassNONE:
+			if h.Rrtype == TypeANY {
+				if len(data) != 0 {
+					return RcodeYXDomain
+				}
+			} else if len(data[h.Rrtype]) != 0 {
+				return RcodeYXRrset
+			}
+		case zclass:
+			name := strings.ToLower(h.Name)
+			if values[name] == nil {
+				values[name] = make(map[uint16][]RR)
+			}
+			values[name][h.Rrtype] = append(values[name][h.Rrtype], rr)
+		default:
+			return RcodeFormatError
+		}
+	}
+	for name, sets := range values {
+		data := z.snapshot(name)
+		for t, rrset := range sets {
+			if !sameRRset(rrset, data[t]) {
+				return RcodeNXRrset
+			}
+		}
+	}
+
+	// Prescan the update section, RFC 2136 section 3.4.1
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		if !IsSubDomain(z.Origin, h.Name) {
+			return RcodeNotZone
+		}
+		switch h.Class {
+		case zclass:
+			switch h.Rrtype {
+			case TypeANY, TypeAXFR, TypeIXFR, TypeMAILA, TypeMAILB:
+				return RcodeFormatError
+			}
+		case ClassANY, ClassNONE:
+			if h.Ttl != 0 || h.Class == ClassNONE && h.Rrtype == TypeANY {
+				return RcodeFormatError
+			}
+		default:
+			return RcodeFormatError
+		}
+	}
+
+	// Apply the updates to a copy of the names involved
+	work := make(map[string]map[uint16][]RR)
+	orig := make(map[string]map[uint16][]RR)
+	newsoa := soa
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if _, ok := work[name]; !ok {
+			orig[name] = z.snapshot(name)
+			work[name] = z.snapshot(name)
+		}
+		data := work[name]
+		apex := name == strings.ToLower(z.Origin)
+		switch h.Class {
+		case zclass:
+			if h.Rrtype == TypeSOA {
+				if s, ok := rr.(*RR_SOA); ok && apex && s.Serial > newsoa.Serial {
+					newsoa = s
+				}
+				continue
+			}
+			dup := false
+			for _, zr := range data[h.Rrtype] {
+				dup = dup || sameRR(rr, zr)
+			}
+			if !dup {
+				data[h.Rrtype] = append(data[h.Rrtype], rr)
+			}
+		case ClassANY:
+			for t, _ := range data {
+				if (h.Rrtype == TypeANY || h.Rrtype == t) && !(apex && (t == TypeSOA || t == TypeNS)) {
+					delete(data, t)
+				}
+			}
+		case ClassNONE:
+			if h.Rrtype == TypeSOA || apex && h.Rrtype == TypeNS && len(data[TypeNS]) == 1 {
+				continue
+			}
+			c := rr.Copy()
+			c.Header().Class = zclass
+			var keep []RR
+			for _, zr := range data[h.Rrtype] {
+				if !sameRR(c, zr) {
+					keep = append(keep, zr)
+				}
+			}
+			data[h.Rrtype] = keep
+		}
+	}
+	var del, add []RR
+	for name, data := range work {
+		for t, rrset := range orig[name] {
+			for _, zr := range rrset {
+				if !containsRR(data[t], zr) {
+					del = append(del, zr)
+				}
+			}
+		}
+		for t, rrset := range data {
+			for _, rr := range rrset {
+				if !containsRR(orig[name][t], rr) {
+					c := rr.Copy()
+					c.Header().Class = zclass
+					add = append(add, c)
+				}
+			}
+		}
+	}
+	if len(del) == 0 && len(add) == 0 && newsoa == soa {
+		return RcodeSuccess
+	}
+	if newsoa == soa {
+		newsoa = soa.Copy().(*RR_SOA)
+		newsoa.Serial++
+	}
+	if err := z.Change(newsoa, del, add); err != nil {
+		return RcodeServerFailure
+	}
+	return RcodeSuccess
+}
+
+// snapshot returns a copy of the RRsets at name, leaving out the RRSIGs
+// and empty RRsets.
+func (z *Zone) snapshot(name string) map[uint16][]RR {
+	data := make(map[uint16][]RR)
+	zd, exact := z.Find(name)
+	if !exact {
+		return data
+	}
+	zd.mutex.RLock()
+	defer zd.mutex.RUnlock()
+	for t, rrset := range zd.RR {
+		if len(rrset) > 0 {
+			data[t] = append([]RR(nil), rrset...)
+		}
+	}
+	return data
+}
+
+// containsRR returns true if rrset holds a record equal to r, see sameRR.
+func containsRR(rrset []RR, r RR) bool {
+	for _, rr := range rrset {
+		if sameRR(rr, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameRRset returns true if a and b hold the same records, in any order.
+func sameRRset(a, b []RR) bool {
+	for _, r := range a {
+		if !containsRR(b, r) {
+			return false
+		}
+	}
+	for _, r := range b {
+		if !containsRR(a, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// SOA returns the SOA record at the zone's origin, or nil when there is
+// none.
+func (z *Zone) SOA() *RR_SOA {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	return z.apexSOA()
+}
+
+// Serial returns the serial of the zone's SOA record, or 0 when there is
+// no SOA record.
+func (z *Zone) Serial() uint32 {
+	if soa := z.SOA(); soa != nil {
+		return soa.Serial
+	}
+	return 0
+}
+
+// apexSOA returns the SOA record at the zone's origin, or nil. The caller
+// must hold the zone's read lock.
+func (z *Zone) apexSOA() *RR_SOA {
+	apex, e := z.Radix.Find(toRadixName(z.Origin))
+	if !e {
+		return nil
+	}
+	zd := apex.Value.(*ZoneData)
+	zd.mutex.RLock()
+	defer zd.mutex.RUnlock()
+	if soa, ok := zd.RR[TypeSOA]; ok && len(soa) > 0 {
+		return soa[0].(*RR_SOA)
+	}
+	return nil
+}
+
+// sameRR returns true if a and b have the same owner name, class, type
+// and rdata. The TTL is not compared.
+func sameRR(a, b RR) bool {
+	ha, hb := a.Header(), b.Header()
+	if ha.Rrtype != hb.Rrtype || ha.Class != hb.Class || !strings.EqualFold(ha.Name, hb.Name) {
+		return false
+	}
+	return strings.TrimPrefix(a.String(), ha.String()) == strings.TrimPrefix(b.String(), hb.String())
+}
+
 // Find looks up the ownername s in the zone and returns the
 // data and true when an exact match is found. If an exact find isn't
 // possible the first parent node with a non-nil Value is returned and
-// the boolean is false.
+// the boolean is false. Use FindMatch to tell an empty non-terminal from
+// a name that does not exist.
 func (z *Zone) Find(s string) (node *ZoneData, exact bool) {
 	z.mutex.RLock()
 	defer z.mutex.RUnlock()
@@ -307,6 +733,379 @@ func (z *Zone) Find(s string) (node *ZoneData, exact bool) {
 	return
 }
 
+// A Match tells how a name was found in a zone, see FindMatch.
+type Match int
+
+const (
+	MatchNone             Match = iota // the name does not exist: NXDOMAIN
+	MatchExact                         // the name has records: an answer, or NODATA for other types
+	MatchEmptyNonTerminal              // the name has no records, but names below it do: NODATA
+)
+
+// FindMatch works like Find, but tells how s was found. For MatchExact
+// the node of s is returned, otherwise the node of its closest parent in
+// the zone, as Find does. Wildcards are not looked at, see FindWildcard.
+func (z *Zone) FindMatch(s string) (node *ZoneData, m Match) {
+	s = Fqdn(s)
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	n, e := z.Radix.Find(toRadixName(s))
+	if n != nil {
+		node, _ = n.Value.(*ZoneData)
+	}
+	switch {
+	case e:
+		return node, MatchExact
+	case z.exists(s):
+		return node, MatchEmptyNonTerminal
+	}
+	return node, MatchNone
+}
+
+// FindWildcard works like Find, but when s does not exist in the zone
+// and a wildcard matches it, following RFC 4592, a node with the records
+// of the wildcard is returned and wildcard is true. The owner names of
+// these records are set to s. No wildcard is used when s is an empty
+// non-terminal, when the closest encloser of s has no wildcard or when s
+// is at or below a delegation.
+func (z *Zone) FindWildcard(s string) (node *ZoneData, exact, wildcard bool) {
+	s = Fqdn(s)
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	n, e := z.Radix.Find(toRadixName(s))
+	if n != nil {
+		node = n.Value.(*ZoneData)
+	}
+	if e || z.Wildcard == 0 || !IsSubDomain(z.Origin, s) || z.exists(s) {
+		return node, e, false
+	}
+	labels := SplitLabels(s)
+	for i := 1; i < len(labels); i++ {
+		ce := strings.Join(labels[i:], ".") + "."
+		if !IsSubDomain(z.Origin, ce) {
+			break
+		}
+		if !z.exists(ce) {
+			continue
+		}
+		// ce is the closest encloser
+		if z.delegated(ce) {
+			return node, false, false
+		}
+		w, e := z.Radix.Find(toRadixName("*." + ce))
+		if !e {
+			return node, false, false
+		}
+		return w.Value.(*ZoneData).synthesize(s), false, true
+	}
+	return node, false, false
+}
+
+// exists returns true if name is in the zone, either as a node or as an
+// empty non-terminal. The caller must hold the zone's read lock.
+func (z *Zone) exists(name string) bool {
+	key := toRadixName(name)
+	n, e := z.Radix.Find(key)
+	if e || n == nil {
+		return e
+	}
+	// Look for names below name, they all come after n in the tree.
+	below := key + "."
+	for next := n.Next(); next != nil && next != n && next.Key() > n.Key(); next = next.Next() {
+		k := next.Key()
+		if strings.HasPrefix(k, below) {
+			return true
+		}
+		if k > key && !strings.HasPrefix(k, key) {
+			break
+		}
+	}
+	return false
+}
+
+// delegated returns true if name or one of its parents in the zone, but
+// not the apex, has NS records. The caller must hold the zone's read lock.
+func (z *Zone) delegated(name string) bool {
+	return z.delegation(name) != nil
+}
+
+// ClosestDelegation returns the node of the delegation that name is at or
+// below, and true, or nil and false when name is not delegated. The node
+// has the NS records to put in a referral, see Referral. When there are
+// NS records at more than one name between name and the apex, the one
+// closest to the apex is returned, the NS records below it are not
+// authoritative data.
+func (z *Zone) ClosestDelegation(name string) (*ZoneData, bool) {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	zd := z.delegation(name)
+	return zd, zd != nil
+}
+
+// delegation returns the node with NS records closest to the apex, but not
+// the apex, of name and its parents, or nil. The caller must hold the
+// zone's read lock.
+func (z *Zone) delegation(name string) (cut *ZoneData) {
+	labels := SplitLabels(name)
+	for i := 0; i < len(labels); i++ {
+		a := strings.Join(labels[i:], ".") + "."
+		if strings.EqualFold(a, z.Origin) || !IsSubDomain(z.Origin, a) {
+			break
+		}
+		if n, e := z.Radix.Find(toRadixName(a)); e {
+			zd := n.Value.(*ZoneData)
+			zd.mutex.RLock()
+			_, ok := zd.RR[TypeNS]
+			zd.mutex.RUnlock()
+			if ok {
+				cut = zd
+			}
+		}
+	}
+	return cut
+}
+
+// synthesize returns a copy of the wildcard node zd with all owner names
+// set to name.
+func (zd *ZoneData) synthesize(name string) *ZoneData {
+	zd.mutex.RLock()
+	defer zd.mutex.RUnlock()
+	s := NewZoneData(name)
+	s.NonAuth = zd.NonAuth
+	for t, rrs := range zd.RR {
+		for _, r := range rrs {
+			c := r.Copy()
+			c.Header().Name = name
+			s.RR[t] = append(s.RR[t], c)
+		}
+	}
+	for t, sigs := range zd.Signatures {
+		for _, r := range sigs {
+			c := r.Copy().(*RR_RRSIG)
+			c.Hdr.Name = name
+			s.Signatures[t] = append(s.Signatures[t], c)
+		}
+	}
+	return s
+}
+
+// maxCnameChain is the number of CNAMEs Lookup follows.
+const maxCnameChain = 8
+
+// Lookup returns the records of type qtype for name. When name has a
+// CNAME record instead, the CNAME is added to the answer and its target
+// is looked up, as long as the target is in the zone. Wildcards are used
+// as with FindWildcard. When the CNAMEs form a loop, or the chain is longer
+// than 8 CNAMEs, the answer up to that point is returned together with
+// ErrCnameLoop. An empty answer means there are no such records. For
+// TypeANY all RRsets at name are returned, ordered by type, and CNAMEs are
+// not followed.
+func (z *Zone) Lookup(name string, qtype uint16) (answer []RR, err error) {
+	return z.lookup(name, qtype, false)
+}
+
+// LookupSigned works like Lookup, but each RRset in the answer is followed
+// by its RRSIGs. Use it when the query has the DO bit set:
+//
+//	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+//		answer, err = z.LookupSigned(name, qtype)
+//	}
+func (z *Zone) LookupSigned(name string, qtype uint16) (answer []RR, err error) {
+	return z.lookup(name, qtype, true)
+}
+
+func (z *Zone) lookup(name string, qtype uint16, signed bool) (answer []RR, err error) {
+	seen := make(map[string]bool)
+	for i := 0; i <= maxCnameChain; i++ {
+		key := toRadixName(name)
+		if seen[key] {
+			return answer, ErrCnameLoop
+		}
+		seen[key] = true
+		node, exact, wildcard := z.FindWildcard(name)
+		if !exact && !wildcard {
+			return answer, nil
+		}
+		node.mutex.RLock()
+		if qtype == TypeANY {
+			answer = node.all(answer, signed)
+			node.mutex.RUnlock()
+			return answer, nil
+		}
+		// The records are copied to answer before the node is unlocked.
+		rrs, ok := node.RR[qtype]
+		t := qtype
+		if ok {
+			answer = append(answer, rrs...)
+		} else if cname := node.RR[TypeCNAME]; len(cname) > 0 {
+			t = TypeCNAME
+			answer = append(answer, cname[0])
+			name = cname[0].(*RR_CNAME).Target
+		} else {
+			node.mutex.RUnlock()
+			return answer, nil
+		}
+		if signed {
+			for _, s := range node.Signatures[t] {
+				answer = append(answer, s)
+			}
+		}
+		node.mutex.RUnlock()
+		if ok || !IsSubDomain(z.Origin, name) {
+			return answer, nil
+		}
+	}
+	return answer, ErrCnameLoop
+}
+
+// all appends the RRsets of zd to answer, ordered by type and each followed
+// by its RRSIGs when signed is true. The caller must hold the lock of zd.
+func (zd *ZoneData) all(answer []RR, signed bool) []RR {
+	types := make([]uint16, 0, len(zd.RR))
+	for t := range zd.RR {
+		types = append(types, t)
+	}
+	sort.Sort(uint16Slice(types))
+	for _, t := range types {
+		answer = append(answer, zd.RR[t]...)
+		if signed {
+			for _, s := range zd.Signatures[t] {
+				answer = append(answer, s)
+			}
+		}
+	}
+	return answer
+}
+
+// Glue returns the A and AAAA records of the nameservers of the
+// delegation at name, as far as these nameservers are below name and
+// their addresses are in the zone. Nameservers outside the delegated zone
+// need no glue. Nil is returned when name has no NS records.
+func (z *Zone) Glue(name string) (glue []RR) {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	for _, ns := range z.rrset(name, TypeNS) {
+		target := ns.(*RR_NS).Ns
+		if !IsSubDomain(name, target) {
+			continue
+		}
+		glue = append(glue, z.rrset(target, TypeA)...)
+		glue = append(glue, z.rrset(target, TypeAAAA)...)
+	}
+	return glue
+}
+
+// rrset returns the records of type t at name. The caller must hold
+// the zone's read lock.
+func (z *Zone) rrset(name string, t uint16) []RR {
+	n, e := z.Radix.Find(toRadixName(name))
+	if !e {
+		return nil
+	}
+	zd := n.Value.(*ZoneData)
+	zd.mutex.RLock()
+	defer zd.mutex.RUnlock()
+	return append([]RR(nil), zd.RR[t]...)
+}
+
+// Referral returns a reply to req referring to the delegation at name:
+// the reply is not authoritative, has the NS records of name in the
+// authority section and their glue, see Glue, in the additional section.
+func (z *Zone) Referral(req *Msg, name string) *Msg {
+	m := new(Msg)
+	m.SetReply(req)
+	m.Authoritative = false
+	z.mutex.RLock()
+	m.Ns = z.rrset(name, TypeNS)
+	z.mutex.RUnlock()
+	m.Extra = z.Glue(name)
+	return m
+}
+
+// NegativeResponse returns an authoritative reply to req saying there is
+// no such name, NXDOMAIN, when nxdomain is true, or that the name has no
+// records of the requested type (NODATA) otherwise. The zone's SOA record
+// is put in the authority section, with the smaller of its TTL and its
+// minimum field as the TTL, so resolvers cache the negative answer that
+// long (RFC 2308, section 3). When the zone has no SOA record the
+// authority section is empty.
+func (z *Zone) NegativeResponse(req *Msg, nxdomain bool) *Msg {
+	m := new(Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	if nxdomain {
+		m.Rcode = RcodeNameError
+	}
+	if soa := z.SOA(); soa != nil {
+		neg := soa.Copy().(*RR_SOA)
+		if neg.Minttl < neg.Hdr.Ttl {
+			neg.Hdr.Ttl = neg.Minttl
+		}
+		m.Ns = []RR{neg}
+	}
+	return m
+}
+
+// Answer returns the reply to the query req from the data in the zone,
+// with the AA bit set as it should be: an answer from the zone, or a
+// negative one, see NegativeResponse, is authoritative, a referral to a
+// delegation, see Referral, is not. A query for a name outside the zone
+// gets REFUSED. When req has the DO bit set the RRSIGs are included, see
+// LookupSigned. Typical use:
+//
+//	dns.HandleFunc("miek.nl.", func(w dns.ResponseWriter, r *dns.Msg) {
+//		w.Write(z.Answer(r))
+//	})
+func (z *Zone) Answer(req *Msg) *Msg {
+	if len(req.Question) != 1 {
+		return new(Msg).SetRcodeFormatError(req)
+	}
+	q := req.Question[0]
+	name := Fqdn(q.Name)
+	if !IsSubDomain(z.Origin, name) {
+		return new(Msg).SetRcodeRefused(req)
+	}
+	// The DS records of a delegation are in the parent, this zone.
+	if cut, ok := z.ClosestDelegation(name); ok && (q.Qtype != TypeDS || !strings.EqualFold(cut.Name, name)) {
+		return z.Referral(req, cut.Name)
+	}
+	opt := req.IsEdns0()
+	answer, err := z.lookup(name, q.Qtype, opt != nil && opt.Do())
+	if err != nil {
+		return new(Msg).SetRcode(req, RcodeServerFailure)
+	}
+	if len(answer) == 0 {
+		_, exact, wildcard := z.FindWildcard(name)
+		_, match := z.FindMatch(name)
+		return z.NegativeResponse(req, !exact && !wildcard && match == MatchNone)
+	}
+	m := new(Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = answer
+	return m
+}
+
+// Walk calls fn for every owner name in the zone, in canonical order
+// (RFC 4034 6.1), which starts with the apex and puts names after their
+// parents. When fn returns an error the walk stops and the error is
+// returned. The zone is not locked while fn runs, so fn may change it.
+func (z *Zone) Walk(fn func(name string, data *ZoneData) error) error {
+	z.mutex.RLock()
+	var nodes []*ZoneData
+	z.Radix.Do(func(i interface{}) {
+		nodes = append(nodes, i.(*ZoneData))
+	})
+	z.mutex.RUnlock()
+	sort.Sort(canonicalOrder(nodes))
+	for _, zd := range nodes {
+		if err := fn(zd.Name, zd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FindFunc works like Find, but the function f is executed on
 // each node which has a non-nil Value during the tree traversal.
 // If f returns true, that node is returned.
@@ -517,6 +1316,306 @@ func (node *ZoneData) Sign(next *ZoneData, keys map[*RR_DNSKEY]PrivateKey, keyta
 	return nil
 }
 
+// SignOptions holds the parameters for SignRRsets.
+type SignOptions struct {
+	// Inception and Expiration set the validity window of the signatures.
+	// When Inception is zero, the current time minus 300 seconds is used,
+	// when Expiration is zero, Inception plus 4 weeks is used.
+	Inception  time.Time
+	Expiration time.Time
+}
+
+// SignRRsets signs every authoritative RRset in the zone with the key priv,
+// DNSKEY key being its public part. The RRSIGs are stored in the Signatures
+// of each node, replacing older signatures made with the same key. At a
+// delegation only the DS and NSEC RRsets are signed, records below it are
+// not signed at all. Unlike Sign, no NSEC records are added and the zone is
+// signed in the calling goroutine, which makes it usable for zones that
+// change often, for instance after each Change. See LookupSigned for
+// getting the signatures back.
+func (z *Zone) SignRRsets(key *RR_DNSKEY, priv PrivateKey, opts SignOptions) error {
+	if key == nil || priv == nil {
+		return ErrPrivKey
+	}
+	inception := opts.Inception
+	if inception.IsZero() {
+		inception = time.Now().UTC().Add(-300 * time.Second)
+	}
+	expiration := opts.Expiration
+	if expiration.IsZero() {
+		expiration = inception.Add(4 * 7 * 24 * time.Hour)
+	}
+	if !expiration.After(inception) {
+		return &Error{Err: "signature expiration before inception"}
+	}
+	keytag := key.KeyTag()
+
+	z.Lock()
+	defer z.Unlock()
+	var nodes []*ZoneData
+	z.Radix.Do(func(i interface{}) {
+		nodes = append(nodes, i.(*ZoneData))
+	})
+	for _, node := range nodes {
+		if z.occluded(node.Name) {
+			continue
+		}
+		cut := z.delegated(node.Name)
+		node.mutex.Lock()
+		for t, rrset := range node.RR {
+			if len(rrset) == 0 || cut && t != TypeDS && t != TypeNSEC {
+				continue
+			}
+			s := new(RR_RRSIG)
+			s.Hdr.Ttl = rrset[0].Header().Ttl
+			s.SignerName = z.Origin
+			s.Algorithm = key.Algorithm
+			s.KeyTag = keytag
+			s.Inception = timeToUint32(inception)
+			s.Expiration = timeToUint32(expiration)
+			if e := s.Sign(priv, rrset); e != nil {
+				node.mutex.Unlock()
+				return e
+			}
+			var sigs []*RR_RRSIG
+			for _, old := range node.Signatures[t] {
+				if old.KeyTag != keytag || old.Algorithm != key.Algorithm {
+					sigs = append(sigs, old)
+				}
+			}
+			node.Signatures[t] = append(sigs, s)
+		}
+		node.mutex.Unlock()
+	}
+	return nil
+}
+
+// occluded returns true if name is below a delegation in the zone,
+// i.e. it is glue or other data the zone is not authoritative for.
+// The caller must hold the zone's read lock.
+func (z *Zone) occluded(name string) bool {
+	return z.delegated(name) && z.delegated(parentName(name))
+}
+
+// canonicalNames returns the authoritative nodes of the zone, including
+// the delegation points but not the NSEC3 records added by GenerateNSEC3,
+// in canonical order. The caller must hold the
+// zone's read lock.
+func (z *Zone) canonicalNames() []*ZoneData {
+	var nodes []*ZoneData
+	z.Radix.Do(func(i interface{}) {
+		zd := i.(*ZoneData)
+		if _, hashed := zd.RR[TypeNSEC3]; !hashed && !z.occluded(zd.Name) && len(zd.RR) > 0 {
+			nodes = append(nodes, zd)
+		}
+	})
+	sort.Sort(canonicalOrder(nodes))
+	return nodes
+}
+
+type canonicalOrder []*ZoneData
+
+func (p canonicalOrder) Len() int           { return len(p) }
+func (p canonicalOrder) Less(i, j int) bool { return canonicalLess(p[i].Name, p[j].Name) }
+func (p canonicalOrder) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// GenerateNSEC adds an NSEC record to every owner name in the zone,
+// replacing existing ones. The records form a chain in canonical order,
+// the last one pointing back to the apex, and list the types at
+// the name plus RRSIG and NSEC. Names below a delegation are not part
+// of the chain and empty non-terminals get no NSEC, as in RFC 4035.
+// The TTL is the SOA's minimum TTL. The NSEC records are not signed,
+// call SignRRsets afterwards.
+func (z *Zone) GenerateNSEC() error {
+	z.Lock()
+	defer z.Unlock()
+	soa := z.apexSOA()
+	if soa == nil {
+		return ErrSoa
+	}
+	nodes := z.canonicalNames()
+	for i, node := range nodes {
+		next := nodes[(i+1)%len(nodes)]
+		nsec := new(RR_NSEC)
+		nsec.Hdr = RR_Header{Name: node.Name, Rrtype: TypeNSEC, Class: ClassINET, Ttl: soa.Minttl}
+		nsec.NextDomain = next.Name
+		node.mutex.Lock()
+		for t, _ := range node.RR {
+			if t != TypeNSEC && t != TypeRRSIG {
+				nsec.TypeBitMap = append(nsec.TypeBitMap, t)
+			}
+		}
+		nsec.TypeBitMap = append(nsec.TypeBitMap, TypeRRSIG, TypeNSEC)
+		sort.Sort(uint16Slice(nsec.TypeBitMap))
+		node.RR[TypeNSEC] = []RR{nsec}
+		delete(node.Signatures, TypeNSEC)
+		node.mutex.Unlock()
+	}
+	return nil
+}
+
+// GenerateNSEC3 adds an NSEC3 chain, RFC 5155, to the zone, replacing one
+// made by an earlier call. Every owner name and every empty non-terminal is
+// hashed with SHA1, using salt (in hex) and iterations, and gets an NSEC3
+// record under the apex; the records point to each other in hash order.
+// An NSEC3PARAM record is added to the apex. With optOut, delegations
+// without a DS record are left out of the chain and the opt-out flag is
+// set. The TTL is the SOA's minimum TTL. Call SignRRsets afterwards to sign
+// the records, and see NSEC3Proof for using them in answers.
+func (z *Zone) GenerateNSEC3(salt string, iterations uint16, optOut bool) error {
+	z.Lock()
+	defer z.Unlock()
+	soa := z.apexSOA()
+	if soa == nil {
+		return ErrSoa
+	}
+	for _, n := range z.nsec3 {
+		z.Radix.Remove(toRadixName(n.Hdr.Name))
+	}
+	z.nsec3 = nil
+
+	param := new(RR_NSEC3PARAM)
+	param.Hdr = RR_Header{Name: z.Origin, Rrtype: TypeNSEC3PARAM, Class: ClassINET, Ttl: 0}
+	param.Hash = SHA1
+	param.Iterations = iterations
+	param.SaltLength = uint8(len(salt) / 2)
+	param.Salt = salt
+	var flags uint8
+	if optOut {
+		flags = 1 // opt-out
+	}
+
+	// The names to hash, nil values are empty non-terminals.
+	names := make(map[string]*ZoneData)
+	for _, zd := range z.canonicalNames() {
+		key := strings.ToLower(zd.Name)
+		zd.mutex.Lock()
+		if key == strings.ToLower(z.Origin) {
+			zd.RR[TypeNSEC3PARAM] = []RR{param}
+		}
+		_, ds := zd.RR[TypeDS]
+		zd.mutex.Unlock()
+		if optOut && !ds && key != strings.ToLower(z.Origin) && z.delegated(zd.Name) {
+			continue
+		}
+		names[key] = zd
+		for p := parentName(key); IsSubDomain(z.Origin, p) && p != strings.ToLower(z.Origin); p = parentName(p) {
+			if _, ok := names[p]; !ok {
+				names[p] = nil
+			}
+		}
+	}
+	for name, zd := range names {
+		n := new(RR_NSEC3)
+		n.Hdr = RR_Header{Name: strings.ToLower(HashName(name, SHA1, iterations, salt)) + "." + z.Origin,
+			Rrtype: TypeNSEC3, Class: ClassINET, Ttl: soa.Minttl}
+		n.Hash = SHA1
+		n.Flags = flags
+		n.Iterations = iterations
+		n.SaltLength = param.SaltLength
+		n.Salt = salt
+		n.HashLength = 20 // SHA1
+		if zd != nil {
+			cut := z.delegated(zd.Name)
+			zd.mutex.RLock()
+			for t, _ := range zd.RR {
+				if t != TypeNSEC && t != TypeRRSIG {
+					n.TypeBitMap = append(n.TypeBitMap, t)
+				}
+			}
+			if _, ds := zd.RR[TypeDS]; ds || !cut {
+				n.TypeBitMap = append(n.TypeBitMap, TypeRRSIG)
+			}
+			zd.mutex.RUnlock()
+			sort.Sort(uint16Slice(n.TypeBitMap))
+		}
+		z.nsec3 = append(z.nsec3, n)
+	}
+	sort.Sort(nsec3Order(z.nsec3))
+	for i, n := range z.nsec3 {
+		next := z.nsec3[(i+1)%len(z.nsec3)]
+		n.NextDomain = strings.ToUpper(nsec3Hash(next))
+		zd := NewZoneData(n.Hdr.Name)
+		zd.RR[TypeNSEC3] = []RR{n}
+		z.Radix.Insert(toRadixName(n.Hdr.Name), zd)
+	}
+	return nil
+}
+
+// nsec3Hash returns the hashed owner name of n, in lowercase.
+func nsec3Hash(n *RR_NSEC3) string {
+	return strings.ToLower(n.Hdr.Name[:strings.Index(n.Hdr.Name, ".")])
+}
+
+type nsec3Order []*RR_NSEC3
+
+func (p nsec3Order) Len() int           { return len(p) }
+func (p nsec3Order) Less(i, j int) bool { return nsec3Hash(p[i]) < nsec3Hash(p[j]) }
+func (p nsec3Order) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// NSEC3Proof returns the NSEC3 records from the chain made by GenerateNSEC3
+// that prove that name does not exist: the record matching the closest
+// encloser, the one covering the next closer name and the one covering
+// the wildcard at the closest encloser, see RFC 5155, section 7.2.2.
+// Their RRSIGs follow them. Nil is returned when the zone has no NSEC3 chain.
+func (z *Zone) NSEC3Proof(name string) []RR {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+	name = strings.ToLower(Fqdn(name))
+	if len(z.nsec3) == 0 || !IsSubDomain(z.Origin, name) {
+		return nil
+	}
+	ce, nc := parentName(name), name
+	for ce != strings.ToLower(z.Origin) && !z.exists(ce) {
+		ce, nc = parentName(ce), ce
+	}
+	var proof []RR
+	done := make(map[*RR_NSEC3]bool)
+	for i, s := range []string{ce, nc, "*." + ce} {
+		n, match := z.nsec3Find(s)
+		if (i == 0) != match || done[n] {
+			continue
+		}
+		done[n] = true
+		proof = append(proof, n)
+		if node, e := z.Radix.Find(toRadixName(n.Hdr.Name)); e {
+			zd := node.Value.(*ZoneData)
+			zd.mutex.RLock()
+			for _, sig := range zd.Signatures[TypeNSEC3] {
+				proof = append(proof, sig)
+			}
+			zd.mutex.RUnlock()
+		}
+	}
+	return proof
+}
+
+// nsec3Find returns the NSEC3 record matching name, or when there is none,
+// the record covering it. The caller must hold the zone's read lock.
+func (z *Zone) nsec3Find(name string) (n *RR_NSEC3, match bool) {
+	n3 := z.nsec3[0]
+	h := strings.ToLower(HashName(name, n3.Hash, n3.Iterations, n3.Salt))
+	i := sort.Search(len(z.nsec3), func(i int) bool { return nsec3Hash(z.nsec3[i]) >= h })
+	if i < len(z.nsec3) && nsec3Hash(z.nsec3[i]) == h {
+		return z.nsec3[i], true
+	}
+	if i == 0 {
+		// Wraps around to the last record
+		i = len(z.nsec3)
+	}
+	return z.nsec3[i-1], false
+}
+
+// parentName returns the name with its first label removed, the
+// parent of the root is the root.
+func parentName(name string) string {
+	labels := SplitLabels(name)
+	if len(labels) < 2 {
+		return "."
+	}
+	return strings.Join(labels[1:], ".") + "."
+}
+
 // timeToUint32 translates a time.Time to a 32 bit value which                      
 // can be used as the RRSIG's inception or expiration times.
 func timeToUint32(t time.Time) uint32 {
@@ -1,7 +1,13 @@
 package dns
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRadixName(t *testing.T) {
@@ -10,6 +16,9 @@ func TestRadixName(t *testing.T) {
 		"miek.nl.":     ".nl.miek",
 		"mi\\.ek.nl.":  ".nl.mi\\.ek",
 		`mi\\.ek.nl.`:  `.nl.ek.mi\\`,
+		`mi\\\.ek.nl.`: `.nl.mi\\\.ek`,
+		`mi\046ek.nl.`: `.nl.mi\046ek`,
+		`\\.\.\046.NL`: `.nl.\.\046.\\`,
 		"":             "."}
 	for i, o := range tests {
 		t.Logf("%s %v\n", i, SplitLabels(i))
@@ -17,10 +26,1316 @@ func TestRadixName(t *testing.T) {
 			t.Logf("%s should convert to %s, not %s\n", i, o, x)
 			t.Fail()
 		}
+		// reversing the labels again gives the (lowercased) name
+		if i == "" {
+			continue
+		}
+		l := SplitLabels(o[1:])
+		for j := 0; j < len(l)/2; j++ {
+			l[j], l[len(l)-1-j] = l[len(l)-1-j], l[j]
+		}
+		if x := strings.Join(l, ".") + "."; x != strings.ToLower(Fqdn(i)) && i != "." {
+			t.Logf("%s should convert back to %s, not %s\n", o, strings.ToLower(i), x)
+			t.Fail()
+		}
 	}
 }
 
 func TestInsert(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"a.miek.nl. 3600 IN A 127.0.0.1",
+		"a.miek.nl. 3600 IN A 127.0.0.2",
+		"b.miek.nl. 3600 IN A 127.0.0.1",
+		"b.miek.nl. 1800 IN A 127.0.0.1",
+		"b.miek.nl. 3600 IN MX 10 a.miek.nl.",
+	} {
+		r, _ := NewRR(s)
+		if err := z.Insert(r); err != nil {
+			t.Fatalf("Failed to insert %s: %s", s, err.Error())
+		}
+	}
+	tests := []struct {
+		name  string
+		t     uint16
+		count int
+	}{
+		{"a.miek.nl.", TypeA, 2},
+		{"b.miek.nl.", TypeA, 1},
+		{"b.miek.nl.", TypeMX, 1},
+	}
+	for _, tc := range tests {
+		zd, exact := z.Find(tc.name)
+		if !exact || len(zd.RR[tc.t]) != tc.count {
+			t.Logf("Expected an RRset of %d records for %s/%d, got %v", tc.count, tc.name, tc.t, zd)
+			t.Fail()
+		}
+	}
+	r, _ := NewRR("miek.org. 3600 IN A 127.0.0.1")
+	if z.Insert(r) == nil {
+		t.Log("Expected an error inserting out of zone data")
+		t.Fail()
+	}
 }
 func TestRemove(t *testing.T) {
+	z := newTestZone(t, 0)
+	mx, _ := NewRR("foo.miek.nl. 3600 IN MX 10 mx.miek.nl.")
+	a, _ := NewRR("bar.foo.miek.nl. 3600 IN A 127.0.0.1")
+	z.Insert(mx)
+	z.Insert(a)
+	if zd, exact := z.Find("foo.miek.nl."); !exact || zd.RR[TypeMX][0] != mx {
+		t.Fatal("Failed to find the MX record")
+	}
+
+	// Removing a record that is not in the zone changes nothing.
+	other, _ := NewRR("foo.miek.nl. 3600 IN MX 20 mx.miek.nl.")
+	missing, _ := NewRR("baz.miek.nl. 3600 IN MX 10 mx.miek.nl.")
+	z.Remove(other)
+	z.Remove(missing)
+	if zd, exact := z.Find("foo.miek.nl."); !exact || len(zd.RR[TypeMX]) != 1 {
+		t.Fatal("Removing a non-existent record changed the zone")
+	}
+
+	// A copy of the record, with another TTL, will do.
+	mx, _ = NewRR("foo.miek.nl. 300 IN MX 10 mx.miek.nl.")
+	z.Remove(mx)
+	if zd, exact := z.Find("foo.miek.nl."); exact {
+		t.Logf("Expected foo.miek.nl. to be removed, found %v", zd)
+		t.Fail()
+	} else if zd == nil || zd.Name != "miek.nl." {
+		t.Logf("Expected the apex to be the closest match, got %v", zd)
+		t.Fail()
+	}
+	if zd, exact := z.Find("bar.foo.miek.nl."); !exact || len(zd.RR[TypeA]) != 1 {
+		t.Log("Expected bar.foo.miek.nl. to be left alone")
+		t.Fail()
+	}
+	if zd, exact := z.Find("miek.nl."); !exact || len(zd.RR[TypeSOA]) != 1 || len(zd.RR[TypeNS]) != 1 {
+		t.Log("Expected the apex to be left alone")
+		t.Fail()
+	}
+}
+
+func newTestZone(t *testing.T, hosts int) *Zone {
+	z := NewZone("miek.nl.")
+	soa, _ := NewRR("miek.nl. 3600 IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400")
+	ns, _ := NewRR("miek.nl. 3600 IN NS open.nlnetlabs.nl.")
+	z.Insert(soa)
+	z.Insert(ns)
+	for i := 0; i < hosts; i++ {
+		a, err := NewRR("host" + strconv.Itoa(i) + ".miek.nl. 3600 IN A 127.0.0.1")
+		if err != nil {
+			t.Fatalf("Failed to parse RR: %s", err.Error())
+		}
+		z.Insert(a)
+	}
+	return z
+}
+
+func TestTransfer(t *testing.T) {
+	// enough records to need more than one message
+	z := newTestZone(t, 3000)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		if err := z.Transfer(w, r); err != nil {
+			t.Logf("Transfer failed: %s", err.Error())
+		}
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	c := new(Client)
+	c.Net = "tcp"
+	m := new(Msg)
+	m.SetAxfr("miek.nl.")
+	tokens, err := c.XfrReceive(m, serverAddr(srv))
+	if err != nil {
+		t.Fatalf("Failed to start transfer: %s", err.Error())
+	}
+	in := NewZone("miek.nl.")
+	envelopes, n := 0, 0
+	for x := range tokens {
+		if x.Error != nil {
+			t.Fatalf("Transfer failed: %s", x.Error.Error())
+		}
+		envelopes++
+		for _, r := range x.RR {
+			n++
+			if r.Header().Rrtype == TypeSOA && n > 1 {
+				continue // the closing SOA
+			}
+			in.Insert(r)
+		}
+	}
+	if envelopes < 2 {
+		t.Logf("Expected the transfer to use multiple messages, got %d", envelopes)
+		t.Fail()
+	}
+	if n != 3000+3 {
+		t.Logf("Expected %d records, got %d", 3000+3, n)
+		t.Fail()
+	}
+	for _, name := range []string{"miek.nl.", "host0.miek.nl.", "host2999.miek.nl."} {
+		got, _ := in.Find(name)
+		want, _ := z.Find(name)
+		if got == nil || len(got.RR) != len(want.RR) {
+			t.Logf("Transferred zone differs at %s", name)
+			t.Fail()
+		}
+	}
+
+	// Not over UDP, RecordingResponseWriter has a UDP remote address by default
+	w := new(RecordingResponseWriter)
+	if err := z.Transfer(w, m); err == nil || !lastMsg(w).Truncated {
+		t.Log("AXFR over UDP should be answered with TC set")
+		t.Fail()
+	}
+	// Nor over HTTPS, where only one reply can be written
+	hw := &httpResponse{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	if err := z.Transfer(hw, m); err == nil || hw.buf == nil {
+		t.Fatal("AXFR over HTTPS should be refused")
+	}
+	if r := new(Msg); r.Unpack(hw.buf) != nil || r.Rcode != RcodeRefused {
+		t.Logf("AXFR over HTTPS should get REFUSED, got %v", r)
+		t.Fail()
+	}
+}
+
+func TestTransferIn(t *testing.T) {
+	z := newTestZone(t, 3000)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		z.Transfer(w, r)
+	})
+	secret := map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h, TsigSecret: secret}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	addr := serverAddr(srv)
+
+	for _, tsig := range []bool{false, true} {
+		tr := new(Transfer)
+		m := new(Msg)
+		m.SetAxfr("miek.nl.")
+		if tsig {
+			tr.TsigSecret = secret
+			m.SetTsig("axfr.", HmacMD5, 300, time.Now().Unix())
+		}
+		c, err := tr.In(m, addr)
+		if err != nil {
+			t.Fatalf("Failed to start transfer: %s", err.Error())
+		}
+		in := NewZone("miek.nl.")
+		envelopes, n := 0, 0
+		for e := range c {
+			if e.Error != nil {
+				t.Fatalf("Transfer with TSIG %t failed: %s", tsig, e.Error.Error())
+			}
+			envelopes++
+			for _, r := range e.RR {
+				n++
+				if r.Header().Rrtype == TypeSOA && n > 1 {
+					continue // the closing SOA
+				}
+				in.Insert(r)
+			}
+		}
+		if envelopes < 2 || n != 3000+3 {
+			t.Logf("Expected %d records in multiple messages, got %d in %d", 3000+3, n, envelopes)
+			t.Fail()
+		}
+		for _, name := range []string{"miek.nl.", "host0.miek.nl.", "host2999.miek.nl."} {
+			got, _ := in.Find(name)
+			want, _ := z.Find(name)
+			if got == nil || len(got.RR) != len(want.RR) {
+				t.Logf("Transferred zone differs at %s", name)
+				t.Fail()
+			}
+		}
+	}
+
+	// a zone the server does not have
+	m := new(Msg)
+	m.SetAxfr("example.org.")
+	c, err := new(Transfer).In(m, addr)
+	if err != nil {
+		t.Fatalf("Failed to start transfer: %s", err.Error())
+	}
+	if e := <-c; e.Error == nil {
+		t.Log("Expected the transfer of an unknown zone to fail")
+		t.Fail()
+	}
+	if _, ok := <-c; ok {
+		t.Log("Expected the channel to be closed after an error")
+		t.Fail()
+	}
+}
+
+func TestTransferTsigName(t *testing.T) {
+	z := newTestZone(t, 10)
+	status := make(chan error, 1)
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		status <- w.TsigStatus()
+		z.Transfer(w, r)
+	})
+	secret := map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h, TsigSecret: secret}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+
+	// The empty algorithm is HmacSHA256.
+	for _, alg := range []string{"", HmacSHA512} {
+		m := new(Msg)
+		m.SetAxfr("miek.nl.")
+		tr := &Transfer{TsigSecret: secret, TsigName: "axfr.", TsigAlgorithm: alg}
+		c, err := tr.In(m, serverAddr(srv))
+		if err != nil {
+			t.Fatalf("Failed to start transfer: %s", err.Error())
+		}
+		n := 0
+		for e := range c {
+			if e.Error != nil {
+				t.Fatalf("Transfer with %q failed: %s", alg, e.Error.Error())
+			}
+			n += len(e.RR)
+		}
+		if err := <-status; err != nil || n != 10+3 {
+			t.Logf("Expected a verified request with %q and %d records, got %v and %d", alg, 10+3, err, n)
+			t.Fail()
+		}
+		if m.IsTsig() != nil {
+			t.Log("The request should not be changed")
+			t.Fail()
+		}
+	}
+}
+
+func TestTransferTsigErrors(t *testing.T) {
+	z := newTestZone(t, 10)
+	tests := []struct {
+		name   string
+		net    string
+		status error
+		rcode  int
+		tsig   uint16
+	}{
+		{"example.org.", "tcp", nil, RcodeNotAuth, 0},
+		{"miek.nl.", "udp", nil, RcodeSuccess, 0},
+		{"miek.nl.", "https", nil, RcodeRefused, 0},
+		{"miek.nl.", "tcp", ErrSig, RcodeNotAuth, RcodeBadSig},
+		{"miek.nl.", "tcp", ErrKeyName, RcodeNotAuth, RcodeBadKey},
+		{"miek.nl.", "tcp", ErrTime, RcodeNotAuth, RcodeBadTime},
+	}
+	for _, tc := range tests {
+		m := new(Msg)
+		m.SetAxfr(tc.name)
+		m.SetTsig("axfr.", HmacSHA256, 300, time.Now().Unix())
+		w := &RecordingResponseWriter{Net: tc.net, Tsig: tc.status}
+		if err := z.Transfer(w, m); err == nil {
+			t.Fatalf("Expected the transfer of %s over %s with %v to fail", tc.name, tc.net, tc.status)
+		}
+		r := lastMsg(w)
+		if tsig := r.IsTsig(); r.Rcode != tc.rcode || tsig == nil || tsig.Error != tc.tsig {
+			t.Logf("Expected rcode %d and TSIG error %d for %s over %s with %v, got %v", tc.rcode, tc.tsig, tc.name, tc.net, tc.status, r)
+			t.Fail()
+		}
+	}
+}
+
+func TestTransferInSlowStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err.Error())
+	}
+	defer l.Close()
+	// serve answers one AXFR, write sends the length and the reply.
+	serve := func(write func(net.Conn, []byte)) {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, err := readTCP(conn)
+		if err != nil {
+			return
+		}
+		req := new(Msg)
+		req.Unpack(buf)
+		soa, _ := NewRR("miek.nl. 3600 IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400")
+		a, _ := NewRR("www.miek.nl. 3600 IN A 127.0.0.1")
+		m := new(Msg)
+		m.SetReply(req)
+		m.Answer = []RR{soa, a, soa}
+		out, _ := m.Pack()
+		a1, b1 := packUint16(uint16(len(out)))
+		write(conn, append([]byte{a1, b1}, out...))
+	}
+	m := new(Msg)
+	m.SetAxfr("miek.nl.")
+
+	// Byte by byte, the length prefix as well.
+	go serve(func(c net.Conn, b []byte) {
+		for i := range b {
+			c.Write(b[i : i+1])
+			time.Sleep(time.Millisecond)
+		}
+	})
+	c, err := new(Transfer).In(m, l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to start transfer: %s", err.Error())
+	}
+	n := 0
+	for e := range c {
+		if e.Error != nil {
+			t.Fatalf("Transfer failed: %s", e.Error.Error())
+		}
+		n += len(e.RR)
+	}
+	if n != 3 {
+		t.Logf("Expected 3 records, got %d", n)
+		t.Fail()
+	}
+
+	// Half a message and then nothing: the timeout is returned.
+	stall := make(chan bool)
+	defer close(stall)
+	go serve(func(c net.Conn, b []byte) {
+		c.Write(b[:len(b)/2])
+		<-stall
+	})
+	tr := &Transfer{ReadTimeout: 100 * time.Millisecond}
+	if c, err = tr.In(m, l.Addr().String()); err != nil {
+		t.Fatalf("Failed to start transfer: %s", err.Error())
+	}
+	select {
+	case e := <-c:
+		if e == nil || !isTimeout(e.Error) {
+			t.Logf("Expected a timeout, got %v", e)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Transfer did not return after the timeout")
+	}
+}
+
+func TestTransferIncremental(t *testing.T) {
+	z := newTestZone(t, 10)
+	z.IXFRJournalSize = 5
+	soa2, _ := NewRR("miek.nl. 3600 IN SOA open.nlnetlabs.nl. miekg.atoom.net. 2 14400 3600 604800 86400")
+	del, _ := NewRR("host1.miek.nl. 60 IN A 127.0.0.1")
+	add, _ := NewRR("new.miek.nl. 3600 IN A 127.0.0.2")
+	if err := z.Change(soa2.(*RR_SOA), []RR{del}, []RR{add}); err != nil {
+		t.Fatalf("Failed to change zone: %s", err.Error())
+	}
+	if zd, _ := z.Find("host1.miek.nl."); len(zd.RR[TypeA]) != 0 {
+		t.Log("Deleted record is still in the zone")
+		t.Fail()
+	}
+
+	h := HandlerFunc(func(w ResponseWriter, r *Msg) {
+		if err := z.TransferIncremental(w, r, r.Ns[0].(*RR_SOA).Serial); err != nil {
+			t.Logf("Transfer failed: %s", err.Error())
+		}
+	})
+	srv := &Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: h}
+	go srv.ListenAndServe()
+	defer srv.Shutdown()
+	c := new(Client)
+	c.Net = "tcp"
+	transfer := func(serial uint32) (rrs []RR) {
+		m := new(Msg)
+		m.SetIxfr("miek.nl.", serial)
+		tokens, err := c.XfrReceive(m, serverAddr(srv))
+		if err != nil {
+			t.Fatalf("Failed to start transfer: %s", err.Error())
+		}
+		for x := range tokens {
+			if x.Error != nil {
+				t.Fatalf("Transfer failed: %s", x.Error.Error())
+			}
+			rrs = append(rrs, x.RR...)
+		}
+		return rrs
+	}
+
+	// The delta: SOA 2, SOA 1, deleted, SOA 2, added, SOA 2
+	rrs := transfer(1)
+	serials := []uint32{2, 1, 0, 2, 0, 2}
+	if len(rrs) != len(serials) {
+		t.Fatalf("Expected %d records in the incremental transfer, got %d: %v", len(serials), len(rrs), rrs)
+	}
+	for i, s := range serials {
+		soa, ok := rrs[i].(*RR_SOA)
+		if (s == 0) == ok || (ok && soa.Serial != s) {
+			t.Logf("Unexpected record %d in the incremental transfer: %s", i, rrs[i])
+			t.Fail()
+		}
+	}
+	if rrs[2].Header().Name != "host1.miek.nl." || rrs[4].Header().Name != "new.miek.nl." {
+		t.Logf("Wrong deleted or added record: %s, %s", rrs[2], rrs[4])
+		t.Fail()
+	}
+
+	// Up to date
+	if rrs := transfer(2); len(rrs) != 1 {
+		t.Logf("Expected a single SOA for an up to date client, got %v", rrs)
+		t.Fail()
+	}
+
+	// Unknown serial falls back to a full transfer
+	if rrs := transfer(42); len(rrs) != 10+3 {
+		t.Logf("Expected a full transfer of %d records, got %d", 10+3, len(rrs))
+		t.Fail()
+	}
+}
+
+func TestReadZone(t *testing.T) {
+	zone := `$ORIGIN miek.nl.
+@	IN	SOA	open.nlnetlabs.nl. miekg.atoom.net. (
+			1	; serial
+			14400	; refresh
+			3600	; retry
+			604800	; expire
+			86400 )	; minimum
+	IN	NS	open.nlnetlabs.nl.
+www	IN	A	127.0.0.1
+$TTL 300
+mx	IN	MX	10 www
+a.b.miek.nl. 60 IN A 127.0.0.2
+`
+	z, err := ReadZone(strings.NewReader(zone), "miek.nl.", 1800)
+	if err != nil {
+		t.Fatalf("Failed to read zone: %s", err.Error())
+	}
+	apex, _ := z.Find("miek.nl.")
+	if apex == nil || len(apex.RR[TypeSOA]) != 1 || len(apex.RR[TypeNS]) != 1 {
+		t.Fatal("Apex should have a SOA and a NS record")
+	}
+	if soa := apex.RR[TypeSOA][0].(*RR_SOA); soa.Serial != 1 || soa.Minttl != 86400 || soa.Hdr.Ttl != 1800 {
+		t.Logf("Multi-line SOA parsed wrong: %s", soa)
+		t.Fail()
+	}
+	ttls := map[string]uint32{"www.miek.nl.": 1800, "mx.miek.nl.": 300, "a.b.miek.nl.": 60}
+	for name, ttl := range ttls {
+		zd, exact := z.Find(name)
+		if !exact {
+			t.Logf("%s not found", name)
+			t.Fail()
+			continue
+		}
+		for _, rrs := range zd.RR {
+			if rrs[0].Header().Ttl != ttl {
+				t.Logf("%s should have TTL %d, got %d", name, ttl, rrs[0].Header().Ttl)
+				t.Fail()
+			}
+		}
+	}
+	if zd, _ := z.Find("mx.miek.nl."); zd.RR[TypeMX][0].(*RR_MX).Mx != "www.miek.nl." {
+		t.Log("Relative name in rdata should be completed with the origin")
+		t.Fail()
+	}
+
+	// $INCLUDE
+	f, err := ioutil.TempFile("", "zone")
+	if err != nil {
+		t.Fatalf("Failed to create file: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("included IN A 127.0.0.3\n")
+	f.Close()
+	z, err = ReadZone(strings.NewReader(zone+"$INCLUDE "+f.Name()+"\n"), "miek.nl.", 0)
+	if err != nil {
+		t.Fatalf("Failed to read zone with $INCLUDE: %s", err.Error())
+	}
+	if _, exact := z.Find("included.miek.nl."); !exact {
+		t.Log("Record from the included file not found")
+		t.Fail()
+	}
+
+	// Errors
+	if _, err := ReadZone(strings.NewReader(zone+"foo IN A bar\n"), "miek.nl.", 0); err == nil || !strings.Contains(err.Error(), "line: 14") {
+		t.Logf("Expected an error at line 14, got %v", err)
+		t.Fail()
+	}
+	if _, err := ReadZone(strings.NewReader("www.example.org. IN A 127.0.0.1\n"), "miek.nl.", 0); err == nil {
+		t.Log("Out of zone data should give an error")
+		t.Fail()
+	}
+}
+
+func TestWalk(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"www.miek.nl. IN A 127.0.0.1",
+		`a\.b.miek.nl. IN A 127.0.0.1`,
+		"miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400",
+		"a.www.miek.nl. IN A 127.0.0.1",
+		"b.miek.nl. IN A 127.0.0.1",
+		"a.miek.nl. IN A 127.0.0.1",
+		"a-b.miek.nl. IN A 127.0.0.1",
+		"x.a.miek.nl. IN A 127.0.0.1",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	expected := []string{"miek.nl.", "a.miek.nl.", "x.a.miek.nl.", "a-b.miek.nl.", `a\.b.miek.nl.`, "b.miek.nl.", "www.miek.nl.", "a.www.miek.nl."}
+	for i := 0; i < 2; i++ {
+		var names []string
+		z.Walk(func(name string, _ *ZoneData) error {
+			names = append(names, name)
+			return nil
+		})
+		if strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Logf("Walk order should be %v, got %v", expected, names)
+			t.Fail()
+		}
+	}
+
+	stop := &Error{Err: "stop"}
+	n := 0
+	err := z.Walk(func(name string, _ *ZoneData) error {
+		if n++; n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Logf("Walk should stop at the first error, got %v after %d names", err, n)
+		t.Fail()
+	}
+}
+
+func TestFindMatch(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400",
+		"www.miek.nl. IN A 127.0.0.2",
+		"a.b.miek.nl. IN A 127.0.0.3",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	tests := []struct {
+		name  string
+		match Match
+		node  string // the owner of the node returned
+	}{
+		{"www.miek.nl.", MatchExact, "www.miek.nl."},
+		{"a.b.miek.nl", MatchExact, "a.b.miek.nl."},
+		{"b.miek.nl.", MatchEmptyNonTerminal, "miek.nl."},
+		{"c.miek.nl.", MatchNone, "miek.nl."},
+		{"x.www.miek.nl.", MatchNone, "www.miek.nl."},
+		{"ab.miek.nl.", MatchNone, "miek.nl."},
+	}
+	for _, tc := range tests {
+		node, m := z.FindMatch(tc.name)
+		if m != tc.match || node == nil || node.Name != tc.node {
+			t.Logf("%s: expected match %d at %s, got %d at %v", tc.name, tc.match, tc.node, m, node)
+			t.Fail()
+		}
+	}
+}
+
+func TestFindWildcard(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400",
+		"*.miek.nl. IN A 127.0.0.1",
+		"*.miek.nl. IN TXT \"wildcard\"",
+		"www.miek.nl. IN A 127.0.0.2",
+		"a.b.miek.nl. IN A 127.0.0.3",
+		"sub.miek.nl. IN NS ns.sub.miek.nl.",
+		"*.sub.miek.nl. IN A 127.0.0.4",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	tests := []struct {
+		name            string
+		exact, wildcard bool
+	}{
+		{"foo.miek.nl.", false, true},
+		{"a.b.c.miek.nl.", false, true},  // multiple labels below the wildcard
+		{"www.miek.nl.", true, false},    // exact match
+		{"b.miek.nl.", false, false},     // empty non-terminal
+		{"x.b.miek.nl.", false, false},   // closest encloser b.miek.nl. has no wildcard
+		{"x.www.miek.nl.", false, false}, // closer name than the wildcard
+		{"sub.miek.nl.", true, false},    // the delegation itself
+		{"x.sub.miek.nl.", false, false}, // below the zone cut
+		{"x.example.org.", false, false}, // out of zone
+	}
+	for _, tc := range tests {
+		node, exact, wildcard := z.FindWildcard(tc.name)
+		if exact != tc.exact || wildcard != tc.wildcard {
+			t.Logf("%s: expected exact %v and wildcard %v, got %v and %v", tc.name, tc.exact, tc.wildcard, exact, wildcard)
+			t.Fail()
+			continue
+		}
+		if !wildcard {
+			continue
+		}
+		if node.Name != tc.name || len(node.RR[TypeA]) != 1 || len(node.RR[TypeTXT]) != 1 {
+			t.Logf("%s: wrong synthesized node %s", tc.name, node)
+			t.Fail()
+			continue
+		}
+		if node.RR[TypeA][0].Header().Name != tc.name {
+			t.Logf("%s: owner name not rewritten: %s", tc.name, node.RR[TypeA][0])
+			t.Fail()
+		}
+	}
+	// The wildcard itself must not change
+	if zd, _ := z.Find("*.miek.nl."); zd.RR[TypeA][0].Header().Name != "*.miek.nl." {
+		t.Log("Synthesizing changed the wildcard records")
+		t.Fail()
+	}
+}
+
+func TestLookup(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400",
+		"www.miek.nl. IN CNAME web.miek.nl.",
+		"web.miek.nl. IN CNAME host.miek.nl.",
+		"host.miek.nl. IN A 127.0.0.1",
+		"out.miek.nl. IN CNAME www.example.org.",
+		"loop.miek.nl. IN CNAME loop.miek.nl.",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	answer, err := z.Lookup("www.miek.nl.", TypeA)
+	if err != nil || len(answer) != 3 || answer[2].Header().Rrtype != TypeA {
+		t.Logf("Expected two CNAMEs and an A record, got %v, %v", answer, err)
+		t.Fail()
+	}
+	answer, err = z.Lookup("www.miek.nl.", TypeCNAME)
+	if err != nil || len(answer) != 1 {
+		t.Logf("A CNAME query should not chase, got %v, %v", answer, err)
+		t.Fail()
+	}
+	answer, err = z.Lookup("out.miek.nl.", TypeA)
+	if err != nil || len(answer) != 1 || answer[0].(*RR_CNAME).Target != "www.example.org." {
+		t.Logf("Out of zone target should stop the chase, got %v, %v", answer, err)
+		t.Fail()
+	}
+	if _, err = z.Lookup("loop.miek.nl.", TypeA); err != ErrCnameLoop {
+		t.Logf("Expected ErrCnameLoop, got %v", err)
+		t.Fail()
+	}
+	if answer, _ = z.Lookup("none.miek.nl.", TypeA); len(answer) != 0 {
+		t.Logf("Expected no answer, got %v", answer)
+		t.Fail()
+	}
+}
+
+func TestZoneSOA(t *testing.T) {
+	z := NewZone("miek.nl.")
+	if z.SOA() != nil || z.Serial() != 0 {
+		t.Log("Empty zone should have no SOA")
+		t.Fail()
+	}
+	soa, _ := NewRR("miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 2012081601 14400 3600 604800 86400")
+	z.Insert(soa)
+	if z.SOA() != soa || z.Serial() != 2012081601 {
+		t.Logf("Expected SOA %s, got %s", soa, z.SOA())
+		t.Fail()
+	}
+}
+
+func TestZoneConcurrent(t *testing.T) {
+	z := newTestZone(t, 10)
+	rrs := make([]RR, 50)
+	for i := range rrs {
+		rrs[i], _ = NewRR("*.w" + strconv.Itoa(i%5) + ".miek.nl. IN A 127.0.0.1")
+	}
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := i; j < len(rrs); j += 4 {
+				z.Insert(rrs[j])
+				z.Remove(rrs[j])
+			}
+			done <- true
+		}(i)
+	}
+	go func() {
+		for i := 0; i < 100; i++ {
+			z.Find("host" + strconv.Itoa(i%10) + ".miek.nl.")
+			z.FindWildcard("x.w1.miek.nl.")
+			z.Lookup("host1.miek.nl.", TypeA)
+			z.Walk(func(string, *ZoneData) error { return nil })
+			z.Serial()
+		}
+		done <- true
+	}()
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+}
+
+func TestZoneLookupConcurrent(t *testing.T) {
+	z := newTestZone(t, 1)
+	churn, _ := NewRR("www.miek.nl. IN A 127.0.0.1")
+	stable, _ := NewRR("www.miek.nl. IN A 127.0.0.2")
+	z.Insert(churn)
+	z.Insert(stable)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			z.Remove(churn)
+			z.Insert(churn)
+		}
+		done <- true
+	}()
+	for i := 0; i < 1000; i++ {
+		answer, _ := z.Lookup("www.miek.nl.", TypeA)
+		if len(answer) == 0 || len(answer) > 2 || len(answer) == 2 && sameRR(answer[0], answer[1]) {
+			t.Fatalf("Lookup during a change returned %v", answer)
+		}
+	}
+	<-done
+}
+
+func TestZoneChangeConcurrent(t *testing.T) {
+	z := newTestZone(t, 1)
+	z.IXFRJournalSize = 100
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 10; j++ {
+				soa, _ := NewRR("miek.nl. 3600 IN SOA open.nlnetlabs.nl. miekg.atoom.net. " + strconv.Itoa(i*10+j+2) + " 14400 3600 604800 86400")
+				a, _ := NewRR("c" + strconv.Itoa(i) + ".miek.nl. IN A 127.0.0.1")
+				z.Change(soa.(*RR_SOA), nil, []RR{a})
+			}
+			done <- true
+		}(i)
+	}
+	go func() {
+		for i := 0; i < 200; i++ {
+			if z.SOA() == nil {
+				t.Log("SOA should never be missing during a change")
+				t.Fail()
+				break
+			}
+		}
+		done <- true
+	}()
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+	if len(z.journal) != 40 {
+		t.Fatalf("Expected 40 journal entries, got %d", len(z.journal))
+	}
+	for i := 1; i < len(z.journal); i++ {
+		if z.journal[i].from != z.journal[i-1].to {
+			t.Logf("Journal entry %d does not follow the previous one", i)
+			t.Fail()
+		}
+	}
+
+	// A change with an out of zone record is not applied at all.
+	serial := z.Serial()
+	soa, _ := NewRR("miek.nl. 3600 IN SOA open.nlnetlabs.nl. miekg.atoom.net. 100 14400 3600 604800 86400")
+	in, _ := NewRR("d.miek.nl. IN A 127.0.0.1")
+	out, _ := NewRR("www.example.org. IN A 127.0.0.1")
+	if err := z.Change(soa.(*RR_SOA), nil, []RR{in, out}); err == nil {
+		t.Fatal("Expected an error for out of zone data")
+	}
+	if _, exact := z.Find("d.miek.nl."); exact || z.Serial() != serial {
+		t.Log("A failed change should leave the zone alone")
+		t.Fail()
+	}
+}
+
+func TestSignRRsets(t *testing.T) {
+	z := newTestZone(t, 2)
+	for _, s := range []string{
+		"sub.miek.nl. 3600 IN NS ns.sub.miek.nl.",
+		"ns.sub.miek.nl. 3600 IN A 127.0.0.2",
+	} {
+		r, _ := NewRR(s)
+		z.Insert(r)
+	}
+	key := new(RR_DNSKEY)
+	key.Hdr = RR_Header{"miek.nl.", TypeDNSKEY, ClassINET, 3600, 0}
+	key.Flags = 256
+	key.Protocol = 3
+	key.Algorithm = RSASHA256
+	priv, err := key.Generate(1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err.Error())
+	}
+	if err := z.SignRRsets(key, priv, SignOptions{}); err != nil {
+		t.Fatalf("Failed to sign zone: %s", err.Error())
+	}
+	// Sign again, the signatures should be replaced, not added
+	if err := z.SignRRsets(key, priv, SignOptions{}); err != nil {
+		t.Fatalf("Failed to sign zone: %s", err.Error())
+	}
+
+	m := new(Msg)
+	m.SetQuestion("host0.miek.nl.", TypeA)
+	m.SetEdns0(4096, true)
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatalf("DO bit not set in query")
+	}
+	answer, err := z.LookupSigned(m.Question[0].Name, m.Question[0].Qtype)
+	if err != nil || len(answer) != 2 {
+		t.Fatalf("Expected an A record and its RRSIG, got %v, %v", answer, err)
+	}
+	sig, ok := answer[1].(*RR_RRSIG)
+	if !ok {
+		t.Fatalf("Expected an RRSIG, got %s", answer[1].String())
+	}
+	if err := sig.Verify(key, answer[:1]); err != nil {
+		t.Logf("Failed to verify the A RRset: %s", err.Error())
+		t.Fail()
+	}
+	if !sig.ValidityPeriod() {
+		t.Log("Signature should be valid now")
+		t.Fail()
+	}
+	if answer, _ := z.Lookup("host0.miek.nl.", TypeA); len(answer) != 1 {
+		t.Logf("Lookup should not return signatures, got %v", answer)
+		t.Fail()
+	}
+
+	zd, _ := z.Find("sub.miek.nl.")
+	if len(zd.Signatures[TypeNS]) != 0 {
+		t.Log("Delegation NS RRset should not be signed")
+		t.Fail()
+	}
+	zd, _ = z.Find("ns.sub.miek.nl.")
+	if len(zd.Signatures[TypeA]) != 0 {
+		t.Log("Glue should not be signed")
+		t.Fail()
+	}
+
+	past := time.Now().Add(-48 * time.Hour)
+	err = z.SignRRsets(key, priv, SignOptions{Inception: past, Expiration: past.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Failed to sign zone: %s", err.Error())
+	}
+	answer, _ = z.LookupSigned("host0.miek.nl.", TypeA)
+	if len(answer) != 2 || answer[1].(*RR_RRSIG).ValidityPeriod() {
+		t.Logf("Expected a single expired signature, got %v", answer)
+		t.Fail()
+	}
+}
+
+func TestGenerateNSEC(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400",
+		"miek.nl. IN NS ns.miek.nl.",
+		"ns.miek.nl. IN A 127.0.0.1",
+		"a.miek.nl. IN A 127.0.0.1",
+		"x.b.miek.nl. IN A 127.0.0.1", // b.miek.nl. is an empty non-terminal
+		"sub.miek.nl. IN NS ns.sub.miek.nl.",
+		"ns.sub.miek.nl. IN A 127.0.0.2", // glue
+		"Z.miek.nl. IN MX 10 a.miek.nl.",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	if err := z.GenerateNSEC(); err != nil {
+		t.Fatalf("Failed to generate NSEC chain: %s", err.Error())
+	}
+	chain := []string{"miek.nl.", "a.miek.nl.", "x.b.miek.nl.", "ns.miek.nl.", "sub.miek.nl.", "Z.miek.nl."}
+	for i, name := range chain {
+		zd, exact := z.Find(name)
+		if !exact || len(zd.RR[TypeNSEC]) != 1 {
+			t.Fatalf("No NSEC at %s", name)
+		}
+		nsec := zd.RR[TypeNSEC][0].(*RR_NSEC)
+		if next := chain[(i+1)%len(chain)]; nsec.NextDomain != next {
+			t.Logf("NSEC at %s should point to %s, got %s", name, next, nsec.NextDomain)
+			t.Fail()
+		}
+		if nsec.Hdr.Ttl != 86400 {
+			t.Logf("NSEC TTL should be the SOA minimum, got %d", nsec.Hdr.Ttl)
+			t.Fail()
+		}
+	}
+	zd, _ := z.Find("sub.miek.nl.")
+	if bitmap := zd.RR[TypeNSEC][0].(*RR_NSEC).TypeBitMap; len(bitmap) != 3 || bitmap[0] != TypeNS || bitmap[1] != TypeRRSIG || bitmap[2] != TypeNSEC {
+		t.Logf("Wrong NSEC type bitmap at the delegation: %v", bitmap)
+		t.Fail()
+	}
+	if zd, _ := z.Find("ns.sub.miek.nl."); len(zd.RR[TypeNSEC]) != 0 {
+		t.Log("Glue should not get an NSEC")
+		t.Fail()
+	}
+
+	// A resolver proves the non-existence of c.miek.nl. with the NSEC
+	// whose owner name sorts before it and whose next name sorts after it.
+	absent := "c.miek.nl."
+	covered := false
+	z.Walk(func(name string, zd *ZoneData) error {
+		for _, r := range zd.RR[TypeNSEC] {
+			nsec := r.(*RR_NSEC)
+			if canonicalLess(name, absent) && canonicalLess(absent, nsec.NextDomain) {
+				covered = true
+			}
+		}
+		return nil
+	})
+	if !covered {
+		t.Logf("No NSEC covers %s", absent)
+		t.Fail()
+	}
+}
+
+// The zone from RFC 5155, Appendix A.
+func TestGenerateNSEC3(t *testing.T) {
+	z := NewZone("example.")
+	for _, s := range []string{
+		"example. 3600 IN SOA ns1.example. bugs.x.w.example. 1 3600 300 3600000 3600",
+		"example. 3600 IN NS ns1.example.",
+		"example. 3600 IN NS ns2.example.",
+		"example. 3600 IN MX 1 xx.example.",
+		"a.example. 3600 IN NS ns1.a.example.",
+		"a.example. 3600 IN NS ns2.a.example.",
+		"a.example. 3600 IN DS 58470 5 1 3079F1593EBAD6DC121E202A8B766A6A4837206C",
+		"ns1.a.example. 3600 IN A 192.0.2.5",
+		"ns2.a.example. 3600 IN A 192.0.2.6",
+		"ai.example. 3600 IN A 192.0.2.9",
+		"c.example. 3600 IN NS ns1.c.example.",
+		"c.example. 3600 IN NS ns2.c.example.",
+		"ns1.c.example. 3600 IN A 192.0.2.7",
+		"ns2.c.example. 3600 IN A 192.0.2.8",
+		"ns1.example. 3600 IN A 192.0.2.1",
+		"ns2.example. 3600 IN A 192.0.2.2",
+		"*.w.example. 3600 IN MX 1 ai.example.",
+		"x.w.example. 3600 IN MX 1 xx.example.",
+		"x.y.w.example. 3600 IN MX 1 xx.example.",
+		"xx.example. 3600 IN A 192.0.2.10",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	if err := z.GenerateNSEC3("aabbccdd", 12, true); err != nil {
+		t.Fatalf("Failed to generate NSEC3 chain: %s", err.Error())
+	}
+	// Twice, the first chain should be replaced
+	if err := z.GenerateNSEC3("aabbccdd", 12, true); err != nil {
+		t.Fatalf("Failed to generate NSEC3 chain: %s", err.Error())
+	}
+	if len(z.nsec3) != 11 {
+		t.Fatalf("Expected 11 NSEC3 records, got %d", len(z.nsec3))
+	}
+	apex, _ := z.Find("example.")
+	if len(apex.RR[TypeNSEC3PARAM]) != 1 {
+		t.Log("No NSEC3PARAM at the apex")
+		t.Fail()
+	}
+	zd, exact := z.Find("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.")
+	if !exact || len(zd.RR[TypeNSEC3]) != 1 {
+		t.Fatal("No NSEC3 for the apex")
+	}
+	n := zd.RR[TypeNSEC3][0].(*RR_NSEC3)
+	if n.NextDomain != "2T7B4G4VSA5SMI47K61MV5BV1A22BOJR" || n.Flags != 1 || !n.MatchType(TypeNSEC3PARAM) || !n.MatchType(TypeRRSIG) {
+		t.Logf("Wrong apex NSEC3: %s", n.String())
+		t.Fail()
+	}
+	// y.w.example. is an empty non-terminal, c.example. is opted out
+	if _, exact := z.Find("ji6neoaepv8b5o6k4ev33abha8ht9fgc.example."); !exact {
+		t.Log("No NSEC3 for the empty non-terminal y.w.example.")
+		t.Fail()
+	}
+	if _, exact := z.Find("4g6p9u5gvfshp30pqecj98b3maqbn1ck.example."); exact {
+		t.Log("The insecure delegation c.example. should be opted out")
+		t.Fail()
+	}
+
+	// RFC 5155, Appendix B.1: the name error proof for a.c.x.w.example.
+	proof := z.NSEC3Proof("a.c.x.w.example.")
+	want := []string{
+		"b4um86eghhds6nea196smvmlo4ors995.example.", // matches x.w.example.
+		"0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.", // covers c.x.w.example.
+		"35mthgpgcu1qg68fab165klnsnk3dpvl.example.", // covers *.x.w.example.
+	}
+	if len(proof) != len(want) {
+		t.Fatalf("Expected %d NSEC3 records in the proof, got %v", len(want), proof)
+	}
+	for i, r := range proof {
+		if r.Header().Name != want[i] {
+			t.Logf("Proof record %d should be %s, got %s", i, want[i], r.Header().Name)
+			t.Fail()
+		}
+	}
+}
+
+func TestGlue(t *testing.T) {
+	z := newTestZone(t, 0)
+	for _, s := range []string{
+		"sub.miek.nl. 3600 IN NS ns.sub.miek.nl.",
+		"sub.miek.nl. 3600 IN NS ns.example.org.",
+		"ns.sub.miek.nl. 3600 IN A 127.0.0.2",
+		"ns.sub.miek.nl. 3600 IN AAAA ::2",
+		"out.miek.nl. 3600 IN NS ns.example.org.",
+	} {
+		r, _ := NewRR(s)
+		z.Insert(r)
+	}
+	if glue := z.Glue("sub.miek.nl."); len(glue) != 2 || glue[0].Header().Name != "ns.sub.miek.nl." {
+		t.Logf("Expected an A and AAAA glue record, got %v", glue)
+		t.Fail()
+	}
+	if glue := z.Glue("out.miek.nl."); len(glue) != 0 {
+		t.Logf("Out of zone nameservers need no glue, got %v", glue)
+		t.Fail()
+	}
+
+	req := new(Msg)
+	req.SetQuestion("www.sub.miek.nl.", TypeA)
+	m := z.Referral(req, "sub.miek.nl.")
+	if m.Authoritative || len(m.Answer) != 0 || len(m.Ns) != 2 || len(m.Extra) != 2 {
+		t.Logf("Wrong referral: %s", m.String())
+		t.Fail()
+	}
+}
+
+func TestClosestDelegation(t *testing.T) {
+	z := NewZone("example.com.")
+	for _, s := range []string{
+		"example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 14400 3600 604800 86400",
+		"example.com. 3600 IN NS ns.example.com.",
+		"ns.example.com. 3600 IN A 127.0.0.1",
+		"sub.example.com. 3600 IN NS ns.sub.example.com.",
+		"ns.sub.example.com. 3600 IN A 127.0.0.2",
+		"deeper.sub.example.com. 3600 IN NS ns.example.org.",
+	} {
+		r, _ := NewRR(s)
+		z.Insert(r)
+	}
+	tests := map[string]string{
+		"x.sub.example.com.":        "sub.example.com.",
+		"sub.example.com.":          "sub.example.com.",
+		"x.deeper.sub.example.com.": "sub.example.com.",
+		"ns.example.com.":           "",
+		"example.com.":              "",
+		"nonexistent.example.com.":  "",
+		"x.sub.example.org.":        "",
+	}
+	for name, cut := range tests {
+		zd, ok := z.ClosestDelegation(name)
+		if ok != (cut != "") || ok && (zd.Name != cut || len(zd.RR[TypeNS]) != 1) {
+			t.Logf("Expected the delegation of %s to be %q, got %v", name, cut, zd)
+			t.Fail()
+		}
+	}
+
+	req := new(Msg)
+	req.SetQuestion("x.sub.example.com.", TypeA)
+	zd, _ := z.ClosestDelegation(req.Question[0].Name)
+	m := z.Referral(req, zd.Name)
+	if len(m.Ns) != 1 || len(m.Extra) != 1 || m.Extra[0].Header().Name != "ns.sub.example.com." {
+		t.Logf("Wrong referral: %s", m.String())
+		t.Fail()
+	}
+}
+
+func TestZoneAnswer(t *testing.T) {
+	z := NewZone("miek.nl.")
+	for _, s := range []string{
+		"miek.nl. IN SOA open.nlnetlabs.nl. miekg.atoom.net. 1 14400 3600 604800 86400",
+		"miek.nl. IN NS ns.miek.nl.",
+		"ns.miek.nl. IN A 127.0.0.1",
+		"www.miek.nl. IN A 127.0.0.2",
+		"sub.miek.nl. IN NS ns.sub.miek.nl.",
+		"ns.sub.miek.nl. IN A 127.0.0.3",
+	} {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		z.Insert(r)
+	}
+	tests := []struct {
+		name          string
+		qtype         uint16
+		rcode         int
+		authoritative bool
+		answer, ns    int
+	}{
+		{"www.miek.nl.", TypeA, RcodeSuccess, true, 1, 0},
+		{"www.miek.nl.", TypeAAAA, RcodeSuccess, true, 0, 1}, // NODATA
+		{"www.miek.nl.", TypeANY, RcodeSuccess, true, 1, 0},
+		{"miek.nl.", TypeANY, RcodeSuccess, true, 2, 0}, // SOA and NS
+		{"nope.miek.nl.", TypeANY, RcodeNameError, true, 0, 1},
+		{"nope.miek.nl.", TypeA, RcodeNameError, true, 0, 1},
+		{"sub.miek.nl.", TypeA, RcodeSuccess, false, 0, 1}, // referral
+		{"www.sub.miek.nl.", TypeA, RcodeSuccess, false, 0, 1},
+		{"sub.miek.nl.", TypeDS, RcodeSuccess, true, 0, 1}, // the parent has the DS records
+		{"example.org.", TypeA, RcodeRefused, false, 0, 0},
+	}
+	for _, tc := range tests {
+		req := new(Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		m := z.Answer(req)
+		if m.Rcode != tc.rcode || m.Authoritative != tc.authoritative || len(m.Answer) != tc.answer || len(m.Ns) != tc.ns {
+			t.Logf("%s %s: expected rcode %s, AA %v, %d answers and %d in authority, got %s",
+				tc.name, Rr_str[tc.qtype], Rcode_str[tc.rcode], tc.authoritative, tc.answer, tc.ns, m.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestNegativeResponse(t *testing.T) {
+	z := newTestZone(t, 1)
+	req := new(Msg)
+	req.SetQuestion("host0.miek.nl.", TypeMX)
+	m := z.NegativeResponse(req, false)
+	if m.Rcode != RcodeSuccess || !m.Authoritative || len(m.Answer) != 0 || len(m.Question) != 1 {
+		t.Logf("Wrong NODATA reply: %s", m.String())
+		t.Fail()
+	}
+	// The SOA's TTL, 3600, is lower than its minimum of 86400.
+	if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != TypeSOA || m.Ns[0].Header().Ttl != 3600 {
+		t.Logf("Expected the SOA with TTL 3600 in the authority section, got %v", m.Ns)
+		t.Fail()
+	}
+
+	soa, _ := NewRR("miek.nl. 3600 IN SOA open.nlnetlabs.nl. miekg.atoom.net. 2 14400 3600 604800 300")
+	z.Remove(z.SOA())
+	z.Insert(soa)
+	req.SetQuestion("nx.miek.nl.", TypeA)
+	m = z.NegativeResponse(req, true)
+	if m.Rcode != RcodeNameError || !m.Authoritative || len(m.Ns) != 1 || m.Ns[0].Header().Ttl != 300 {
+		t.Logf("Expected NXDOMAIN with the SOA at TTL 300, got %s", m.String())
+		t.Fail()
+	}
+	if soa.Header().Ttl != 3600 {
+		t.Log("The SOA in the zone should not be changed")
+		t.Fail()
+	}
+}
+
+func TestZoneUpdate(t *testing.T) {
+	z := newTestZone(t, 2)
+	rr := func(s string) RR {
+		r, err := NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", s, err.Error())
+		}
+		return r
+	}
+
+	// Add a record
+	m := new(Msg)
+	m.SetUpdate("miek.nl.")
+	m.RRsetAddRdata([]RR{rr("www.miek.nl. 3600 IN A 127.0.0.2")})
+	if rcode := z.Update(m); rcode != RcodeSuccess {
+		t.Fatalf("Add failed with %s", Rcode_str[rcode])
+	}
+	if answer, _ := z.Lookup("www.miek.nl.", TypeA); len(answer) != 1 {
+		t.Logf("Expected the added A record, got %v", answer)
+		t.Fail()
+	}
+	if z.Serial() != 2 {
+		t.Logf("Serial should be incremented to 2, got %d", z.Serial())
+		t.Fail()
+	}
+
+	// Delete host0 only when www exists
+	m = new(Msg)
+	m.SetUpdate("miek.nl.")
+	m.RRsetUsedNoRdata([]RR{rr("www.miek.nl. 3600 IN A 127.0.0.2")})
+	m.RRsetDeleteRR([]RR{rr("host0.miek.nl. 3600 IN A 127.0.0.1")})
+	if rcode := z.Update(m); rcode != RcodeSuccess {
+		t.Fatalf("Conditional delete failed with %s", Rcode_str[rcode])
+	}
+	if answer, _ := z.Lookup("host0.miek.nl.", TypeA); len(answer) != 0 {
+		t.Logf("Expected host0.miek.nl. to be deleted, got %v", answer)
+		t.Fail()
+	}
+
+	// A failing prerequisite leaves the zone alone
+	m = new(Msg)
+	m.SetUpdate("miek.nl.")
+	m.NameNotUsed([]RR{rr("host1.miek.nl. 3600 IN A 127.0.0.1")})
+	m.NameDelete([]RR{rr("www.miek.nl. 3600 IN A 127.0.0.2")})
+	if rcode := z.Update(m); rcode != RcodeYXDomain {
+		t.Logf("Expected YXDOMAIN, got %s", Rcode_str[rcode])
+		t.Fail()
+	}
+	if answer, _ := z.Lookup("www.miek.nl.", TypeA); len(answer) != 1 || z.Serial() != 3 {
+		t.Logf("Zone should be unchanged, got %v and serial %d", answer, z.Serial())
+		t.Fail()
+	}
+	m = new(Msg)
+	m.SetUpdate("miek.nl.")
+	m.RRsetUsedRdata([]RR{rr("host1.miek.nl. 0 IN A 127.0.0.9")})
+	m.NameDelete([]RR{rr("www.miek.nl. 3600 IN A 127.0.0.2")})
+	if rcode := z.Update(m); rcode != RcodeNXRrset {
+		t.Logf("Expected NXRRSET, got %s", Rcode_str[rcode])
+		t.Fail()
+	}
+
+	m = new(Msg)
+	m.SetUpdate("example.org.")
+	if rcode := z.Update(m); rcode != RcodeNotAuth {
+		t.Logf("Expected NOTAUTH for another zone, got %s", Rcode_str[rcode])
+		t.Fail()
+	}
+	m = new(Msg)
+	m.SetUpdate("miek.nl.")
+	m.RRsetAddRdata([]RR{rr("www.example.org. 3600 IN A 127.0.0.2")})
+	if rcode := z.Update(m); rcode != RcodeNotZone {
+		t.Logf("Expected NOTZONE for out of zone data, got %s", Rcode_str[rcode])
+		t.Fail()
+	}
+}
+
+func TestZoneClone(t *testing.T) {
+	z := newTestZone(t, 10)
+	c := z.Clone()
+	if c.Origin != z.Origin || c.Serial() != z.Serial() {
+		t.Fatalf("Expected a clone of %s with serial %d, got %s with %d", z.Origin, z.Serial(), c.Origin, c.Serial())
+	}
+	a, _ := NewRR("host1.miek.nl. 60 IN A 127.0.0.1")
+	b, _ := NewRR("new.miek.nl. 3600 IN A 127.0.0.2")
+	if err := c.Remove(a); err != nil {
+		t.Fatalf("Failed to remove from the clone: %s", err.Error())
+	}
+	c.Insert(b)
+	if zd, _ := c.Find("host0.miek.nl."); zd != nil {
+		zd.RR[TypeA][0].Header().Ttl = 1
+	}
+
+	if zd, exact := z.Find("host1.miek.nl."); !exact || len(zd.RR[TypeA]) != 1 {
+		t.Log("Removing from the clone changed the original")
+		t.Fail()
+	}
+	if _, exact := z.Find("new.miek.nl."); exact {
+		t.Log("Inserting in the clone changed the original")
+		t.Fail()
+	}
+	if zd, _ := z.Find("host0.miek.nl."); zd == nil || zd.RR[TypeA][0].Header().Ttl == 1 {
+		t.Log("Changing a record of the clone changed the original")
+		t.Fail()
+	}
+	if _, exact := c.Find("new.miek.nl."); !exact {
+		t.Log("Expected the inserted record in the clone")
+		t.Fail()
+	}
 }
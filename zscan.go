@@ -105,7 +105,7 @@ func NewRR(s string) (RR, error) {
 // ReadRR reads the RR contained in q. Only the first RR is returned.
 // The class defaults to IN and TTL defaults to 3600.
 func ReadRR(q io.Reader, filename string) (RR, error) {
-	r := <-parseZoneHelper(q, ".", filename, 1)
+	r := <-parseZoneHelper(q, ".", filename, defaultTtl, 1)
 	if r.Error != nil {
 		return nil, r.Error
 	}
@@ -129,17 +129,17 @@ func ReadRR(q io.Reader, filename string) (RR, error) {
 //		}
 //	}      
 func ParseZone(r io.Reader, origin, file string) chan Token {
-	return parseZoneHelper(r, origin, file, 10000)
+	return parseZoneHelper(r, origin, file, defaultTtl, 10000)
 }
 
-func parseZoneHelper(r io.Reader, origin, file string, chansize int) chan Token {
+func parseZoneHelper(r io.Reader, origin, file string, defttl uint32, chansize int) chan Token {
 	t := make(chan Token, chansize)
-	go parseZone(r, origin, file, t, 0)
+	go parseZone(r, origin, file, defttl, t, 0)
 	return t
 
 }
 
-func parseZone(r io.Reader, origin, f string, t chan Token, include int) {
+func parseZone(r io.Reader, origin, f string, defttl uint32, t chan Token, include int) {
 	defer func() {
 		if include == 0 {
 			close(t)
@@ -170,7 +170,6 @@ func parseZone(r io.Reader, origin, f string, t chan Token, include int) {
 
 	st := _EXPECT_OWNER_DIR // initial state
 	var h RR_Header
-	var defttl uint32 = defaultTtl
 	var prevName string
 	for l := range c {
 		if _DEBUG {
@@ -265,7 +264,8 @@ func parseZone(r io.Reader, origin, f string, t chan Token, include int) {
 				t <- Token{Error: &ParseError{f, "too deeply nested $INCLUDE", l}}
 				return
 			}
-			parseZone(r1, l.token, origin, t, include+1)
+			parseZone(r1, origin, l.token, defttl, t, include+1)
+			r1.Close()
 			st = _EXPECT_OWNER_DIR
 		case _EXPECT_DIRTTL_BL:
 			if l.value != _BLANK {